@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// HeaderReader is the part of a chain client needed to map times to blocks.
+type HeaderReader interface {
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+}
+
+// parseTime accepts unix seconds or an RFC 3339 timestamp.
+func parseTime(value string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, expected unix seconds or RFC 3339", value)
+	}
+	return t, nil
+}
+
+// averageBlockTime is the first guess at how far back a time is.
+const averageBlockTime = 12
+
+// BlockAt returns the last block mined at or before t. It steps back from
+// the head by the distance the average block time suggests, doubling the
+// step until it passes t, and then narrows the range down by interpolating
+// between the timestamps of its ends.
+func BlockAt(ctx context.Context, chain HeaderReader, t time.Time) (uint64, error) {
+	head, err := chain.HeaderByNumber(ctx, nil)
+
+	if err != nil {
+		return 0, err
+	}
+
+	target := uint64(t.Unix())
+
+	if head.Time <= target {
+		return head.Number.Uint64(), nil
+	}
+
+	// lo is mined at or before target, hi after it
+	var lo, loTime uint64
+	hi, hiTime := head.Number.Uint64(), head.Time
+	step := (hiTime-target)/averageBlockTime + 1
+
+	for {
+		n := uint64(0)
+		if step < hi {
+			n = hi - step
+		}
+
+		header, err := chain.HeaderByNumber(ctx, new(big.Int).SetUint64(n))
+		if err != nil {
+			return 0, err
+		}
+
+		if header.Time <= target {
+			lo, loTime = n, header.Time
+			break
+		}
+
+		if n == 0 {
+			return 0, errors.New("time is before the first block")
+		}
+
+		hi, hiTime = n, header.Time
+		step *= 2
+	}
+
+	for bisect := false; hi-lo > 1; bisect = !bisect {
+		// interpolation finds regularly mined blocks in a few steps,
+		// bisecting every other step bounds the irregular ones
+		mid := lo + (hi-lo)/2
+
+		if !bisect {
+			mid = lo + (target-loTime)*(hi-lo)/(hiTime-loTime)
+			if mid <= lo {
+				mid = lo + 1
+			} else if mid >= hi {
+				mid = hi - 1
+			}
+		}
+
+		header, err := chain.HeaderByNumber(ctx, new(big.Int).SetUint64(mid))
+		if err != nil {
+			return 0, err
+		}
+
+		if header.Time <= target {
+			lo, loTime = mid, header.Time
+		} else {
+			hi, hiTime = mid, header.Time
+		}
+	}
+
+	return lo, nil
+}
+
+// headerConfirmations is how deep a header has to be before HeaderCache
+// keeps it, so a reorg can't leave a stale one behind.
+const headerConfirmations = 64
+
+// HeaderCache remembers the headers of blocks, other than the most recent
+// ones, so repeated lookups of nearby times don't ask the chain again.
+type HeaderCache struct {
+	HeaderReader
+	Size int
+
+	mu      sync.Mutex
+	head    uint64
+	headers map[uint64]*types.Header
+}
+
+func NewHeaderCache(chain HeaderReader, size int) *HeaderCache {
+	return &HeaderCache{HeaderReader: chain, Size: size, headers: map[uint64]*types.Header{}}
+}
+
+func (h *HeaderCache) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	if number != nil {
+		h.mu.Lock()
+		header, ok := h.headers[number.Uint64()]
+		h.mu.Unlock()
+
+		if ok {
+			return header, nil
+		}
+	}
+
+	header, err := h.HeaderReader.HeaderByNumber(ctx, number)
+
+	if err != nil {
+		return nil, err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	n := header.Number.Uint64()
+
+	if number == nil {
+		if n > h.head {
+			h.head = n
+		}
+		return header, nil
+	}
+
+	if n+headerConfirmations > h.head {
+		return header, nil
+	}
+
+	if len(h.headers) >= h.Size {
+		// any entry will do, BlockAt rarely asks for the same block twice
+		// unless it is asked for the same time
+		for old := range h.headers {
+			delete(h.headers, old)
+			break
+		}
+	}
+
+	h.headers[n] = header
+	return header, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"net/http"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// fakeHeaders is a chain of blocks mined every 12 seconds, with every
+// seventh slot missed, counting the headers asked for.
+type fakeHeaders struct {
+	head  uint64
+	calls int
+}
+
+func (f *fakeHeaders) time(n uint64) uint64 {
+	return 1_600_000_000 + 12*(n+n/6)
+}
+
+func (f *fakeHeaders) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	f.calls++
+
+	n := f.head
+	if number != nil {
+		n = number.Uint64()
+	}
+
+	if n > f.head {
+		return nil, errors.New("not found")
+	}
+	return &types.Header{Number: new(big.Int).SetUint64(n), Time: f.time(n)}, nil
+}
+
+func TestBlockAt(t *testing.T) {
+	chain := &fakeHeaders{head: 16_000_000}
+	head := chain.time(chain.head)
+
+	for _, at := range []uint64{
+		head + 100, head, head - 1, head - 3600, head - 86400, head - 30*86400,
+		chain.time(1), chain.time(1) + 5, chain.time(0), chain.time(12_345_678) - 1,
+	} {
+		want := uint64(sort.Search(int(chain.head)+1, func(n int) bool { return chain.time(uint64(n)) > at })) - 1
+
+		chain.calls = 0
+		got, err := BlockAt(context.Background(), chain, time.Unix(int64(at), 0))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got != want {
+			t.Errorf("BlockAt(%d) = %d, want %d", at, got, want)
+		}
+
+		// a binary search from genesis takes 25
+		if chain.calls > 12 {
+			t.Errorf("BlockAt(%d) asked for %d headers", at, chain.calls)
+		}
+	}
+
+	if _, err := BlockAt(context.Background(), chain, time.Unix(int64(chain.time(0))-1, 0)); err == nil {
+		t.Error("found a block before the first one")
+	}
+}
+
+func TestHeaderCache(t *testing.T) {
+	chain := &fakeHeaders{head: 16_000_000}
+	cache := NewHeaderCache(chain, 1024)
+	at := time.Unix(int64(chain.time(15_000_000)+5), 0)
+
+	first, err := BlockAt(context.Background(), cache, at)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chain.calls = 0
+	second, err := BlockAt(context.Background(), cache, at)
+
+	if err != nil || second != first {
+		t.Fatalf("got %d %v, then %d", first, err, second)
+	}
+
+	// only the head is asked for again
+	if chain.calls != 1 {
+		t.Errorf("asked for %d headers the second time", chain.calls)
+	}
+
+	// recent headers may still be reorged
+	chain.calls = 0
+	cache.HeaderByNumber(context.Background(), big.NewInt(int64(chain.head-1)))
+	cache.HeaderByNumber(context.Background(), big.NewInt(int64(chain.head-1)))
+
+	if chain.calls != 2 {
+		t.Errorf("cached a recent header")
+	}
+}
+
+func TestResolveAtSimulated(t *testing.T) {
+	chain := newSimulatedChain(t)
+	citizen := chain.deployStoredCitizen()
+	contracts := &CitizenContracts{Old: citizen, New: &fakeCitizenContract{}, Chain: NewHeaderCache(chain, 64)}
+
+	// the contract is deployed in block 1, version n is set in block 2n
+	for version := int64(1); version <= 3; version++ {
+		citizen.setVersion(7, version)
+		chain.Commit()
+		chain.Commit()
+	}
+
+	tokenURIAt := func(at time.Time) (string, error) {
+		spec := &RenderSpec{TokenID: 7}
+
+		if err := resolveAt(context.Background(), spec, contracts, at.Format(time.RFC3339)); err != nil {
+			return "", err
+		}
+
+		uri, _, err := contracts.TokenURI(spec.CallOpts(context.Background()), big.NewInt(7))
+		return uri, err
+	}
+
+	for block, want := range map[uint64]string{2: "version 1", 3: "version 1", 4: "version 2", 5: "version 2", 6: "version 3", 7: "version 3"} {
+		header, err := chain.HeaderByNumber(context.Background(), new(big.Int).SetUint64(block))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// any time before the next block resolves to this one
+		for _, at := range []time.Time{time.Unix(int64(header.Time), 0), time.Unix(int64(header.Time)+9, 0)} {
+			uri, err := tokenURIAt(at)
+
+			if err != nil {
+				t.Fatalf("block %d: %v", block, err)
+			}
+
+			if metadata, _ := DecodeTokenURI(uri); metadata == nil || metadata.Description != want {
+				t.Errorf("got %s at block %d, want %s", uri, block, want)
+			}
+		}
+	}
+
+	// before the token was minted
+	genesis, _ := chain.HeaderByNumber(context.Background(), big.NewInt(1))
+
+	if _, err := tokenURIAt(time.Unix(int64(genesis.Time), 0)); err == nil {
+		t.Error("got a tokenURI from before the token existed")
+	}
+
+	if err := resolveAt(context.Background(), &RenderSpec{}, contracts, "yesterday"); statusOf(err) != http.StatusBadRequest {
+		t.Errorf("got %v for an invalid time", err)
+	}
+}
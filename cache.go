@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrCacheMiss is returned by a Cache when no entry exists for a key.
+var ErrCacheMiss = errors.New("cache miss")
+
+// CacheEntry describes a stored render.
+type CacheEntry struct {
+	ContentType string
+	Metadata    map[string]string
+	Size        int64
+	ModTime     time.Time
+}
+
+// Cache stores rendered images keyed by a slash separated path such as
+// "s1/400x400/1.png".
+type Cache interface {
+	Get(ctx context.Context, key string) ([]byte, *CacheEntry, error)
+	Put(ctx context.Context, key string, data []byte, entry CacheEntry) error
+	Stat(ctx context.Context, key string) (*CacheEntry, error)
+	Delete(ctx context.Context, key string) error
+	// List returns the keys starting with prefix, such as every variant
+	// of a token under "s1/42/".
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// NewCacheFromEnv builds the cache selected by CACHE_BACKEND ("fs" or "s3").
+func NewCacheFromEnv() (Cache, error) {
+	switch strings.ToLower(os.Getenv("CACHE_BACKEND")) {
+	case "", "fs", "file", "disk":
+		dir := os.Getenv("CACHE_DIR")
+		if dir == "" {
+			dir = "images"
+		}
+		return NewFileCache(dir)
+	case "s3":
+		return NewS3CacheFromEnv()
+	}
+	return nil, errors.New("unknown CACHE_BACKEND " + os.Getenv("CACHE_BACKEND"))
+}
+
+// cleanKey normalizes a cache key and rejects keys escaping the cache root.
+func cleanKey(key string) (string, error) {
+	cleaned := path.Clean("/" + key)[1:]
+	if cleaned == "" || cleaned == "." {
+		return "", errors.New("empty cache key")
+	}
+	return cleaned, nil
+}
+
+// FileCache stores entries as files under Root, mirroring the layout the
+// service has always used in ./images. Content type and metadata live in a
+// sidecar "<file>.meta.json".
+type FileCache struct {
+	Root string
+}
+
+type fileCacheMeta struct {
+	ContentType string            `json:"content_type"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+func NewFileCache(root string) (*FileCache, error) {
+	if err := os.MkdirAll(root, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &FileCache{Root: root}, nil
+}
+
+func (f *FileCache) path(key string) (string, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(f.Root, filepath.FromSlash(key)), nil
+}
+
+func (f *FileCache) Get(ctx context.Context, key string) ([]byte, *CacheEntry, error) {
+	p, err := f.path(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data, err := os.ReadFile(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, ErrCacheMiss
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	entry, err := f.Stat(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, entry, nil
+}
+
+func (f *FileCache) Put(ctx context.Context, key string, data []byte, entry CacheEntry) error {
+	p, err := f.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+		return err
+	}
+
+	meta, err := json.Marshal(fileCacheMeta{entry.ContentType, entry.Metadata})
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(p+".meta.json", meta); err != nil {
+		return err
+	}
+	return writeFileAtomic(p, data)
+}
+
+func (f *FileCache) Stat(ctx context.Context, key string) (*CacheEntry, error) {
+	p, err := f.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrCacheMiss
+	} else if err != nil {
+		return nil, err
+	}
+
+	entry := &CacheEntry{
+		ContentType: mime.TypeByExtension(filepath.Ext(p)),
+		Size:        info.Size(),
+		ModTime:     info.ModTime(),
+	}
+
+	// files cached before the sidecar existed simply have no metadata
+	if raw, err := os.ReadFile(p + ".meta.json"); err == nil {
+		var meta fileCacheMeta
+		if err := json.Unmarshal(raw, &meta); err == nil {
+			if meta.ContentType != "" {
+				entry.ContentType = meta.ContentType
+			}
+			entry.Metadata = meta.Metadata
+		}
+	}
+
+	return entry, nil
+}
+
+func (f *FileCache) Delete(ctx context.Context, key string) error {
+	p, err := f.path(key)
+	if err != nil {
+		return err
+	}
+
+	os.Remove(p + ".meta.json")
+
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (f *FileCache) List(ctx context.Context, prefix string) ([]string, error) {
+	// only walk the deepest directory the prefix is sure to be in
+	dir := path.Dir(prefix + "x")
+	if dir == "." {
+		dir = ""
+	}
+
+	start := filepath.Join(f.Root, filepath.FromSlash(dir))
+
+	var keys []string
+
+	err := filepath.WalkDir(start, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+
+		if d.IsDir() || strings.HasSuffix(p, ".meta.json") || strings.HasPrefix(d.Name(), ".tmp-") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(f.Root, p)
+		if err != nil {
+			return err
+		}
+
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return ctx.Err()
+	})
+
+	return keys, err
+}
+
+// writeFileAtomic writes data to a temporary file next to name and renames
+// it into place so readers never observe a partially written file.
+func writeFileAtomic(name string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".tmp-*")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), name)
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/chromedp/chromedp"
+)
+
+// ChromeRenderer screenshots SVGs in a long-lived headless Chrome, which
+// has to be installed. It draws everything a browser does. Renders run in
+// reused tabs, at most Tabs at a time, and the browser is started again
+// when it crashes.
+type ChromeRenderer struct {
+	Tabs int
+	// Timeout bounds a single render, not including the wait for a tab.
+	Timeout time.Duration
+	// Options are the flags Chrome is started with.
+	Options []chromedp.ExecAllocatorOption
+
+	sem chan struct{}
+
+	mu        sync.Mutex
+	browser   *chromeBrowser
+	idle      []*chromeTab
+	busy      int
+	waiting   int
+	renders   uint64
+	failures  uint64
+	crashes   uint64
+	restarts  uint64
+	waits     uint64
+	waitTotal time.Duration
+	waitMax   time.Duration
+	lastError string
+	started   bool
+}
+
+type chromeBrowser struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+type chromeTab struct {
+	browser *chromeBrowser
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// ChromeStats is a snapshot of the browser pool.
+type ChromeStats struct {
+	Running        bool    `json:"running"`
+	Tabs           int     `json:"tabs"`
+	Busy           int     `json:"busy"`
+	Idle           int     `json:"idle"`
+	Waiting        int     `json:"waiting"`
+	Renders        uint64  `json:"renders"`
+	Failures       uint64  `json:"failures"`
+	Crashes        uint64  `json:"crashes"`
+	Restarts       uint64  `json:"restarts"`
+	QueueWaitAvgMs float64 `json:"queue_wait_avg_ms"`
+	QueueWaitMaxMs float64 `json:"queue_wait_max_ms"`
+	LastError      string  `json:"last_error,omitempty"`
+}
+
+func NewChromeRenderer(tabs int, timeout time.Duration) *ChromeRenderer {
+	return &ChromeRenderer{
+		Tabs:    tabs,
+		Timeout: timeout,
+		Options: append([]chromedp.ExecAllocatorOption{}, chromedp.DefaultExecAllocatorOptions[:]...),
+		sem:     make(chan struct{}, tabs),
+	}
+}
+
+// NewChromeRendererFromEnv reads CHROME_TABS, CHROME_TIMEOUT and
+// CHROME_PATH, the Chrome binary to use instead of the one found on PATH.
+func NewChromeRendererFromEnv() *ChromeRenderer {
+	r := NewChromeRenderer(envInt("CHROME_TABS", 4), envDuration("CHROME_TIMEOUT", 30*time.Second))
+
+	if path := os.Getenv("CHROME_PATH"); path != "" {
+		r.Options = append(r.Options, chromedp.ExecPath(path))
+	}
+
+	return r
+}
+
+func (r *ChromeRenderer) RenderSVG(ctx context.Context, svg []byte) (image.Image, error) {
+	width, height, err := SVGSize(svg)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.wait(ctx); err != nil {
+		return nil, err
+	}
+	defer func() { <-r.sem }()
+
+	tab, err := r.acquire()
+
+	if err != nil {
+		r.record(err)
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.Timeout)
+	defer cancel()
+
+	// actions run on the tab's context, which outlives the request, so they
+	// are stopped separately when the request is done
+	runCtx, stop := context.WithCancel(tab.ctx)
+	defer stop()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			stop()
+		case <-runCtx.Done():
+		}
+	}()
+
+	var buf []byte
+
+	// the SVG may not be inline, so the browser is handed what was already
+	// downloaded
+	dataUri := "data:image/svg+xml;base64," + base64.StdEncoding.EncodeToString(svg)
+
+	err = chromedp.Run(runCtx, fullScreenshot(dataUri, 100, int(width*PartScale), int(height*PartScale), &buf))
+
+	if err != nil && ctx.Err() != nil {
+		err = fmt.Errorf("chrome render: %w", ctx.Err())
+	}
+
+	r.release(tab, err == nil)
+	r.record(err)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return png.Decode(bytes.NewReader(buf))
+}
+
+// wait takes a slot of the semaphore, recording how long it took.
+func (r *ChromeRenderer) wait(ctx context.Context) error {
+	queued := time.Now()
+
+	r.mu.Lock()
+	r.waiting++
+	r.mu.Unlock()
+
+	var err error
+
+	select {
+	case r.sem <- struct{}{}:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	waited := time.Since(queued)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.waiting--
+
+	if err == nil {
+		r.waits++
+		r.waitTotal += waited
+		if waited > r.waitMax {
+			r.waitMax = waited
+		}
+	}
+
+	return err
+}
+
+// acquire returns an idle tab or opens a new one, starting the browser
+// first if it isn't running.
+func (r *ChromeRenderer) acquire() (*chromeTab, error) {
+	r.mu.Lock()
+
+	if n := len(r.idle); n > 0 {
+		tab := r.idle[n-1]
+		r.idle = r.idle[:n-1]
+		r.busy++
+		r.mu.Unlock()
+		return tab, nil
+	}
+
+	if r.browser == nil {
+		if err := r.start(); err != nil {
+			r.mu.Unlock()
+			return nil, err
+		}
+	}
+
+	ctx, cancel := chromedp.NewContext(r.browser.ctx)
+	tab := &chromeTab{browser: r.browser, ctx: ctx, cancel: cancel}
+	r.busy++
+
+	r.mu.Unlock()
+
+	// the first Run opens the tab and runs its event loop on the context it's
+	// given, which has to be the tab's own for the tab to be reused
+	if err := chromedp.Run(ctx); err != nil {
+		r.release(tab, false)
+		return nil, fmt.Errorf("open chrome tab: %w", err)
+	}
+
+	return tab, nil
+}
+
+// release puts a tab back in the pool. Tabs that failed a render are
+// closed, as they may be stuck on the page.
+func (r *ChromeRenderer) release(tab *chromeTab, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.busy--
+
+	if ok && tab.browser == r.browser {
+		r.idle = append(r.idle, tab)
+		return
+	}
+
+	tab.cancel()
+}
+
+// start launches Chrome. r.mu must be held.
+func (r *ChromeRenderer) start() error {
+	allocCtx, allocCancel := chromedp.NewExecAllocator(context.Background(), r.Options...)
+	ctx, cancel := chromedp.NewContext(allocCtx)
+
+	browser := &chromeBrowser{
+		ctx: ctx,
+		cancel: func() {
+			cancel()
+			allocCancel()
+		},
+	}
+
+	// the first Run launches the browser, it must not have a timeout as
+	// that would stop the browser with it
+	if err := chromedp.Run(ctx); err != nil {
+		browser.cancel()
+		return fmt.Errorf("start chrome: %w", err)
+	}
+
+	if r.started {
+		r.restarts++
+	}
+
+	r.started = true
+	r.browser = browser
+
+	go r.watch(browser, chromedp.FromContext(ctx).Browser.LostConnection)
+
+	return nil
+}
+
+// watch forgets the browser once the connection to it is lost, so the
+// next render starts a new one.
+func (r *ChromeRenderer) watch(browser *chromeBrowser, lost <-chan struct{}) {
+	<-lost
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.browser != browser {
+		return
+	}
+
+	r.crashes++
+	r.lastError = "lost connection to chrome"
+	r.browser = nil
+
+	for _, tab := range r.idle {
+		tab.cancel()
+	}
+	r.idle = nil
+
+	browser.cancel()
+}
+
+// Close stops the browser. A later render starts it again.
+func (r *ChromeRenderer) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, tab := range r.idle {
+		tab.cancel()
+	}
+	r.idle = nil
+
+	if r.browser != nil {
+		r.browser.cancel()
+		r.browser = nil
+	}
+}
+
+func (r *ChromeRenderer) record(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.renders++
+
+	if err != nil {
+		r.failures++
+		r.lastError = err.Error()
+	}
+}
+
+func (r *ChromeRenderer) Stats() ChromeStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats := ChromeStats{
+		Running:        r.browser != nil,
+		Tabs:           r.Tabs,
+		Busy:           r.busy,
+		Idle:           len(r.idle),
+		Waiting:        r.waiting,
+		Renders:        r.renders,
+		Failures:       r.failures,
+		Crashes:        r.crashes,
+		Restarts:       r.restarts,
+		QueueWaitMaxMs: float64(r.waitMax) / float64(time.Millisecond),
+		LastError:      r.lastError,
+	}
+
+	if r.waits > 0 {
+		stats.QueueWaitAvgMs = float64(r.waitTotal) / float64(r.waits) / float64(time.Millisecond)
+	}
+
+	return stats
+}
+
+// chromeRendererOf returns the Chrome renderer used by renderer, if any.
+func chromeRendererOf(renderer PartRenderer) *ChromeRenderer {
+	switch r := renderer.(type) {
+	case *ChromeRenderer:
+		return r
+	case FallbackRenderer:
+		for _, renderer := range r {
+			if chrome := chromeRendererOf(renderer); chrome != nil {
+				return chrome
+			}
+		}
+	}
+	return nil
+}
+
+func fullScreenshot(urlstr string, quality int, w, h int, res *[]byte) chromedp.Tasks {
+	return chromedp.Tasks{
+		chromedp.Navigate(urlstr),
+		chromedp.EmulateViewport(int64(w), int64(h)),
+		chromedp.Screenshot("svg", res, chromedp.NodeVisible),
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/chromedp/chromedp"
+)
+
+// chromeForTest returns a renderer for the Chrome found on the machine,
+// skipping the test when there is none.
+func chromeForTest(t *testing.T, tabs int) *ChromeRenderer {
+	t.Helper()
+
+	r := NewChromeRenderer(tabs, 20*time.Second)
+
+	if path := os.Getenv("CHROME_PATH"); path != "" {
+		r.Options = append(r.Options, chromedp.ExecPath(path))
+		return r
+	}
+
+	for _, name := range []string{"headless-shell", "chromium", "chromium-browser", "google-chrome", "google-chrome-stable"} {
+		if _, err := exec.LookPath(name); err == nil {
+			return r
+		}
+	}
+
+	t.Skip("chrome isn't installed, set CHROME_PATH")
+	return nil
+}
+
+func TestChromeRendererReusesTabs(t *testing.T) {
+	r := chromeForTest(t, 1)
+	t.Cleanup(r.Close)
+
+	svg := []byte(`<svg xmlns="http://www.w3.org/2000/svg" width="20" height="10"><rect width="20" height="10" fill="red"/></svg>`)
+
+	// a single tab, so the second render runs on the tab the first one used
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		img, err := r.RenderSVG(ctx, svg)
+		cancel()
+
+		if err != nil {
+			t.Fatalf("render %d: %v", i, err)
+		}
+
+		if got := img.Bounds().Size(); got.X != 20*PartScale || got.Y != 10*PartScale {
+			t.Fatalf("render %d: size %v", i, got)
+		}
+	}
+
+	stats := r.Stats()
+
+	if stats.Renders != 2 || stats.Failures != 0 || stats.Idle != 1 {
+		t.Fatalf("stats %+v, want 2 renders on 1 idle tab", stats)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	// FetchWorkers bounds how many layers of a single render are downloaded
+	// at the same time.
+	FetchWorkers = 8
+
+	// FetchTimeout bounds a single layer download, including reading the body.
+	FetchTimeout = 20 * time.Second
+
+	// FetchMaxBytes bounds the body of a single download.
+	FetchMaxBytes int64 = 32 << 20
+
+	// layerClient is shared by every layer fetch so connections to the
+	// gateway are kept alive and reused between renders.
+	layerClient = &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			MaxIdleConns:          100,
+			MaxIdleConnsPerHost:   32,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 15 * time.Second,
+		},
+	}
+
+	// publicClient downloads the URLs metadata and SVGs point at, which
+	// anyone can aim at the server's own network. It only connects to
+	// public addresses, redirects included, and goes around any proxy.
+	publicClient = &http.Client{
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout: 10 * time.Second,
+				Control: dialPublicOnly,
+			}).DialContext,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 15 * time.Second,
+		},
+	}
+)
+
+// ErrPrivateAddress is returned for downloads from metadata that resolve
+// to a loopback, private, link-local or otherwise internal address.
+var ErrPrivateAddress = errors.New("fetch: refusing to connect to a non-public address")
+
+// ErrTooLarge is returned for downloads larger than their limit.
+var ErrTooLarge = errors.New("fetch: response is too large")
+
+// carrierGradeNAT is 100.64.0.0/10, shared address space that
+// net.IP.IsPrivate doesn't cover.
+var carrierGradeNAT = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// isPublicIP reports whether ip is routable on the internet.
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() ||
+		carrierGradeNAT.Contains(ip) || ip.To4() != nil && ip.To4()[0] == 0)
+}
+
+// dialPublicOnly is a net.Dialer Control refusing non-public addresses. It
+// runs after name resolution, so DNS can't be used to get around it.
+func dialPublicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+		return fmt.Errorf("%w: %s", ErrPrivateAddress, host)
+	}
+	return nil
+}
+
+// loadFetchConfig applies FETCH_* overrides from the environment.
+func loadFetchConfig() {
+	FetchWorkers = envInt("FETCH_WORKERS", FetchWorkers)
+	FetchTimeout = envDuration("FETCH_TIMEOUT", FetchTimeout)
+	FetchMaxBytes = int64(envInt("FETCH_MAX_BYTES", int(FetchMaxBytes)))
+}
+
+func envInt(name string, fallback int) int {
+	if v, err := strconv.Atoi(os.Getenv(name)); err == nil && v > 0 {
+		return v
+	}
+	return fallback
+}
+
+// envCount is envInt for counts where 0 is meaningful, such as no retries
+// or an empty cache.
+func envCount(name string, fallback int) int {
+	if v, err := strconv.Atoi(os.Getenv(name)); err == nil && v >= 0 {
+		return v
+	}
+	return fallback
+}
+
+func envDuration(name string, fallback time.Duration) time.Duration {
+	if v, err := time.ParseDuration(os.Getenv(name)); err == nil && v > 0 {
+		return v
+	}
+	return fallback
+}
+
+// fetchImage returns the decoded image at url, serving IPFS layers from the
+// layer cache when they have been seen before.
+func fetchImage(ctx context.Context, url string) (*FetchedImage, error) {
+	key, cacheable := layerKey(url)
+
+	if cacheable {
+		if img, ok := layers.Get(key); ok {
+			return &FetchedImage{img, url}, nil
+		}
+	}
+
+	raw, err := fetchRaw(ctx, url)
+
+	if err != nil {
+		return nil, err
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(raw))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if cacheable {
+		layers.Put(key, raw, img)
+	}
+
+	return &FetchedImage{img, url}, nil
+}
+
+// fetchRaw downloads url, routing IPFS URLs through the local mirror and
+// then the gateway pool so they don't depend on the gateway baked into the
+// on-chain SVG. Other URLs are only fetched from public addresses.
+func fetchRaw(ctx context.Context, url string) ([]byte, error) {
+	if groups := IPFSRegex.FindStringSubmatch(url); groups != nil {
+		if data, ok := readMirror(groups[2], groups[3]); ok {
+			return data, nil
+		}
+		return gateways.Fetch(ctx, groups[2], groups[3])
+	}
+	return download(ctx, publicClient, url, FetchMaxBytes)
+}
+
+// HTTPStatusError is returned for responses other than 200 OK.
+type HTTPStatusError struct {
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("fetch %s: %s", e.URL, e.Status)
+}
+
+// httpGet downloads url from a configured gateway with the shared layer
+// client, bounded by FetchTimeout and FetchMaxBytes.
+func httpGet(ctx context.Context, url string) ([]byte, error) {
+	return download(ctx, layerClient, url, FetchMaxBytes)
+}
+
+func download(ctx context.Context, client *http.Client, url string, limit int64) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, FetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &HTTPStatusError{url, resp.StatusCode, resp.Status}
+	}
+
+	if resp.ContentLength > limit {
+		return nil, fmt.Errorf("%w: %s is %d bytes", ErrTooLarge, url, resp.ContentLength)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+
+	if err == nil && int64(len(data)) > limit {
+		return nil, fmt.Errorf("%w: %s is over %d bytes", ErrTooLarge, url, limit)
+	}
+	return data, err
+}
+
+// fetchLayers downloads urls with at most FetchWorkers requests in flight.
+// The result keeps the order of urls so layers are drawn in SVG order;
+// layers that fail to download are left out and reported in the returned
+// error. Cancelling ctx aborts every outstanding download.
+func fetchLayers(ctx context.Context, urls []string) ([]*FetchedImage, error) {
+	results := make([]*FetchedImage, len(urls))
+	errs := make([]error, len(urls))
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+
+	for w := 0; w < min(FetchWorkers, len(urls)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				results[idx], errs[idx] = fetchImage(ctx, urls[idx])
+			}
+		}()
+	}
+
+feed:
+	for idx := range urls {
+		select {
+		case jobs <- idx:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	var fetched []*FetchedImage
+	for _, img := range results {
+		if img != nil {
+			fetched = append(fetched, img)
+		}
+	}
+	return fetched, errors.Join(errs...)
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testLayersCID = "QmTestLayers"
+
+// layerURL is the on-chain href of a test layer.
+func layerURL(path string) string {
+	return DefaultGateway + "/" + testLayersCID + "/" + path
+}
+
+// layerPNG encodes a size x size layer of a single color.
+func layerPNG(size int, c color.Color) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			img.Set(x, y, c)
+		}
+	}
+
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return buf.Bytes()
+}
+
+// testGateway is an IPFS path gateway serving files by their path in any
+// CID, counting requests per path and how many were in flight at once.
+type testGateway struct {
+	*httptest.Server
+	files  map[string][]byte
+	delay  time.Duration
+	status int
+
+	mu          sync.Mutex
+	requests    map[string]int
+	inFlight    int
+	maxInFlight int
+}
+
+func newTestGateway(t *testing.T, files map[string][]byte) *testGateway {
+	gw := &testGateway{files: files, requests: map[string]int{}}
+
+	gw.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the path within whatever CID is asked for
+		path := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/ipfs/"), "/", 2)[1]
+
+		gw.mu.Lock()
+		gw.requests[path]++
+		gw.inFlight++
+		gw.maxInFlight = max(gw.maxInFlight, gw.inFlight)
+		gw.mu.Unlock()
+
+		defer func() {
+			gw.mu.Lock()
+			gw.inFlight--
+			gw.mu.Unlock()
+		}()
+
+		select {
+		case <-time.After(gw.delay):
+		case <-r.Context().Done():
+			return
+		}
+
+		if gw.status != 0 {
+			w.WriteHeader(gw.status)
+			return
+		}
+
+		data, ok := gw.files[path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(gw.Close)
+	return gw
+}
+
+func (gw *testGateway) count(path string) int {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	return gw.requests[path]
+}
+
+// useGateways points the gateway pool at gws, without retries, and starts
+// with an empty layer cache, until the test ends.
+func useGateways(t *testing.T, gws ...*testGateway) *GatewayPool {
+	var urls []string
+	for _, gw := range gws {
+		urls = append(urls, gw.URL+"/ipfs")
+	}
+
+	pool := NewGatewayPool(urls)
+	pool.Retries = 0
+
+	oldGateways, oldLayers := gateways, layers
+	gateways, layers = pool, NewLayerCache(256<<20, "")
+
+	t.Cleanup(func() { gateways, layers = oldGateways, oldLayers })
+	return pool
+}
+
+func TestEnvCount(t *testing.T) {
+	tests := []struct {
+		value    string
+		count    int
+		positive int
+	}{
+		{"", 7, 7},
+		{"3", 3, 3},
+		{"0", 0, 7},
+		{"-1", 7, 7},
+		{"many", 7, 7},
+	}
+
+	for _, test := range tests {
+		t.Setenv("CITIZEN_GEN_TEST", test.value)
+
+		if got := envCount("CITIZEN_GEN_TEST", 7); got != test.count {
+			t.Errorf("envCount(%q) = %d, want %d", test.value, got, test.count)
+		}
+
+		if got := envInt("CITIZEN_GEN_TEST", 7); got != test.positive {
+			t.Errorf("envInt(%q) = %d, want %d", test.value, got, test.positive)
+		}
+	}
+}
+
+func TestIsPublicIP(t *testing.T) {
+	tests := map[string]bool{
+		"1.1.1.1":          true,
+		"2606:4700::1111":  true,
+		"127.0.0.1":        false,
+		"::1":              false,
+		"10.1.2.3":         false,
+		"172.16.0.1":       false,
+		"192.168.1.1":      false,
+		"169.254.169.254":  false,
+		"fe80::1":          false,
+		"fd00::1":          false,
+		"100.64.0.1":       false,
+		"0.0.0.0":          false,
+		"::":               false,
+		"224.0.0.1":        false,
+		"::ffff:127.0.0.1": false,
+	}
+
+	for ip, public := range tests {
+		if got := isPublicIP(net.ParseIP(ip)); got != public {
+			t.Errorf("isPublicIP(%s) = %v, want %v", ip, got, public)
+		}
+	}
+}
+
+func TestFetchRawRefusesPrivateAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("internal"))
+	}))
+	defer server.Close()
+
+	if data, err := fetchRaw(context.Background(), server.URL); !errors.Is(err, ErrPrivateAddress) {
+		t.Errorf("got %q %v for a loopback URL", data, err)
+	}
+
+	// gateways are configured by the operator, so they may be local
+	if data, err := httpGet(context.Background(), server.URL); err != nil || string(data) != "internal" {
+		t.Errorf("got %q %v from a local gateway", data, err)
+	}
+}
+
+func TestDownloadLimit(t *testing.T) {
+	body := strings.Repeat("x", 100)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("chunked") {
+			w.(http.Flusher).Flush()
+		}
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	for _, url := range []string{server.URL, server.URL + "?chunked"} {
+		if data, err := download(context.Background(), layerClient, url, 100); err != nil || len(data) != 100 {
+			t.Errorf("got %d bytes %v at the limit", len(data), err)
+		}
+
+		if data, err := download(context.Background(), layerClient, url, 99); !errors.Is(err, ErrTooLarge) {
+			t.Errorf("got %d bytes %v over the limit from %s", len(data), err, url)
+		}
+	}
+}
+
+func TestFetchLayers(t *testing.T) {
+	files := map[string][]byte{}
+	var urls []string
+
+	for i := 0; i < 12; i++ {
+		path := "hair/" + string(rune('a'+i)) + ".png"
+		files[path] = layerPNG(i+1, color.NRGBA{R: 0xff, A: 0xff})
+		urls = append(urls, layerURL(path))
+	}
+	urls = append(urls[:6], append([]string{layerURL("hair/missing.png")}, urls[6:]...)...)
+
+	gw := newTestGateway(t, files)
+	gw.delay = 20 * time.Millisecond
+	useGateways(t, gw)
+
+	defer func(workers int) { FetchWorkers = workers }(FetchWorkers)
+	FetchWorkers = 3
+
+	fetched, err := fetchLayers(context.Background(), urls)
+
+	var statusErr *HTTPStatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound {
+		t.Errorf("got %v for the missing layer", err)
+	}
+
+	if len(fetched) != 12 {
+		t.Fatalf("got %d layers, want 12", len(fetched))
+	}
+
+	// in SVG order, without the missing layer
+	for i, img := range fetched {
+		if size := img.Img.Bounds().Dx(); size != i+1 || img.URL != layerURL(fmt.Sprintf("hair/%c.png", 'a'+i)) {
+			t.Errorf("layer %d is %s of size %d", i, img.URL, size)
+		}
+	}
+
+	if gw.maxInFlight != FetchWorkers {
+		t.Errorf("%d requests were in flight at once, want %d", gw.maxInFlight, FetchWorkers)
+	}
+}
+
+func TestFetchLayersCancelled(t *testing.T) {
+	gw := newTestGateway(t, map[string][]byte{"hair/a.png": layerPNG(1, color.Black)})
+	gw.delay = time.Minute
+	useGateways(t, gw)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	fetched, err := fetchLayers(ctx, []string{layerURL("hair/a.png"), layerURL("hair/a.png")})
+
+	if len(fetched) != 0 || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %d layers %v", len(fetched), err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("took %s to give up", elapsed)
+	}
+}
+
+func TestFetchTimeout(t *testing.T) {
+	gw := newTestGateway(t, map[string][]byte{"hair/a.png": layerPNG(1, color.Black)})
+	gw.delay = time.Minute
+	useGateways(t, gw)
+
+	defer func(timeout time.Duration) { FetchTimeout = timeout }(FetchTimeout)
+	FetchTimeout = 50 * time.Millisecond
+
+	if _, err := fetchLayers(context.Background(), []string{layerURL("hair/a.png")}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v for a layer slower than the timeout", err)
+	}
+}
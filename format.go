@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/labstack/echo/v4"
+)
+
+// Output formats.
+const (
+	FormatPNG  = "png"
+	FormatJPEG = "jpeg"
+	FormatWebP = "webp"
+	FormatGIF  = "gif"
+	// FormatSVG is only available for citizens, see CitizenSVG.
+	FormatSVG = "svg"
+)
+
+// DefaultJPEGQuality is used when no quality is asked for.
+const DefaultJPEGQuality = 90
+
+var formatTypes = map[string]string{
+	FormatPNG:  "image/png",
+	FormatJPEG: "image/jpeg",
+	FormatWebP: "image/webp",
+	FormatGIF:  "image/gif",
+	FormatSVG:  "image/svg+xml",
+}
+
+var pngCompression = map[string]png.CompressionLevel{
+	"":     png.DefaultCompression,
+	"none": png.NoCompression,
+	"fast": png.BestSpeed,
+	"best": png.BestCompression,
+}
+
+// Encoding is an output format with its options.
+type Encoding struct {
+	Format string
+	// Quality is the JPEG quality, from 1 to 100, or nil for
+	// DefaultJPEGQuality.
+	Quality *int
+	// Compression is the PNG compression level: none, fast, best or empty
+	// for the default.
+	Compression string
+}
+
+// normalize validates e, defaulting its options and dropping those of other
+// formats so equivalent encodings are equal.
+func (e *Encoding) normalize(svg bool) error {
+	e.Format = strings.ToLower(e.Format)
+
+	switch e.Format {
+	case "":
+		e.Format = FormatPNG
+	case "jpg":
+		e.Format = FormatJPEG
+	}
+
+	if _, ok := formatTypes[e.Format]; !ok || e.Format == FormatSVG && !svg {
+		return fmt.Errorf("unsupported format %q", e.Format)
+	}
+
+	if e.Quality != nil && (*e.Quality < 1 || *e.Quality > 100) {
+		return errors.New("quality must be between 1 and 100")
+	}
+
+	if e.Format != FormatJPEG {
+		e.Quality = nil
+	} else if e.Quality == nil {
+		quality := DefaultJPEGQuality
+		e.Quality = &quality
+	}
+
+	e.Compression = strings.ToLower(e.Compression)
+
+	if e.Format != FormatPNG || e.Compression == "default" {
+		e.Compression = ""
+	}
+
+	if _, ok := pngCompression[e.Compression]; !ok {
+		return fmt.Errorf("unknown compression %q, expected none, fast, best or default", e.Compression)
+	}
+
+	return nil
+}
+
+func (e Encoding) ContentType() string {
+	return formatTypes[e.Format]
+}
+
+// Key appends the options and the extension of e to a cache key.
+func (e Encoding) Key(base string) string {
+	switch {
+	case e.Quality != nil:
+		base += fmt.Sprintf("-q%d", *e.Quality)
+	case e.Compression != "":
+		base += "-" + e.Compression
+	}
+	return base + "." + e.Format
+}
+
+// Encode writes img in the format of e.
+func (e Encoding) Encode(w io.Writer, img image.Image) error {
+	switch e.Format {
+	case FormatPNG:
+		encoder := png.Encoder{CompressionLevel: pngCompression[e.Compression]}
+		return encoder.Encode(w, img)
+	case FormatJPEG:
+		quality := DefaultJPEGQuality
+		if e.Quality != nil {
+			quality = *e.Quality
+		}
+		return jpeg.Encode(w, flatten(img), &jpeg.Options{Quality: quality})
+	case FormatWebP:
+		return EncodeWebP(w, img)
+	case FormatGIF:
+		return encodeGIF(w, img)
+	}
+	return fmt.Errorf("can't encode an image as %s", e.Format)
+}
+
+// flatten draws img on white, JPEG having no transparency.
+func flatten(img image.Image) image.Image {
+	if opaque, ok := img.(interface{ Opaque() bool }); ok && opaque.Opaque() {
+		return img
+	}
+
+	flat := image.NewRGBA(img.Bounds())
+	draw.Draw(flat, flat.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+	return flat
+}
+
+// encodeGIF writes img with a palette of exactly its colors, which is
+// lossless for pixel art. GIF transparency is all or nothing, so pixels are
+// either transparent or opaque depending on their alpha. Images of more
+// than 256 colors are dithered instead.
+func encodeGIF(w io.Writer, img image.Image) error {
+	nrgba := imaging.Clone(img)
+	paletted := image.NewPaletted(nrgba.Rect, nil)
+	index := map[color.NRGBA]uint8{}
+
+	for i := 0; i < len(nrgba.Pix); i += 4 {
+		c := color.NRGBA{nrgba.Pix[i], nrgba.Pix[i+1], nrgba.Pix[i+2], 0xff}
+
+		if nrgba.Pix[i+3] < 0x80 {
+			c = color.NRGBA{}
+		}
+
+		idx, ok := index[c]
+
+		if !ok {
+			if len(paletted.Palette) == 256 {
+				return gif.Encode(w, img, nil)
+			}
+
+			idx = uint8(len(paletted.Palette))
+			index[c] = idx
+			paletted.Palette = append(paletted.Palette, c)
+		}
+
+		paletted.Pix[i/4] = idx
+	}
+
+	return gif.Encode(w, paletted, &gif.Options{NumColors: len(paletted.Palette)})
+}
+
+// NegotiateEncoding reads the format, quality and compression query
+// parameters. Without a format, the best one the Accept header allows is
+// used, PNG when it allows none. SVG has to be asked for explicitly, as
+// browsers accept it for any image.
+func NegotiateEncoding(c echo.Context, svg bool) (Encoding, error) {
+	enc := Encoding{
+		Format:      c.QueryParam("format"),
+		Compression: c.QueryParam("compression"),
+	}
+
+	if quality := c.QueryParam("quality"); quality != "" {
+		q, err := strconv.Atoi(quality)
+		if err != nil {
+			return enc, fmt.Errorf("invalid quality %q", quality)
+		}
+		enc.Quality = &q
+	}
+
+	if enc.Format == "" {
+		// caches must keep a response per Accept header
+		c.Response().Header().Add(echo.HeaderVary, "Accept")
+		enc.Format = acceptedFormat(c.Request().Header.Get(echo.HeaderAccept))
+	}
+
+	return enc, enc.normalize(svg)
+}
+
+// acceptedFormat returns the format an Accept header prefers, ties going to
+// the type listed first.
+func acceptedFormat(accept string) string {
+	type accepted struct {
+		format string
+		q      float64
+	}
+
+	var formats []accepted
+
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+
+		format := ""
+
+		switch mediaType {
+		case "*/*", "image/*", "image/apng":
+			format = FormatPNG
+		default:
+			for f, contentType := range formatTypes {
+				if contentType == mediaType && f != FormatSVG {
+					format = f
+				}
+			}
+		}
+
+		if format != "" && q > 0 {
+			formats = append(formats, accepted{format, q})
+		}
+	}
+
+	sort.SliceStable(formats, func(i, j int) bool { return formats[i].q > formats[j].q })
+
+	if len(formats) == 0 {
+		return FormatPNG
+	}
+	return formats[0].format
+}
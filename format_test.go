@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"math/rand"
+	"testing"
+
+	"github.com/disintegration/imaging"
+	"golang.org/x/image/webp"
+)
+
+// pixelArt is a citizen-like image: a few flat colors on transparency.
+func pixelArt() *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, 48, 32))
+	colors := []color.NRGBA{{0xe0, 0x40, 0x20, 0xff}, {0x20, 0x20, 0x30, 0xff}, {0xf0, 0xd0, 0xa0, 0xff}}
+
+	for y := 8; y < 32; y++ {
+		for x := 12; x < 36; x++ {
+			img.SetNRGBA(x, y, colors[(x/4+y/6)%len(colors)])
+		}
+	}
+	return img
+}
+
+// noise has more than 256 colors and every alpha.
+func noise() *image.NRGBA {
+	rng := rand.New(rand.NewSource(1))
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 40))
+	rng.Read(img.Pix)
+
+	// a run of repeated pixels for backward references to pick up
+	for i := 0; i < 64*4; i++ {
+		img.Pix[10*img.Stride+i] = img.Pix[10*img.Stride+i%8]
+	}
+	return img
+}
+
+func TestEncodeWebPRoundTrip(t *testing.T) {
+	for name, img := range map[string]*image.NRGBA{"pixel art": pixelArt(), "noise": noise()} {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+
+			if err := EncodeWebP(&buf, img); err != nil {
+				t.Fatal(err)
+			}
+
+			decoded, err := webp.Decode(&buf)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := imaging.Clone(decoded)
+
+			if got.Rect.Size() != img.Rect.Size() {
+				t.Fatalf("got a %v image, want %v", got.Rect.Size(), img.Rect.Size())
+			}
+
+			if !bytes.Equal(got.Pix, img.Pix) {
+				t.Fatal("the decoded image differs from the encoded one")
+			}
+		})
+	}
+}
+
+func TestEncodeGIF(t *testing.T) {
+	img := pixelArt()
+	// partially transparent pixels become transparent or opaque
+	img.SetNRGBA(0, 0, color.NRGBA{0x10, 0x20, 0x30, 0x90})
+	img.SetNRGBA(1, 0, color.NRGBA{0x10, 0x20, 0x30, 0x70})
+
+	var buf bytes.Buffer
+
+	if err := encodeGIF(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := gif.Decode(&buf)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 5 colors, padded to a power of two
+	if n := len(decoded.(*image.Paletted).Palette); n != 8 {
+		t.Errorf("got %d palette colors, want 8", n)
+	}
+
+	got := imaging.Clone(decoded)
+
+	for y := 0; y < img.Rect.Dy(); y++ {
+		for x := 0; x < img.Rect.Dx(); x++ {
+			want := img.NRGBAAt(x, y)
+
+			switch {
+			case want.A >= 0x80:
+				want.A = 0xff
+			default:
+				want = color.NRGBA{}
+			}
+
+			if g := got.NRGBAAt(x, y); g != want {
+				t.Fatalf("got %v at %d,%d, want %v", g, x, y, want)
+			}
+		}
+	}
+}
+
+func TestEncodeGIFManyColors(t *testing.T) {
+	img := noise()
+	var buf bytes.Buffer
+
+	if err := encodeGIF(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := gif.Decode(&buf)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.Bounds().Size() != img.Rect.Size() {
+		t.Fatalf("got a %v image, want %v", decoded.Bounds().Size(), img.Rect.Size())
+	}
+
+	if n := len(decoded.(*image.Paletted).Palette); n > 256 {
+		t.Fatalf("got %d palette colors", n)
+	}
+}
+
+func TestAcceptedFormat(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", FormatPNG},
+		{"*/*", FormatPNG},
+		{"image/jpeg", FormatJPEG},
+		{"image/gif", FormatGIF},
+		{"text/html", FormatPNG},
+		{"image/svg+xml", FormatPNG},
+		{"image/png;q=0.5, image/jpeg;q=0.8", FormatJPEG},
+		{"image/jpeg, image/webp", FormatJPEG},
+		{"image/webp;q=0, image/gif", FormatGIF},
+		{"image/jpeg;q=abc, image/gif;q=0.1", FormatGIF},
+		{"IMAGE/WEBP", FormatWebP},
+		// Chrome and Firefox loading an <img>
+		{"image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8", FormatWebP},
+		{"image/avif,image/webp,*/*", FormatWebP},
+		// Safari
+		{"image/webp,image/avif,image/jxl,image/heic,image/heic-sequence,video/*;q=0.8,image/png,image/svg+xml,image/*;q=0.8,*/*;q=0.5", FormatWebP},
+		// curl
+		{"*/*;q=0.1", FormatPNG},
+	}
+
+	for _, test := range tests {
+		if got := acceptedFormat(test.accept); got != test.want {
+			t.Errorf("acceptedFormat(%q) = %s, want %s", test.accept, got, test.want)
+		}
+	}
+}
+
+func TestEncodingQuality(t *testing.T) {
+	quality := func(q int) *int { return &q }
+
+	tests := []struct {
+		enc     Encoding
+		quality *int
+		key     string
+	}{
+		{Encoding{Format: "jpg"}, quality(DefaultJPEGQuality), "k-q90.jpeg"},
+		{Encoding{Format: FormatJPEG, Quality: quality(1)}, quality(1), "k-q1.jpeg"},
+		{Encoding{Format: FormatPNG, Quality: quality(50)}, nil, "k.png"},
+		{Encoding{Format: FormatJPEG, Quality: quality(0)}, nil, ""},
+		{Encoding{Format: FormatJPEG, Quality: quality(101)}, nil, ""},
+		{Encoding{Format: FormatPNG, Quality: quality(-1)}, nil, ""},
+	}
+
+	for _, test := range tests {
+		enc := test.enc
+		err := enc.normalize(false)
+
+		if test.key == "" {
+			if err == nil {
+				t.Errorf("accepted quality %d", *test.enc.Quality)
+			}
+			continue
+		}
+
+		if err != nil || enc.Key("k") != test.key || (enc.Quality == nil) != (test.quality == nil) || enc.Quality != nil && *enc.Quality != *test.quality {
+			t.Errorf("got %s %v, want %s", enc.Key("k"), err, test.key)
+		}
+	}
+}
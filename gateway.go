@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultGateway is where the on-chain SVGs point their layers at.
+const DefaultGateway = "https://neotokyo.mypinata.cloud/ipfs"
+
+// gateways serves every IPFS layer fetch. It is configured in main from
+// IPFS_GATEWAYS, IPFS_RETRIES and IPFS_BACKOFF.
+var gateways = NewGatewayPool([]string{DefaultGateway})
+
+// Gateway is a single IPFS path gateway, e.g. "https://ipfs.io/ipfs" or a
+// local Kubo node at "http://127.0.0.1:8080/ipfs".
+type Gateway struct {
+	URL string
+
+	mu                  sync.Mutex
+	requests, failures  uint64
+	consecutiveFailures int
+	downUntil           time.Time
+	lastError           string
+}
+
+// GatewayStats is a snapshot of a gateway's health.
+type GatewayStats struct {
+	URL       string     `json:"url"`
+	Healthy   bool       `json:"healthy"`
+	Requests  uint64     `json:"requests"`
+	Failures  uint64     `json:"failures"`
+	DownUntil *time.Time `json:"down_until,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+func (g *Gateway) healthy(now time.Time) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return !now.Before(g.downUntil)
+}
+
+func (g *Gateway) record(err error, cooldown, maxCooldown time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.requests++
+
+	if err == nil {
+		g.consecutiveFailures = 0
+		g.downUntil = time.Time{}
+		return
+	}
+
+	g.failures++
+	g.consecutiveFailures++
+	g.lastError = err.Error()
+
+	// back off exponentially while the gateway keeps failing
+	wait := cooldown << min(g.consecutiveFailures-1, 16)
+	if wait > maxCooldown || wait <= 0 {
+		wait = maxCooldown
+	}
+	g.downUntil = time.Now().Add(wait)
+}
+
+func (g *Gateway) stats(now time.Time) GatewayStats {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	stats := GatewayStats{
+		URL:       g.URL,
+		Healthy:   !now.Before(g.downUntil),
+		Requests:  g.requests,
+		Failures:  g.failures,
+		LastError: g.lastError,
+	}
+	if !stats.Healthy {
+		downUntil := g.downUntil
+		stats.DownUntil = &downUntil
+	}
+	return stats
+}
+
+// GatewayPool fetches IPFS content from an ordered list of gateways,
+// preferring earlier ones and skipping gateways that recently failed.
+type GatewayPool struct {
+	Gateways []*Gateway
+
+	// Retries is how many extra passes over the gateways are made when
+	// every gateway failed, waiting Backoff (doubling each pass) in between.
+	Retries int
+	Backoff time.Duration
+
+	// Cooldown is how long a gateway is skipped after failing; it doubles
+	// with every consecutive failure up to MaxCooldown.
+	Cooldown, MaxCooldown time.Duration
+
+	// Verify fetches content as a CAR and checks it against the CID instead
+	// of trusting the bytes a gateway serves.
+	Verify bool
+}
+
+func NewGatewayPool(urls []string) *GatewayPool {
+	pool := &GatewayPool{
+		Retries:     2,
+		Backoff:     250 * time.Millisecond,
+		Cooldown:    5 * time.Second,
+		MaxCooldown: 5 * time.Minute,
+	}
+
+	for _, u := range urls {
+		if u = strings.TrimSuffix(strings.TrimSpace(u), "/"); u != "" {
+			pool.Gateways = append(pool.Gateways, &Gateway{URL: u})
+		}
+	}
+	return pool
+}
+
+// NewGatewayPoolFromEnv builds a pool from the comma separated
+// IPFS_GATEWAYS list, falling back to DefaultGateway. IPFS_VERIFY=true
+// turns on CID verification.
+func NewGatewayPoolFromEnv() *GatewayPool {
+	urls := []string{DefaultGateway}
+	if v := os.Getenv("IPFS_GATEWAYS"); v != "" {
+		urls = strings.Split(v, ",")
+	}
+
+	pool := NewGatewayPool(urls)
+	pool.Retries = envCount("IPFS_RETRIES", pool.Retries)
+	pool.Backoff = envDuration("IPFS_BACKOFF", pool.Backoff)
+	pool.Verify, _ = strconv.ParseBool(os.Getenv("IPFS_VERIFY"))
+	return pool
+}
+
+// order returns the gateways to try, healthy ones first. Unhealthy gateways
+// are still tried last so an outage of every gateway doesn't stop renders
+// any longer than necessary.
+func (p *GatewayPool) order() []*Gateway {
+	now := time.Now()
+
+	var healthy, down []*Gateway
+	for _, gw := range p.Gateways {
+		if gw.healthy(now) {
+			healthy = append(healthy, gw)
+		} else {
+			down = append(down, gw)
+		}
+	}
+	return append(healthy, down...)
+}
+
+// Fetch downloads <cid>/<path> from the first gateway able to serve it.
+// With Verify set, a gateway serving content not matching the CID counts as
+// a failure and the next gateway is tried.
+func (p *GatewayPool) Fetch(ctx context.Context, cid, path string) ([]byte, error) {
+	if !p.Verify {
+		return p.Do(ctx, func(ctx context.Context, gw *Gateway) ([]byte, error) {
+			return httpGet(ctx, gw.URL+"/"+cid+"/"+path)
+		})
+	}
+
+	root, err := ParseCID(cid)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.Do(ctx, func(ctx context.Context, gw *Gateway) ([]byte, error) {
+		car, err := httpGet(ctx, gw.URL+"/"+cid+"/"+path+"?format=car")
+		if err != nil {
+			return nil, err
+		}
+		return VerifyCAR(car, root, path)
+	})
+}
+
+// Do runs fetch against the gateways in order until one succeeds, retrying
+// with backoff when all of them failed.
+func (p *GatewayPool) Do(ctx context.Context, fetch func(ctx context.Context, gw *Gateway) ([]byte, error)) ([]byte, error) {
+	if len(p.Gateways) == 0 {
+		return nil, errors.New("no IPFS gateways configured")
+	}
+
+	var errs []error
+
+	for attempt := 0; attempt <= p.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(p.Backoff << (attempt - 1)):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		notFound := true
+
+		for _, gw := range p.order() {
+			data, err := fetch(ctx, gw)
+
+			if ctx.Err() != nil {
+				// the caller gave up, that says nothing about the gateway
+				return nil, ctx.Err()
+			}
+
+			if err == nil {
+				gw.record(nil, p.Cooldown, p.MaxCooldown)
+				return data, nil
+			}
+
+			// a gateway answering 404 is healthy, it just doesn't have the content (yet)
+			var statusErr *HTTPStatusError
+			if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+				gw.record(nil, p.Cooldown, p.MaxCooldown)
+			} else {
+				gw.record(err, p.Cooldown, p.MaxCooldown)
+				notFound = false
+			}
+
+			errs = append(errs, err)
+		}
+
+		// every gateway agrees the content doesn't exist, retrying won't help
+		if notFound {
+			break
+		}
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+func (p *GatewayPool) Stats() []GatewayStats {
+	now := time.Now()
+
+	stats := make([]GatewayStats, 0, len(p.Gateways))
+	for _, gw := range p.Gateways {
+		stats = append(stats, gw.stats(now))
+	}
+	return stats
+}
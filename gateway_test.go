@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"image/color"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGatewayPoolFailover(t *testing.T) {
+	layer := layerPNG(1, color.Black)
+	down := newTestGateway(t, nil)
+	down.status = http.StatusBadGateway
+	up := newTestGateway(t, map[string][]byte{"hair/a.png": layer})
+
+	pool := useGateways(t, down, up)
+
+	// the CID is fetched from the pool, whatever gateway the href names
+	data, err := fetchRaw(context.Background(), layerURL("hair/a.png"))
+
+	if err != nil || string(data) != string(layer) {
+		t.Fatalf("got %d bytes %v", len(data), err)
+	}
+
+	if down.count("hair/a.png") != 1 || up.count("hair/a.png") != 1 {
+		t.Errorf("got %d and %d requests", down.count("hair/a.png"), up.count("hair/a.png"))
+	}
+
+	stats := pool.Stats()
+
+	if stats[0].Healthy || stats[0].Failures != 1 || stats[0].DownUntil == nil || stats[0].LastError == "" {
+		t.Errorf("the failing gateway is %+v", stats[0])
+	}
+
+	if !stats[1].Healthy || stats[1].Requests != 1 {
+		t.Errorf("the working gateway is %+v", stats[1])
+	}
+
+	// while it cools down, the failed gateway is tried last
+	if _, err := fetchRaw(context.Background(), layerURL("hair/a.png")); err != nil || down.count("hair/a.png") != 1 || up.count("hair/a.png") != 2 {
+		t.Errorf("got %v with %d requests to the failed gateway", err, down.count("hair/a.png"))
+	}
+}
+
+func TestGatewayPoolRecovers(t *testing.T) {
+	layer := layerPNG(1, color.Black)
+	gw := newTestGateway(t, map[string][]byte{"hair/a.png": layer})
+	gw.status = http.StatusServiceUnavailable
+
+	pool := useGateways(t, gw)
+	pool.Cooldown = time.Millisecond
+	pool.Retries = 1
+	pool.Backoff = 10 * time.Millisecond
+
+	if _, err := fetchRaw(context.Background(), layerURL("hair/a.png")); err == nil {
+		t.Fatal("fetched from a gateway that is down")
+	}
+
+	if gw.count("hair/a.png") != 2 {
+		t.Errorf("got %d requests, want one per pass", gw.count("hair/a.png"))
+	}
+
+	gw.status = 0
+	time.Sleep(5 * time.Millisecond)
+
+	if _, err := fetchRaw(context.Background(), layerURL("hair/a.png")); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats := pool.Stats(); !stats[0].Healthy || stats[0].Failures != 2 {
+		t.Errorf("got %+v after a success", stats[0])
+	}
+}
+
+func TestGatewayPoolNotFound(t *testing.T) {
+	a, b := newTestGateway(t, nil), newTestGateway(t, nil)
+
+	pool := useGateways(t, a, b)
+	pool.Retries = 3
+
+	_, err := fetchRaw(context.Background(), layerURL("hair/missing.png"))
+
+	var statusErr *HTTPStatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound {
+		t.Fatalf("got %v", err)
+	}
+
+	// every gateway not having the content is no reason to retry, or to
+	// mark them down
+	if a.count("hair/missing.png") != 1 || b.count("hair/missing.png") != 1 {
+		t.Errorf("got %d and %d requests", a.count("hair/missing.png"), b.count("hair/missing.png"))
+	}
+
+	for _, stats := range pool.Stats() {
+		if !stats.Healthy || stats.Failures != 0 {
+			t.Errorf("got %+v", stats)
+		}
+	}
+}
+
+func TestGatewayPoolCancelled(t *testing.T) {
+	gw := newTestGateway(t, map[string][]byte{"hair/a.png": layerPNG(1, color.Black)})
+	gw.delay = time.Minute
+	pool := useGateways(t, gw)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if _, err := fetchRaw(ctx, layerURL("hair/a.png")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v", err)
+	}
+
+	// the client gave up, that says nothing about the gateway
+	if stats := pool.Stats(); !stats[0].Healthy || stats[0].Failures != 0 {
+		t.Errorf("got %+v", stats[0])
+	}
+}
+
+func TestGatewayPoolVerify(t *testing.T) {
+	car, _ := layersCAR()
+	valid := car.bytes()
+	car.blocks[0][1] = []byte("\x89PNG other")
+
+	tampered := newTestGateway(t, map[string][]byte{"1.png": car.bytes()})
+	honest := newTestGateway(t, map[string][]byte{"1.png": valid})
+
+	pool := useGateways(t, tampered, honest)
+	pool.Verify = true
+
+	data, err := pool.Fetch(context.Background(), car.root.String(), "1.png")
+
+	if err != nil || string(data) != "\x89PNG layer" {
+		t.Fatalf("got %q %v", data, err)
+	}
+
+	if stats := pool.Stats(); stats[0].Healthy || !strings.Contains(stats[0].LastError, ErrCIDMismatch.Error()) {
+		t.Errorf("the gateway serving other content is %+v", stats[0])
+	}
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/labstack/echo/v4"
+)
+
+// MetadataVersion is a tokenURI a citizen had over a range of blocks.
+type MetadataVersion struct {
+	FromBlock uint64 `json:"from_block"`
+	// ToBlock is nil for the version that is still current.
+	ToBlock *uint64 `json:"to_block"`
+	// Contract and V2 are the contract serving the version at FromBlock.
+	// A citizen moved to the V2 contract keeps its version, MigratedBlock
+	// is the block it first answered on the V2 contract.
+	Contract       common.Address `json:"contract"`
+	V2             bool           `json:"v2"`
+	MigratedBlock  *uint64        `json:"migrated_block,omitempty"`
+	TokenURISHA256 string         `json:"token_uri_sha256"`
+	Name           string         `json:"name,omitempty"`
+	Attributes     []Attribute    `json:"attributes,omitempty"`
+	Layers         []string       `json:"layers,omitempty"`
+	Error          string         `json:"error,omitempty"`
+}
+
+// tokenState is what a token's tokenURI was at some block. Tokens that
+// don't exist (yet) have the zero state.
+type tokenState struct {
+	URI    string
+	V2     bool
+	Exists bool
+}
+
+// sameMetadata reports whether two states have the same tokenURI, no
+// matter which contract served it.
+func sameMetadata(a, b tokenState) bool {
+	return a.URI == b.URI && a.Exists == b.Exists
+}
+
+// sameContract reports whether the same contract served two states.
+func sameContract(a, b tokenState) bool {
+	return a.V2 == b.V2
+}
+
+// historyProbe looks up the states of a token, remembering every block it
+// asked for.
+type historyProbe struct {
+	ctx       context.Context
+	contracts *CitizenContracts
+	id        *big.Int
+	states    map[uint64]tokenState
+}
+
+func (p *historyProbe) at(block uint64) (tokenState, error) {
+	if state, ok := p.states[block]; ok {
+		return state, nil
+	}
+
+	opts := &bind.CallOpts{Context: p.ctx, BlockNumber: new(big.Int).SetUint64(block)}
+	uri, v2, err := p.contracts.TokenURI(opts, p.id)
+
+	if IsTransient(err) || errors.Is(err, ErrOffline) {
+		return tokenState{}, err
+	}
+
+	state := tokenState{URI: uri, V2: v2, Exists: err == nil}
+	p.states[block] = state
+	return state, nil
+}
+
+// HistorySamples is how many evenly spaced blocks of a range TokenHistory
+// looks up before bisecting between them.
+var HistorySamples = 128
+
+// changes appends the blocks in (lo, hi] at which the state stopped being
+// the same. The range is bisected until both ends agree, so a change that
+// was reverted within the range is not seen.
+func (p *historyProbe) changes(lo, hi uint64, low, high tokenState, same func(a, b tokenState) bool, out *[]uint64) error {
+	if same(low, high) {
+		return nil
+	}
+
+	if hi-lo == 1 {
+		*out = append(*out, hi)
+		return nil
+	}
+
+	mid := lo + (hi-lo)/2
+	middle, err := p.at(mid)
+
+	if err != nil {
+		return err
+	}
+
+	if err := p.changes(lo, mid, low, middle, same, out); err != nil {
+		return err
+	}
+	return p.changes(mid, hi, middle, high, same, out)
+}
+
+// TokenHistory returns the distinct tokenURIs of a citizen between the
+// blocks from and to, oldest first. The range is looked up every stride
+// blocks, spread over HistorySamples lookups, and bisected where two
+// lookups differ: a change undone in fewer than stride blocks is missed,
+// so the history is only complete for a stride of 1.
+func TokenHistory(ctx context.Context, contracts *CitizenContracts, id int, from, to uint64) (versions []MetadataVersion, stride uint64, err error) {
+	probe := &historyProbe{
+		ctx:       ctx,
+		contracts: contracts,
+		id:        big.NewInt(int64(id)),
+		states:    map[uint64]tokenState{},
+	}
+
+	stride = (to - from + uint64(HistorySamples) - 1) / uint64(HistorySamples)
+
+	if stride == 0 {
+		stride = 1
+	}
+
+	boundaries := []uint64{from}
+	previous, err := probe.at(from)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for lo := from; lo < to; lo += stride {
+		hi := lo + stride
+
+		if hi > to {
+			hi = to
+		}
+
+		state, err := probe.at(hi)
+
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if err := probe.changes(lo, hi, previous, state, sameMetadata, &boundaries); err != nil {
+			return nil, 0, err
+		}
+		previous = state
+	}
+
+	versions = []MetadataVersion{}
+
+	for i, start := range boundaries {
+		state := probe.states[start]
+
+		if !state.Exists {
+			continue
+		}
+
+		version := MetadataVersion{
+			FromBlock:      start,
+			Contract:       contracts.OldAddress,
+			V2:             state.V2,
+			TokenURISHA256: sha256Hex([]byte(state.URI)),
+		}
+
+		if state.V2 {
+			version.Contract = contracts.NewAddress
+		}
+
+		end := to
+
+		if i+1 < len(boundaries) {
+			end = boundaries[i+1] - 1
+			version.ToBlock = &end
+		}
+
+		endState, err := probe.at(end)
+
+		if err != nil {
+			return nil, 0, err
+		}
+
+		var moves []uint64
+
+		if err := probe.changes(start, end, state, endState, sameContract, &moves); err != nil {
+			return nil, 0, err
+		}
+
+		for _, move := range moves {
+			if probe.states[move].V2 {
+				migrated := move
+				version.MigratedBlock = &migrated
+				break
+			}
+		}
+
+		metadata, layers, err := decodeCitizen(state.URI)
+
+		if err != nil {
+			version.Error = err.Error()
+		} else {
+			version.Name = metadata.Name
+			version.Attributes = metadata.Attributes
+			for _, layer := range layers {
+				version.Layers = append(version.Layers, layer.Href)
+			}
+		}
+
+		versions = append(versions, version)
+	}
+
+	return versions, stride, nil
+}
+
+// DeploymentBlock returns the first block in which either contract had
+// code, found by bisecting up to head with CodeAt. It is looked up once.
+func (c *CitizenContracts) DeploymentBlock(ctx context.Context, head uint64) (uint64, error) {
+	c.deployMu.Lock()
+	defer c.deployMu.Unlock()
+
+	if c.deployed != nil {
+		return *c.deployed, nil
+	}
+
+	if c.Code == nil {
+		return 0, nil
+	}
+
+	deployed := head
+
+	for _, address := range []common.Address{c.OldAddress, c.NewAddress} {
+		var searchErr error
+
+		hasCode := func(n int) bool {
+			if searchErr != nil {
+				return true
+			}
+
+			code, err := c.Code.CodeAt(ctx, address, big.NewInt(int64(n)))
+			if err != nil {
+				searchErr = err
+				return true
+			}
+			return len(code) > 0
+		}
+
+		block := sort.Search(int(deployed)+1, hasCode)
+
+		if searchErr != nil {
+			return 0, searchErr
+		}
+
+		// without code up to deployed, the other contract is older
+		if uint64(block) <= deployed {
+			deployed = uint64(block)
+		}
+	}
+
+	c.deployed = &deployed
+	return deployed, nil
+}
+
+func parseBlockParam(c echo.Context, name string, fallback uint64) (uint64, error) {
+	value := c.QueryParam(name)
+
+	if value == "" {
+		return fallback, nil
+	}
+
+	block, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s block %q", name, value)
+	}
+	return block, nil
+}
+
+// history serves the metadata versions of a citizen. The full history is
+// cached alongside the renders of the token, so the invalidator drops it
+// as soon as the metadata changes again.
+func history(contracts *CitizenContracts, season int) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+
+		ctx := c.Request().Context()
+		full := c.QueryParam("from") == "" && c.QueryParam("to") == ""
+		cacheKey := fmt.Sprintf("s%d/%d/history.json", season, id)
+
+		if full {
+			if ok, err := serveCached(c, cacheKey); ok || err != nil {
+				return err
+			}
+		}
+
+		head, err := contracts.Chain.HeaderByNumber(ctx, nil)
+
+		if err != nil {
+			return c.String(chainStatus(err, http.StatusBadGateway), err.Error())
+		}
+
+		var deployed uint64
+
+		if c.QueryParam("from") == "" {
+			deployed, err = contracts.DeploymentBlock(ctx, head.Number.Uint64())
+
+			if err != nil {
+				return c.String(chainStatus(err, http.StatusBadGateway), err.Error())
+			}
+		}
+
+		from, err := parseBlockParam(c, "from", deployed)
+
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+
+		to, err := parseBlockParam(c, "to", head.Number.Uint64())
+
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+
+		if from >= to {
+			return c.String(http.StatusBadRequest, "from must be before to")
+		}
+
+		versions, stride, err := TokenHistory(ctx, contracts, id, from, to)
+
+		if err != nil {
+			return c.String(chainStatus(err, http.StatusBadGateway), err.Error())
+		}
+
+		// only the range asked for is known, the last version may have
+		// changed right after it
+		if !full && len(versions) > 0 && versions[len(versions)-1].ToBlock == nil {
+			versions[len(versions)-1].ToBlock = &to
+		}
+
+		body, err := json.Marshal(map[string]interface{}{
+			"season":   season,
+			"id":       id,
+			"versions": versions,
+			// changes undone within fewer blocks than the stride can be missing
+			"stride":   stride,
+			"complete": stride == 1,
+		})
+
+		if err != nil {
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+
+		if full && len(versions) > 0 && versions[len(versions)-1].ToBlock == nil {
+			entry := CacheEntry{
+				ContentType: echo.MIMEApplicationJSON,
+				Metadata: map[string]string{
+					"season":           strconv.Itoa(season),
+					"token-id":         strconv.Itoa(id),
+					"token-uri-sha256": versions[len(versions)-1].TokenURISHA256,
+				},
+			}
+
+			if err := renderCache.Put(ctx, cacheKey, body, entry); err != nil {
+				c.Logger().Errorf("cache put %s: %v", cacheKey, err)
+			}
+		}
+
+		return c.JSONBlob(http.StatusOK, body)
+	}
+}
+
+// compare renders two versions of a citizen side by side. a and b are
+// blocks, such as the from_block of versions in the history; "latest" is
+// the current version.
+func compare(contracts *CitizenContracts, season int) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+
+		enc, err := NegotiateEncoding(c, false)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+
+		size := c.QueryParam("size")
+
+		if size == "" {
+			size = "pfp"
+		}
+
+		var specs []*RenderSpec
+
+		for _, name := range []string{"a", "b"} {
+			spec := &RenderSpec{Season: season, TokenID: id, Format: FormatPNG}
+
+			if err := spec.setDimensions(size); err != nil {
+				return c.String(http.StatusBadRequest, err.Error())
+			}
+
+			spec.Background.None = c.QueryParam("no-bg") != ""
+
+			value := c.QueryParam(name)
+
+			switch {
+			case value == "":
+				return c.String(http.StatusBadRequest, fmt.Sprintf("%s is required", name))
+			case strings.ToLower(value) != "latest":
+				if spec.Block, err = parseBlockParam(c, name, 0); err != nil {
+					return c.String(http.StatusBadRequest, err.Error())
+				}
+			}
+
+			if err := spec.Validate(); err != nil {
+				return c.String(http.StatusBadRequest, err.Error())
+			}
+
+			specs = append(specs, spec)
+		}
+
+		grid := Grid{Cols: 2}
+
+		if spacing := c.QueryParam("spacing"); spacing != "" {
+			if grid.Spacing, err = strconv.Atoi(spacing); err != nil || grid.Spacing < 0 {
+				return c.String(http.StatusBadRequest, "spacing must be a non-negative integer")
+			}
+		}
+
+		if bgColorHex := c.QueryParam("bg-color"); bgColorHex != "" {
+			if grid.Background, err = validateBGColor(bgColorHex); err != nil {
+				return c.String(http.StatusBadRequest, err.Error())
+			}
+		}
+
+		if width, height := grid.Size(2, specs[0].Width, specs[0].Height); width > MaxDimension || height > MaxDimension {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("image would be %dx%d, the maximum is %d in either direction", width, height, MaxDimension))
+		}
+
+		ctx := c.Request().Context()
+		cells, err := renderCitizens(ctx, specs, map[int]*CitizenContracts{season: contracts})
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if err != nil {
+			return c.String(statusOf(err), err.Error())
+		}
+
+		return storeAndServe(c, "", grid.Draw(cells), enc, nil)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestTokenHistorySimulated(t *testing.T) {
+	ctx := context.Background()
+	chain := newSimulatedChain(t)
+	chain.Commit()
+
+	// deployed in blocks 2 and 3
+	old, v2 := chain.deployStoredCitizen(), chain.deployStoredCitizen()
+	contracts := &CitizenContracts{Old: old, New: v2, OldAddress: old.address, NewAddress: v2.address, Chain: chain, Code: chain}
+
+	steps := map[int]func(){
+		4: func() { old.setVersion(7, 1) },
+		// the citizen moves to V2 with the same tokenURI
+		7: func() { v2.setVersion(7, 1) },
+		9: func() { v2.setVersion(7, 2) },
+	}
+
+	for block := 4; block <= 10; block++ {
+		if step, ok := steps[block]; ok {
+			step()
+		}
+		chain.Commit()
+	}
+
+	deployed, err := contracts.DeploymentBlock(ctx, 10)
+
+	if err != nil || deployed != 2 {
+		t.Fatalf("got deployment block %d %v, want 2", deployed, err)
+	}
+
+	versions, stride, err := TokenHistory(ctx, contracts, 7, deployed, 10)
+
+	if err != nil || stride != 1 {
+		t.Fatal(stride, err)
+	}
+
+	if len(versions) != 2 {
+		t.Fatalf("got %d versions, want 2: %+v", len(versions), versions)
+	}
+
+	first, second := versions[0], versions[1]
+
+	if first.FromBlock != 4 || first.ToBlock == nil || *first.ToBlock != 8 || first.V2 || first.Contract != old.address {
+		t.Errorf("got first version %+v", first)
+	}
+
+	if first.MigratedBlock == nil || *first.MigratedBlock != 7 {
+		t.Errorf("got migrated block %v, want 7", first.MigratedBlock)
+	}
+
+	if second.FromBlock != 9 || second.ToBlock != nil || !second.V2 || second.Contract != v2.address || second.MigratedBlock != nil {
+		t.Errorf("got second version %+v", second)
+	}
+
+	if first.TokenURISHA256 == second.TokenURISHA256 {
+		t.Error("both versions have the same tokenURI")
+	}
+}
+
+func TestTokenHistoryRevertedChange(t *testing.T) {
+	ctx := context.Background()
+	chain := newSimulatedChain(t)
+	chain.Commit()
+
+	old, v2 := chain.deployStoredCitizen(), chain.deployStoredCitizen()
+	contracts := &CitizenContracts{Old: old, New: v2, OldAddress: old.address, NewAddress: v2.address, Chain: chain, Code: chain}
+
+	// version 1, changed to 2 in block 9 and back to 1 in block 11
+	steps := map[int]func(){
+		4:  func() { old.setVersion(7, 1) },
+		9:  func() { old.setVersion(7, 2) },
+		11: func() { old.setVersion(7, 1) },
+	}
+
+	for block := 4; block <= 12; block++ {
+		if step, ok := steps[block]; ok {
+			step()
+		}
+		chain.Commit()
+	}
+
+	versions, stride, err := TokenHistory(ctx, contracts, 7, 2, 12)
+
+	if err != nil || stride != 1 {
+		t.Fatal(stride, err)
+	}
+
+	var starts []uint64
+	for _, version := range versions {
+		starts = append(starts, version.FromBlock)
+	}
+
+	if len(versions) != 3 || starts[0] != 4 || starts[1] != 9 || starts[2] != 11 || versions[0].TokenURISHA256 != versions[2].TokenURISHA256 {
+		t.Fatalf("got versions from %v, want 4, 9 and 11", starts)
+	}
+
+	// looked up at both ends only, the change in between is invisible
+	defer func(samples int) { HistorySamples = samples }(HistorySamples)
+	HistorySamples = 1
+
+	versions, stride, err = TokenHistory(ctx, contracts, 7, 2, 12)
+
+	if err != nil || stride != 10 || len(versions) != 1 {
+		t.Fatalf("got %d versions with stride %d %v", len(versions), stride, err)
+	}
+}
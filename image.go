@@ -1,20 +1,24 @@
 package main
 
 import (
+	"fmt"
 	"image"
-	"image/color"
 	"image/draw"
-	"net/http"
+	"path"
 	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/disintegration/imaging"
 
 	_ "image/jpeg"
 	_ "image/png"
+
+	_ "golang.org/x/image/webp"
 )
 
-var IPFSRegex = regexp.MustCompile(`(https:\/\/neotokyo\.mypinata\.cloud\/ipfs)\/(Qm[\w]+)\/(.+)`)
+// IPFSRegex splits an IPFS path gateway URL into (gateway)/(CID)/(path).
+var IPFSRegex = regexp.MustCompile(`(https?:\/\/[^\/]+\/ipfs)\/(Qm[\w]+|b[a-z2-7]+)\/(.+)`)
 
 type IPFSBucket struct {
 	Male, Female string
@@ -38,19 +42,26 @@ type FetchedImage struct {
 }
 
 type ImageGenerator struct {
-	Width, Height                                                     int
-	NoBackground, SantaHat, Snowball, Female, NoClothes, PFP, Preview bool
-
-	BackgroundColor *color.RGBA
-
-	SeasonNumber int
-	Layers       []*FetchedImage
+	Spec   *RenderSpec
+	Layers []*FetchedImage
 }
 
 func (i *ImageGenerator) Generate() image.Image {
 	base := image.NewNRGBA(image.Rect(0, 0, 1200, 1200))
+	// padding is filled with the background, so it's drawn apart
+	backdrop := base
+
+	spec := i.Spec
+	backgroundColor := spec.Background.RGBA()
+	pfp := spec.Crop == CropPFP
+	preview := spec.Crop == CropPreview
+	snowball := spec.HasAccessory(AccessorySnowball)
 
-	if i.SantaHat {
+	if spec.pads() {
+		backdrop = image.NewNRGBA(base.Bounds())
+	}
+
+	if spec.HasAccessory(AccessorySantaHat) {
 		i.Layers = append(i.Layers, &FetchedImage{santaHat, ""})
 	}
 
@@ -59,6 +70,11 @@ func (i *ImageGenerator) Generate() image.Image {
 
 	for idx, fetchedImg := range i.Layers {
 		img := fetchedImg.Img
+		hidden := spec.HidesLayer(layerCategory(fetchedImg.URL))
+
+		if hidden && idx > 0 {
+			continue
+		}
 
 		if strings.Contains(fetchedImg.URL, "body") && strings.Contains(fetchedImg.URL, "QmPVfdHHdjyZb6BKHhwaJ1eEdCx9Jz4mvCn4KHiCJQaB8e") {
 
@@ -80,25 +96,28 @@ func (i *ImageGenerator) Generate() image.Image {
 			}
 		}
 
-		if strings.Contains(fetchedImg.URL, "cloth") && i.NoClothes {
+		if strings.Contains(fetchedImg.URL, "cloth") && spec.NoClothes {
 			continue
 		}
 
-		if idx == 0 && i.BackgroundColor != nil {
-			img = image.NewUniform(i.BackgroundColor)
+		if idx == 0 && backgroundColor != nil {
+			img = image.NewUniform(backgroundColor)
 
-			draw.Draw(base, base.Bounds(), img, image.Pt(0, 0), draw.Over)
+			draw.Draw(backdrop, base.Bounds(), img, image.Pt(0, 0), draw.Over)
 			continue
-		} else if (i.NoBackground || i.Preview) && idx == 0 {
+		} else if (spec.Background.None || preview || hidden) && idx == 0 {
 			// don't draw background if requested otherwise
 			continue
+		} else if idx == 0 {
+			draw.Draw(backdrop, img.Bounds(), img, image.Pt(0, 0), draw.Over)
+			continue
 		}
 
-		if i.Snowball && strings.Contains(fetchedImg.URL, "weapon") {
+		if snowball && strings.Contains(fetchedImg.URL, "weapon") {
 			continue // don't render the weapon with a snowball
 		}
 
-		if i.Snowball && strings.Contains(fetchedImg.URL, "hand") {
+		if snowball && strings.Contains(fetchedImg.URL, "hand") {
 			img = emptyFist
 			draw.Draw(img.(*image.NRGBA), emptyFist.Bounds(), snowBall, image.Pt(0, 0), draw.Over)
 		}
@@ -108,7 +127,7 @@ func (i *ImageGenerator) Generate() image.Image {
 
 	var finalizedImage image.Image = base
 
-	if i.PFP || i.Preview {
+	if pfp || preview {
 		startX := midPointX
 		startY := highestPixelY
 		endY := (startY + 640)
@@ -118,21 +137,63 @@ func (i *ImageGenerator) Generate() image.Image {
 		}
 		finalizedImage = imaging.Crop(finalizedImage, image.Rect(startX-320, startY, startX+320, endY))
 	} else {
-		rw, rh := 0, 0
-		if base.Bounds().Dx() != i.Width {
-			rw = i.Width
-		}
+		finalizedImage = fitComposition(base, backdrop, spec, highestPixelY)
+	}
 
-		if base.Bounds().Dy() != i.Height {
-			rh = i.Height
-		}
+	return finalizedImage
+}
+
+// fitComposition scales the composed citizen to the dimensions of spec, see
+// FitMode and Padding. backdrop is the background, apart from base only when
+// spec pads. headY is where the head starts in base.
+func fitComposition(base, backdrop *image.NRGBA, spec *RenderSpec, headY int) image.Image {
+	size := base.Bounds().Dx()
+	width, height := spec.FitSize(size)
+	boxWidth, boxHeight := spec.contentSize()
 
-		if rw > 0 || rh > 0 {
-			finalizedImage = imaging.Resize(base, rw, rh, imaging.NearestNeighbor)
+	var fitted image.Image = base
+
+	if width != size || height != size {
+		fitted = imaging.Resize(base, width, height, imaging.NearestNeighbor)
+	}
+
+	if spec.Fit == FitCover {
+		x := (width - boxWidth) / 2
+		y := (height - boxHeight) / 2
+
+		switch spec.Anchor {
+		case AnchorHead:
+			y = min(max(headY*height/size, 0), height-boxHeight)
+		case AnchorFeet:
+			y = height - boxHeight
 		}
+
+		fitted = imaging.Crop(fitted, image.Rect(x, y, x+boxWidth, y+boxHeight))
+		width, height = boxWidth, boxHeight
 	}
 
-	return finalizedImage
+	if !spec.pads() {
+		return fitted
+	}
+
+	padded := imaging.Fill(backdrop, spec.Width, spec.Height, imaging.Center, imaging.NearestNeighbor)
+
+	x := (boxWidth - width) / 2
+	y := (boxHeight - height) / 2
+
+	switch spec.Anchor {
+	case AnchorHead:
+		y = 0
+	case AnchorFeet:
+		y = boxHeight - height
+	}
+
+	if p := spec.Padding; p != nil {
+		x, y = x+p.Left, y+p.Top
+	}
+
+	draw.Draw(padded, image.Rect(x, y, x+width, y+height), fitted, image.Point{}, draw.Over)
+	return padded
 }
 
 func findHighestColoredPixel(img image.Image, x int) int {
@@ -164,22 +225,118 @@ func findHighestColoredPixel(img image.Image, x int) int {
 	return highestY - 40
 }
 
-func NewImageGenerator(w, h int, layers []*FetchedImage) *ImageGenerator {
+func NewImageGenerator(spec *RenderSpec, layers []*FetchedImage) *ImageGenerator {
 	return &ImageGenerator{
-		BackgroundColor: nil,
-		Width:           w,
-		Height:          h,
-		Layers:          layers,
+		Spec:   spec,
+		Layers: layers,
+	}
+}
+
+// layerCategory returns the trait category of a layer URL, which is the
+// first path segment after the IPFS CID (e.g. "background" or "weapon").
+func layerCategory(href string) string {
+	groups := IPFSRegex.FindStringSubmatch(href)
+	if groups == nil {
+		return ""
+	}
+	return strings.SplitN(groups[3], "/", 2)[0]
+}
+
+// checkHiddenLayers rejects hidden layers that are none of the categories
+// of the citizen's layers, as they would silently hide nothing. Categories
+// are the folders of the trait buckets, so there's no list to check
+// against before the layers are known.
+func checkHiddenLayers(spec *RenderSpec, imgs []XMLImage) error {
+	categories := map[string]bool{}
+	for _, img := range imgs {
+		categories[layerCategory(img.Href)] = true
+	}
+
+	for _, hidden := range spec.HiddenLayers {
+		if categories[hidden] {
+			continue
+		}
+
+		known := make([]string, 0, len(categories))
+		for category := range categories {
+			if category != "" {
+				known = append(known, category)
+			}
+		}
+		sort.Strings(known)
+
+		return fmt.Errorf("unknown layer category %q, the citizen has %s", hidden, strings.Join(known, ", "))
 	}
+	return nil
 }
 
-func fetchImage(url string) (*FetchedImage, error) {
-	resp, err := http.Get(url)
+// Gender buckets a layer can come from.
+const (
+	BucketMale   = "male"
+	BucketFemale = "female"
+	// BucketShared is used by seasons whose layers aren't split by gender.
+	BucketShared = "shared"
+)
+
+// LayerInfo describes a layer of a citizen's SVG.
+type LayerInfo struct {
+	Href string `json:"href"`
+	// Category is the trait the layer draws ("hair", "weapon", ...) and
+	// Variant the file within it, without extension.
+	Category string `json:"category"`
+	Variant  string `json:"variant"`
+	Bucket   string `json:"bucket,omitempty"`
+}
 
-	if err != nil {
-		return nil, err
+func describeLayer(href string, season int) LayerInfo {
+	info := LayerInfo{Href: href}
+
+	groups := IPFSRegex.FindStringSubmatch(href)
+	if groups == nil {
+		return info
+	}
+
+	category, variant, _ := strings.Cut(groups[3], "/")
+	info.Category = category
+	info.Variant = strings.TrimSuffix(variant, path.Ext(variant))
+
+	bucket := IPFSBuckets[season]
+	switch {
+	case bucket.Male == bucket.Female && groups[2] == bucket.Male:
+		info.Bucket = BucketShared
+	case groups[2] == bucket.Male:
+		info.Bucket = BucketMale
+	case groups[2] == bucket.Female:
+		info.Bucket = BucketFemale
+	}
+
+	return info
+}
+
+// resolveLayerURL returns the URL a layer href should be fetched from for
+// the given spec.
+func resolveLayerURL(href string, spec *RenderSpec) string {
+	if spec.Gender != GenderFemale {
+		return href
+	}
+
+	// force a replace to the female IPFS bucket
+
+	// highly experimental
+	fetchUrl := IPFSRegex.ReplaceAllString(href, fmt.Sprintf("$1/%s/$3", IPFSBuckets[spec.Season].Female))
+
+	if strings.Contains(fetchUrl, "body") || strings.Contains(fetchUrl, "hand") || strings.Contains(fetchUrl, "head") {
+		groups := IPFSRegex.FindAllStringSubmatch(fetchUrl, -1)
+		if len(groups) > 0 && strings.Contains(groups[0][3], "0.png") {
+			replaceString := "0-0.png"
+
+			if strings.Contains(fetchUrl, "hand") {
+				replaceString = "fist/" + replaceString
+			}
+
+			fetchUrl = strings.ReplaceAll(fetchUrl, groups[0][3], fmt.Sprintf("%s/%s", strings.Split(groups[0][3], "/")[0], replaceString))
+		}
 	}
 
-	img, _, err := image.Decode(resp.Body)
-	return &FetchedImage{img, url}, err
+	return fetchUrl
 }
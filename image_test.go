@@ -0,0 +1,109 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"strings"
+	"testing"
+)
+
+func TestCheckHiddenLayers(t *testing.T) {
+	imgs := []XMLImage{
+		{Href: "https://gateway.example/ipfs/QmPVfdHHdjyZb6BKHhwaJ1eEdCx9Jz4mvCn4KHiCJQaB8e/background/2.png"},
+		{Href: "https://gateway.example/ipfs/QmPVfdHHdjyZb6BKHhwaJ1eEdCx9Jz4mvCn4KHiCJQaB8e/body/5.png"},
+		{Href: "https://gateway.example/ipfs/QmPVfdHHdjyZb6BKHhwaJ1eEdCx9Jz4mvCn4KHiCJQaB8e/weapon/7.png"},
+	}
+
+	if err := checkHiddenLayers(&RenderSpec{HiddenLayers: []string{"background", "weapon"}}, imgs); err != nil {
+		t.Fatal(err)
+	}
+
+	err := checkHiddenLayers(&RenderSpec{HiddenLayers: []string{"weapon", "wepon"}}, imgs)
+
+	if err == nil || !strings.Contains(err.Error(), `"wepon"`) || !strings.Contains(err.Error(), "background, body, weapon") {
+		t.Fatalf("got %v, want the unknown category and the known ones", err)
+	}
+}
+
+// fitLayers is a background and a citizen: a red box at (300,100)-(900,1100)
+// of the 1200x1200 composition, drawn as hair so its top is the head.
+func fitLayers() []*FetchedImage {
+	background := image.NewNRGBA(image.Rect(0, 0, 1200, 1200))
+	draw.Draw(background, background.Bounds(), image.NewUniform(color.NRGBA{0, 0xff, 0, 0xff}), image.Point{}, draw.Src)
+
+	citizen := image.NewNRGBA(image.Rect(0, 0, 1200, 1200))
+	draw.Draw(citizen, image.Rect(300, 100, 900, 1100), image.NewUniform(color.NRGBA{0xff, 0, 0, 0xff}), image.Point{}, draw.Src)
+
+	const cid = "https://gateway.example/ipfs/QmPVfdHHdjyZb6BKHhwaJ1eEdCx9Jz4mvCn4KHiCJQaB8e"
+	return []*FetchedImage{{background, cid + "/background/1.png"}, {citizen, cid + "/hair/1.png"}}
+}
+
+// colorBounds returns the bounds of the pixels of img that are c.
+func colorBounds(img image.Image, c color.NRGBA) image.Rectangle {
+	var bounds image.Rectangle
+
+	for y := img.Bounds().Min.Y; y < img.Bounds().Max.Y; y++ {
+		for x := img.Bounds().Min.X; x < img.Bounds().Max.X; x++ {
+			if color.NRGBAModel.Convert(img.At(x, y)) == c {
+				bounds = bounds.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	return bounds
+}
+
+func TestFitComposition(t *testing.T) {
+	red, blue := color.NRGBA{0xff, 0, 0, 0xff}, color.NRGBA{0, 0, 0xff, 0xff}
+
+	tests := []struct {
+		name    string
+		spec    RenderSpec
+		citizen image.Rectangle
+	}{
+		{"stretch", RenderSpec{Width: 1500, Height: 500}, image.Rect(375, 42, 1125, 458)},
+		// 500x500 in the middle of the banner
+		{"contain", RenderSpec{Width: 1500, Height: 500, Fit: FitContain}, image.Rect(625, 42, 875, 458)},
+		{"contain integer", RenderSpec{Width: 1500, Height: 500, Fit: FitContain, IntegerScale: true}, image.Rect(650, 83, 850, 417)},
+		{"contain padded", RenderSpec{Width: 1500, Height: 500, Fit: FitContain, Padding: &Padding{50, 50, 50, 50}}, image.Rect(650, 83, 850, 417)},
+		// 1500x1500, cropped to 500 rows
+		{"cover", RenderSpec{Width: 1500, Height: 500, Fit: FitCover}, image.Rect(375, 0, 1125, 500)},
+		{"cover head", RenderSpec{Width: 1500, Height: 500, Fit: FitCover, Anchor: AnchorHead}, image.Rect(375, 50, 1125, 500)},
+		{"cover feet", RenderSpec{Width: 1500, Height: 500, Fit: FitCover, Anchor: AnchorFeet}, image.Rect(375, 0, 1125, 375)},
+		// 500x500 within a 500x1500 portrait
+		{"pad", RenderSpec{Width: 500, Height: 1500, Fit: FitPad}, image.Rect(125, 542, 375, 958)},
+		{"pad head", RenderSpec{Width: 500, Height: 1500, Fit: FitPad, Anchor: AnchorHead}, image.Rect(125, 42, 375, 458)},
+		{"pad feet", RenderSpec{Width: 500, Height: 1500, Fit: FitPad, Anchor: AnchorFeet}, image.Rect(125, 1042, 375, 1458)},
+		{"contain portrait", RenderSpec{Width: 500, Height: 1500, Fit: FitContain, Anchor: AnchorFeet}, image.Rect(125, 542, 375, 958)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spec := test.spec
+			spec.Season, spec.TokenID, spec.Background.Color = 1, 1, "0000ff"
+
+			if err := spec.Validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			img := NewImageGenerator(&spec, fitLayers()).Generate()
+
+			if size := img.Bounds().Size(); size != image.Pt(test.spec.Width, test.spec.Height) {
+				t.Fatalf("got a %v image, want %dx%d", size, test.spec.Width, test.spec.Height)
+			}
+
+			citizen := colorBounds(img, red)
+
+			for _, d := range []int{citizen.Min.X - test.citizen.Min.X, citizen.Min.Y - test.citizen.Min.Y, citizen.Max.X - test.citizen.Max.X, citizen.Max.Y - test.citizen.Max.Y} {
+				if d < -2 || d > 2 {
+					t.Fatalf("the citizen is at %v, want %v", citizen, test.citizen)
+				}
+			}
+
+			// the letterbox and the padding are the background
+			if background := colorBounds(img, blue); background != img.Bounds() {
+				t.Errorf("the background covers %v, want all of %v", background, img.Bounds())
+			}
+		})
+	}
+}
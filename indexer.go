@@ -0,0 +1,574 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"log"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	bolt "go.etcd.io/bbolt"
+)
+
+// indexer, when set, answers ownership questions from the local database
+// instead of the chain.
+var indexer *Indexer
+
+var (
+	bucketMeta      = []byte("meta")
+	bucketOwners    = []byte("owners")    // contract|id -> owner
+	bucketHoldings  = []byte("holdings")  // owner|contract|id -> nil
+	bucketTransfers = []byte("transfers") // contract|id|block|log -> from|to|tx
+	bucketByBlock   = []byte("byblock")   // block|log -> contract|id
+	bucketBlocks    = []byte("blocks")    // block -> hash of indexed checkpoints
+
+	keyCheckpoint = []byte("checkpoint")
+
+	transferTopic = erc721ABI.Events["Transfer"].ID
+)
+
+// keptCheckpoints is how many checkpoint hashes are kept to find the fork
+// point after a reorg.
+const keptCheckpoints = 256
+
+// IndexerBackend is the part of a chain client the indexer needs.
+// MultiBackend and go-ethereum's simulated backend both implement it.
+type IndexerBackend interface {
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+	FilterLogs(ctx context.Context, query ethereum.FilterQuery) ([]types.Log, error)
+}
+
+// Transfer is an indexed ERC-721 Transfer event.
+type Transfer struct {
+	Contract common.Address `json:"contract"`
+	ID       *big.Int       `json:"id"`
+	From     common.Address `json:"from"`
+	To       common.Address `json:"to"`
+	Block    uint64         `json:"block"`
+	LogIndex uint           `json:"log_index"`
+	TxHash   common.Hash    `json:"tx_hash"`
+}
+
+// Holding is a token held by an address.
+type Holding struct {
+	Contract common.Address `json:"contract"`
+	ID       *big.Int       `json:"id"`
+}
+
+// IndexerStats is a snapshot of the indexer's progress.
+type IndexerStats struct {
+	Checkpoint uint64 `json:"checkpoint"`
+	Head       uint64 `json:"head"`
+	Reorgs     int    `json:"reorgs"`
+	LastError  string `json:"last_error,omitempty"`
+}
+
+// Indexer follows the Transfer logs of Contracts and keeps the current
+// owner and the transfer history of every token in a bbolt database.
+//
+// Blocks are indexed up to Confirmations behind the head. The hash of
+// every checkpoint is stored, so when the chain reorganises below the
+// checkpoint anyway, the indexer rewinds to the last checkpoint still on
+// the canonical chain and indexes again from there.
+type Indexer struct {
+	DB        *bolt.DB
+	Backend   IndexerBackend
+	Contracts []common.Address
+
+	StartBlock    uint64
+	Confirmations uint64
+	// BatchSize is the number of blocks asked for per FilterLogs call. It
+	// is halved when a provider refuses a range as too large.
+	BatchSize uint64
+	Interval  time.Duration
+
+	mu    sync.Mutex
+	stats IndexerStats
+}
+
+// OpenIndexer opens (or creates) the database at path.
+func OpenIndexer(path string, backend IndexerBackend, contracts []common.Address) (*Indexer, error) {
+	db, err := bolt.Open(path, 0o644, &bolt.Options{Timeout: time.Second})
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketMeta, bucketOwners, bucketHoldings, bucketTransfers, bucketByBlock, bucketBlocks} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Indexer{
+		DB:            db,
+		Backend:       backend,
+		Contracts:     contracts,
+		Confirmations: 12,
+		BatchSize:     2000,
+		Interval:      15 * time.Second,
+	}, nil
+}
+
+// NewIndexerFromEnv opens the database at INDEXER_DB and indexes the
+// citizen and parts contracts.
+func NewIndexerFromEnv(backend IndexerBackend) (*Indexer, error) {
+	var contracts []common.Address
+	for _, c := range snapshotContracts(true) {
+		contracts = append(contracts, c.Address)
+	}
+
+	idx, err := OpenIndexer(os.Getenv("INDEXER_DB"), backend, contracts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	idx.StartBlock = uint64(envCount("INDEXER_START_BLOCK", 0))
+	idx.Confirmations = uint64(envCount("INDEXER_CONFIRMATIONS", int(idx.Confirmations)))
+	idx.BatchSize = uint64(max(envInt("INDEXER_BATCH", int(idx.BatchSize)), 1))
+	idx.Interval = envDuration("INDEXER_INTERVAL", idx.Interval)
+	return idx, nil
+}
+
+func (idx *Indexer) Close() error {
+	return idx.DB.Close()
+}
+
+// Run syncs until ctx is done, polling for new blocks every Interval.
+func (idx *Indexer) Run(ctx context.Context) {
+	for {
+		if err := idx.Sync(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("indexer: %v", err)
+		}
+
+		select {
+		case <-time.After(idx.Interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Sync indexes every confirmed block after the checkpoint.
+func (idx *Indexer) Sync(ctx context.Context) error {
+	err := idx.sync(ctx)
+
+	idx.mu.Lock()
+	if err != nil {
+		idx.stats.LastError = err.Error()
+	} else {
+		idx.stats.LastError = ""
+	}
+	idx.mu.Unlock()
+
+	return err
+}
+
+func (idx *Indexer) sync(ctx context.Context) error {
+	head, err := idx.Backend.HeaderByNumber(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	idx.mu.Lock()
+	idx.stats.Head = head.Number.Uint64()
+	idx.mu.Unlock()
+
+	if err := idx.handleReorg(ctx); err != nil {
+		return err
+	}
+
+	checkpoint, err := idx.Checkpoint()
+
+	if err != nil {
+		return err
+	}
+
+	idx.mu.Lock()
+	idx.stats.Checkpoint = checkpoint
+	idx.mu.Unlock()
+
+	if head.Number.Uint64() < idx.Confirmations {
+		return nil
+	}
+	target := head.Number.Uint64() - idx.Confirmations
+
+	from := checkpoint + 1
+	if from < idx.StartBlock {
+		from = idx.StartBlock
+	}
+
+	batch := idx.BatchSize
+	if batch == 0 {
+		batch = 1
+	}
+
+	for from <= target {
+		to := from + batch - 1
+		if to > target {
+			to = target
+		}
+
+		logs, err := idx.Backend.FilterLogs(ctx, ethereum.FilterQuery{
+			FromBlock: new(big.Int).SetUint64(from),
+			ToBlock:   new(big.Int).SetUint64(to),
+			Addresses: idx.Contracts,
+			Topics:    [][]common.Hash{{transferTopic}},
+		})
+
+		if err != nil {
+			if !isRangeError(err) || batch == 1 || ctx.Err() != nil {
+				return err
+			}
+			batch /= 2
+			continue
+		}
+
+		header, err := idx.Backend.HeaderByNumber(ctx, new(big.Int).SetUint64(to))
+
+		if err != nil {
+			return err
+		}
+
+		if err := idx.apply(logs, to, header.Hash()); err != nil {
+			return err
+		}
+
+		idx.mu.Lock()
+		idx.stats.Checkpoint = to
+		idx.mu.Unlock()
+
+		from = to + 1
+	}
+
+	return nil
+}
+
+// apply stores a batch of logs and moves the checkpoint to block.
+func (idx *Indexer) apply(logs []types.Log, block uint64, hash common.Hash) error {
+	sort.Slice(logs, func(i, j int) bool {
+		if logs[i].BlockNumber != logs[j].BlockNumber {
+			return logs[i].BlockNumber < logs[j].BlockNumber
+		}
+		return logs[i].Index < logs[j].Index
+	})
+
+	return idx.DB.Update(func(tx *bolt.Tx) error {
+		owners := tx.Bucket(bucketOwners)
+		holdings := tx.Bucket(bucketHoldings)
+		transfers := tx.Bucket(bucketTransfers)
+		byBlock := tx.Bucket(bucketByBlock)
+
+		for _, l := range logs {
+			// ERC-20 shares the Transfer signature but doesn't index the amount
+			if len(l.Topics) != 4 || l.Removed {
+				continue
+			}
+
+			token := tokenKey(l.Address, l.Topics[3].Big())
+			from := common.BytesToAddress(l.Topics[1].Bytes())
+			to := common.BytesToAddress(l.Topics[2].Bytes())
+			position := positionKey(l.BlockNumber, l.Index)
+
+			if err := setOwner(owners, holdings, token, to); err != nil {
+				return err
+			}
+
+			value := make([]byte, 0, 2*common.AddressLength+common.HashLength)
+			value = append(append(append(value, from.Bytes()...), to.Bytes()...), l.TxHash.Bytes()...)
+
+			if err := transfers.Put(append(append([]byte{}, token...), position...), value); err != nil {
+				return err
+			}
+
+			if err := byBlock.Put(position, token); err != nil {
+				return err
+			}
+		}
+
+		return setCheckpoint(tx, block, hash)
+	})
+}
+
+// handleReorg compares the stored checkpoint hashes with the chain and
+// rewinds to the newest one that is still canonical.
+func (idx *Indexer) handleReorg(ctx context.Context) error {
+	var checkpoints []uint64
+	var hashes []common.Hash
+
+	err := idx.DB.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketBlocks).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			checkpoints = append(checkpoints, binary.BigEndian.Uint64(k))
+			hashes = append(hashes, common.BytesToHash(v))
+		}
+		return nil
+	})
+
+	if err != nil || len(checkpoints) == 0 {
+		return err
+	}
+
+	for i, number := range checkpoints {
+		header, err := idx.Backend.HeaderByNumber(ctx, new(big.Int).SetUint64(number))
+
+		if err != nil && !errors.Is(err, ethereum.NotFound) {
+			return err
+		}
+
+		if err == nil && header.Hash() == hashes[i] {
+			if i == 0 {
+				return nil
+			}
+			log.Printf("indexer: reorg, rewinding from block %d to %d", checkpoints[0], number)
+			return idx.rewind(number, hashes[i])
+		}
+	}
+
+	// the reorg is deeper than anything remembered, start over
+	log.Printf("indexer: reorg below block %d, reindexing", checkpoints[len(checkpoints)-1])
+	return idx.rewind(0, common.Hash{})
+}
+
+// rewind drops everything indexed after block and restores the owners of
+// the affected tokens from the remaining history.
+func (idx *Indexer) rewind(block uint64, hash common.Hash) error {
+	idx.mu.Lock()
+	idx.stats.Reorgs++
+	idx.stats.Checkpoint = block
+	idx.mu.Unlock()
+
+	return idx.DB.Update(func(tx *bolt.Tx) error {
+		owners := tx.Bucket(bucketOwners)
+		holdings := tx.Bucket(bucketHoldings)
+		transfers := tx.Bucket(bucketTransfers)
+		byBlock := tx.Bucket(bucketByBlock)
+
+		affected := map[string]bool{}
+
+		var positions [][]byte
+		c := byBlock.Cursor()
+		for k, v := c.Seek(positionKey(block+1, 0)); k != nil; k, v = c.Next() {
+			positions = append(positions, append([]byte{}, k...))
+			affected[string(v)] = true
+
+			if err := transfers.Delete(append(append([]byte{}, v...), k...)); err != nil {
+				return err
+			}
+		}
+
+		for _, k := range positions {
+			if err := byBlock.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		for token := range affected {
+			// the last remaining transfer has the owner, none means unminted
+			var owner common.Address
+			tc := transfers.Cursor()
+			prefix := []byte(token)
+			for k, v := tc.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = tc.Next() {
+				owner = common.BytesToAddress(v[common.AddressLength : 2*common.AddressLength])
+			}
+
+			if err := setOwner(owners, holdings, prefix, owner); err != nil {
+				return err
+			}
+		}
+
+		blocks := tx.Bucket(bucketBlocks)
+		var stale [][]byte
+		bc := blocks.Cursor()
+		for k, _ := bc.Seek(blockKey(block + 1)); k != nil; k, _ = bc.Next() {
+			stale = append(stale, append([]byte{}, k...))
+		}
+		for _, k := range stale {
+			if err := blocks.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		if block == 0 && hash == (common.Hash{}) {
+			return tx.Bucket(bucketMeta).Delete(keyCheckpoint)
+		}
+		return setCheckpoint(tx, block, hash)
+	})
+}
+
+// Checkpoint returns the last indexed block, 0 if nothing was indexed yet.
+func (idx *Indexer) Checkpoint() (uint64, error) {
+	var checkpoint uint64
+
+	err := idx.DB.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(bucketMeta).Get(keyCheckpoint); v != nil {
+			checkpoint = binary.BigEndian.Uint64(v)
+		}
+		return nil
+	})
+
+	return checkpoint, err
+}
+
+// Owner returns the indexed owner of a token; ok is false for tokens the
+// indexer hasn't seen minted (or that were burned).
+func (idx *Indexer) Owner(contract common.Address, id *big.Int) (owner common.Address, ok bool, err error) {
+	err = idx.DB.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(bucketOwners).Get(tokenKey(contract, id)); v != nil {
+			owner, ok = common.BytesToAddress(v), true
+		}
+		return nil
+	})
+
+	return owner, ok, err
+}
+
+// Holdings lists the indexed tokens held by owner.
+func (idx *Indexer) Holdings(owner common.Address) ([]Holding, error) {
+	var holdings []Holding
+
+	err := idx.DB.View(func(tx *bolt.Tx) error {
+		prefix := owner.Bytes()
+		c := tx.Bucket(bucketHoldings).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			contract, id := splitTokenKey(k[common.AddressLength:])
+			holdings = append(holdings, Holding{contract, id})
+		}
+		return nil
+	})
+
+	return holdings, err
+}
+
+// History lists the indexed transfers of a token, oldest first.
+func (idx *Indexer) History(contract common.Address, id *big.Int) ([]Transfer, error) {
+	var history []Transfer
+
+	err := idx.DB.View(func(tx *bolt.Tx) error {
+		prefix := tokenKey(contract, id)
+		c := tx.Bucket(bucketTransfers).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			position := k[len(prefix):]
+			history = append(history, Transfer{
+				Contract: contract,
+				ID:       id,
+				From:     common.BytesToAddress(v[:common.AddressLength]),
+				To:       common.BytesToAddress(v[common.AddressLength : 2*common.AddressLength]),
+				Block:    binary.BigEndian.Uint64(position[:8]),
+				LogIndex: uint(binary.BigEndian.Uint32(position[8:])),
+				TxHash:   common.BytesToHash(v[2*common.AddressLength:]),
+			})
+		}
+		return nil
+	})
+
+	return history, err
+}
+
+func (idx *Indexer) Stats() IndexerStats {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return idx.stats
+}
+
+// isRangeError reports whether a provider refused a FilterLogs call for
+// covering too many blocks or returning too many logs. There's no standard
+// error code for it, so match the messages of the common providers.
+func isRangeError(err error) bool {
+	msg := strings.ToLower(err.Error())
+
+	for _, s := range []string{"more than", "too many", "too large", "block range", "limit exceeded", "response size"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// setOwner moves token to owner; the zero address removes it.
+func setOwner(owners, holdings *bolt.Bucket, token []byte, owner common.Address) error {
+	if previous := owners.Get(token); previous != nil {
+		if err := holdings.Delete(append(append([]byte{}, previous...), token...)); err != nil {
+			return err
+		}
+	}
+
+	if owner == (common.Address{}) {
+		return owners.Delete(token)
+	}
+
+	if err := owners.Put(token, owner.Bytes()); err != nil {
+		return err
+	}
+	return holdings.Put(append(owner.Bytes(), token...), nil)
+}
+
+func setCheckpoint(tx *bolt.Tx, block uint64, hash common.Hash) error {
+	if err := tx.Bucket(bucketMeta).Put(keyCheckpoint, blockKey(block)); err != nil {
+		return err
+	}
+
+	blocks := tx.Bucket(bucketBlocks)
+	if err := blocks.Put(blockKey(block), hash.Bytes()); err != nil {
+		return err
+	}
+
+	// keys are collected first, deleting moves the cursor
+	var stale [][]byte
+	kept := 0
+	c := blocks.Cursor()
+	for k, _ := c.Seek(blockKey(block)); k != nil; k, _ = c.Prev() {
+		if kept < keptCheckpoints {
+			kept++
+			continue
+		}
+		stale = append(stale, append([]byte{}, k...))
+	}
+
+	for _, k := range stale {
+		if err := blocks.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tokenKey is the 20 byte contract address followed by the 32 byte id, so
+// keys sort by contract and then numerically by id.
+func tokenKey(contract common.Address, id *big.Int) []byte {
+	key := make([]byte, common.AddressLength+32)
+	copy(key, contract.Bytes())
+	id.FillBytes(key[common.AddressLength:])
+	return key
+}
+
+func splitTokenKey(key []byte) (common.Address, *big.Int) {
+	return common.BytesToAddress(key[:common.AddressLength]), new(big.Int).SetBytes(key[common.AddressLength:])
+}
+
+func blockKey(block uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, block)
+}
+
+func positionKey(block uint64, index uint) []byte {
+	return binary.BigEndian.AppendUint32(blockKey(block), uint32(index))
+}
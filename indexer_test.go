@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"math/big"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	bolt "go.etcd.io/bbolt"
+)
+
+func openTestIndexer(t *testing.T, backend IndexerBackend, contracts ...common.Address) *Indexer {
+	idx, err := OpenIndexer(filepath.Join(t.TempDir(), "index.db"), backend, contracts)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { idx.Close() })
+
+	idx.Confirmations = 0
+	return idx
+}
+
+func TestIndexerReorg(t *testing.T) {
+	ctx := context.Background()
+	chain := newSimulatedChain(t)
+	contract := chain.deploy(transferEmitterCode())
+	idx := openTestIndexer(t, chain, contract)
+
+	alice, bob := common.HexToAddress("0xa11ce"), common.HexToAddress("0xb0b")
+
+	if err := idx.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	forkPoint := chain.blockHash(1)
+
+	chain.emitTransfer(contract, common.Address{}, alice, 7)
+	chain.Commit()
+
+	if err := idx.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if owner, ok, err := idx.Owner(contract, big.NewInt(7)); err != nil || !ok || owner != alice {
+		t.Fatalf("got owner %v %v %v before the reorg, want %v", owner, ok, err, alice)
+	}
+
+	// a longer chain where bob got the token instead
+	if err := chain.Fork(ctx, forkPoint); err != nil {
+		t.Fatal(err)
+	}
+	chain.emitTransfer(contract, common.Address{}, bob, 7)
+	chain.Commit()
+	chain.Commit()
+	chain.Commit()
+
+	if err := idx.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if owner, ok, err := idx.Owner(contract, big.NewInt(7)); err != nil || !ok || owner != bob {
+		t.Fatalf("got owner %v %v %v after the reorg, want %v", owner, ok, err, bob)
+	}
+
+	history, err := idx.History(contract, big.NewInt(7))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(history) != 1 || history[0].To != bob {
+		t.Fatalf("got history %+v, want only the transfer to bob", history)
+	}
+
+	holdings, err := idx.Holdings(alice)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(holdings) != 0 {
+		t.Fatalf("alice still holds %+v", holdings)
+	}
+
+	stats := idx.Stats()
+
+	if stats.Reorgs != 1 || stats.Checkpoint != 4 {
+		t.Fatalf("got %d reorgs and checkpoint %d, want 1 and 4", stats.Reorgs, stats.Checkpoint)
+	}
+}
+
+func TestSetCheckpointKeepsCheckpoints(t *testing.T) {
+	idx := openTestIndexer(t, nil)
+
+	err := idx.DB.Update(func(tx *bolt.Tx) error {
+		for block := uint64(1); block <= keptCheckpoints+44; block++ {
+			if err := setCheckpoint(tx, block, common.Hash{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = idx.DB.View(func(tx *bolt.Tx) error {
+		blocks := tx.Bucket(bucketBlocks)
+
+		if n := blocks.Stats().KeyN; n != keptCheckpoints {
+			t.Errorf("kept %d checkpoints, want %d", n, keptCheckpoints)
+		}
+
+		if k, _ := blocks.Cursor().First(); binary.BigEndian.Uint64(k) != 45 {
+			t.Errorf("oldest checkpoint is %d, want 45", binary.BigEndian.Uint64(k))
+		}
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// renderKeyRegex matches the cache keys of citizen renders, see
+// RenderSpec.CacheKey.
+var renderKeyRegex = regexp.MustCompile(`^s(\d+)/(\d+)/[^/]+$`)
+
+// Invalidation is an entry of the invalidation log.
+type Invalidation struct {
+	Time    time.Time `json:"time"`
+	Season  int       `json:"season"`
+	ID      int       `json:"id"`
+	OldHash string    `json:"old_hash,omitempty"`
+	NewHash string    `json:"new_hash"`
+	Purged  []string  `json:"purged"`
+}
+
+// Invalidator periodically compares the tokenURI every cached citizen was
+// rendered from with the one on chain, and purges every cached variant of
+// a token whose metadata changed. Renders cached without a tokenURI hash
+// can't be checked and are purged as well. The hash each token had on the
+// last pass is remembered, so only the renders of tokens whose tokenURI
+// changed since are looked at again.
+type Invalidator struct {
+	Cache    Cache
+	Citizens map[int]*CitizenContracts
+	Interval time.Duration
+	// LogSize is the number of invalidations kept for the log endpoint.
+	LogSize int
+
+	// checked is the tokenURI hash of every token ("s1/42") whose renders
+	// all matched it on a previous pass. Only Check uses it.
+	checked map[string]string
+
+	mu        sync.Mutex
+	log       []Invalidation
+	lastRun   time.Time
+	lastError string
+}
+
+func NewInvalidator(cache Cache, citizens map[int]*CitizenContracts) *Invalidator {
+	return &Invalidator{
+		Cache:    cache,
+		Citizens: citizens,
+		Interval: time.Hour,
+		LogSize:  500,
+		checked:  map[string]string{},
+	}
+}
+
+// Run checks the cache every Interval until ctx is done.
+func (inv *Invalidator) Run(ctx context.Context) {
+	for {
+		if err := inv.Check(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("invalidator: %v", err)
+		}
+
+		select {
+		case <-time.After(inv.Interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Check runs a single pass over every season.
+func (inv *Invalidator) Check(ctx context.Context) error {
+	seasons := make([]int, 0, len(inv.Citizens))
+	for season := range inv.Citizens {
+		seasons = append(seasons, season)
+	}
+	sort.Ints(seasons)
+
+	var err error
+	for _, season := range seasons {
+		if err = inv.checkSeason(ctx, season); err != nil {
+			break
+		}
+	}
+
+	inv.mu.Lock()
+	inv.lastRun = time.Now()
+	inv.lastError = ""
+	if err != nil {
+		inv.lastError = err.Error()
+	}
+	inv.mu.Unlock()
+
+	return err
+}
+
+func (inv *Invalidator) checkSeason(ctx context.Context, season int) error {
+	keys, err := inv.Cache.List(ctx, fmt.Sprintf("s%d/", season))
+
+	if err != nil {
+		return err
+	}
+
+	byToken := map[int][]string{}
+
+	for _, key := range keys {
+		if match := renderKeyRegex.FindStringSubmatch(key); match != nil {
+			id, _ := strconv.Atoi(match[2])
+			byToken[id] = append(byToken[id], key)
+		}
+	}
+
+	if len(byToken) == 0 {
+		return nil
+	}
+
+	ids := make([]int, 0, len(byToken))
+	bigIds := make([]*big.Int, 0, len(byToken))
+	for id := range byToken {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		bigIds = append(bigIds, big.NewInt(int64(id)))
+	}
+
+	results, err := inv.Citizens[season].TokenURIs(ctx, bigIds)
+
+	if err != nil {
+		return err
+	}
+
+	for i, id := range ids {
+		// a token that can't be looked up right now keeps its renders
+		if results[i].Err != nil {
+			continue
+		}
+
+		current := sha256Hex([]byte(results[i].URI))
+		token := fmt.Sprintf("s%d/%d", season, id)
+
+		// renders added since were made from the same tokenURI
+		if inv.checked[token] == current {
+			continue
+		}
+
+		var stale []string
+		var oldHash string
+
+		for _, key := range byToken[id] {
+			hash, err := inv.hash(ctx, key)
+
+			if errors.Is(err, ErrCacheMiss) || hash == pinnedHash {
+				continue
+			} else if err != nil {
+				return err
+			}
+
+			if hash != current {
+				stale = append(stale, key)
+				oldHash = hash
+			}
+		}
+
+		if len(stale) == 0 {
+			inv.checked[token] = current
+			continue
+		}
+
+		if err := inv.purge(ctx, stale); err != nil {
+			return err
+		}
+
+		inv.checked[token] = current
+
+		log.Printf("invalidator: s%d #%d: purged %d renders of outdated metadata", season, id, len(stale))
+
+		inv.record(Invalidation{
+			Time:    time.Now(),
+			Season:  season,
+			ID:      id,
+			OldHash: oldHash,
+			NewHash: current,
+			Purged:  stale,
+		})
+	}
+
+	return nil
+}
+
+// pinnedHash stands in for the hash of renders pinned to a block.
+const pinnedHash = "pinned"
+
+// hash returns the tokenURI hash stored with a cache entry, "" when it was
+// cached before hashes were stored.
+func (inv *Invalidator) hash(ctx context.Context, key string) (string, error) {
+	entry, err := inv.Cache.Stat(ctx, key)
+
+	if err != nil {
+		return "", err
+	}
+
+	if entry.Metadata["block"] != "" {
+		return pinnedHash, nil
+	}
+	return entry.Metadata["token-uri-sha256"], nil
+}
+
+func (inv *Invalidator) purge(ctx context.Context, keys []string) error {
+	for _, key := range keys {
+		if err := inv.Cache.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (inv *Invalidator) record(entry Invalidation) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	inv.log = append(inv.log, entry)
+	if over := len(inv.log) - max(inv.LogSize, 1); over > 0 {
+		inv.log = append([]Invalidation(nil), inv.log[over:]...)
+	}
+}
+
+// Log returns the recorded invalidations, newest first.
+func (inv *Invalidator) Log() []Invalidation {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	entries := make([]Invalidation, len(inv.log))
+	for i, entry := range inv.log {
+		entries[len(inv.log)-1-i] = entry
+	}
+	return entries
+}
+
+func invalidations(inv *Invalidator) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		inv.mu.Lock()
+		lastRun, lastError := inv.lastRun, inv.lastError
+		inv.mu.Unlock()
+
+		response := map[string]interface{}{
+			"interval":    inv.Interval.String(),
+			"last_error":  lastError,
+			"invalidated": inv.Log(),
+		}
+
+		if !lastRun.IsZero() {
+			response["last_run"] = lastRun
+		}
+
+		return c.JSON(http.StatusOK, response)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// uriContract serves tokenURIs that can be changed between passes.
+type uriContract struct {
+	mu   sync.Mutex
+	uris map[int64]string
+}
+
+func (u *uriContract) set(id int64, uri string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.uris[id] = uri
+}
+
+func (u *uriContract) TokenURI(opts *bind.CallOpts, id *big.Int) (string, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	uri, ok := u.uris[id.Int64()]
+	if !ok {
+		return "", errors.New("execution reverted")
+	}
+	return uri, nil
+}
+
+func (u *uriContract) OwnerOf(opts *bind.CallOpts, id *big.Int) (common.Address, error) {
+	return common.Address{}, errors.New("execution reverted")
+}
+
+func (u *uriContract) TotalSupply(opts *bind.CallOpts) (*big.Int, error) {
+	return big.NewInt(int64(len(u.uris))), nil
+}
+
+// statCounter counts the entries read from a cache.
+type statCounter struct {
+	Cache
+	stats map[string]int
+}
+
+func (s *statCounter) Stat(ctx context.Context, key string) (*CacheEntry, error) {
+	s.stats[key]++
+	return s.Cache.Stat(ctx, key)
+}
+
+func TestInvalidator(t *testing.T) {
+	ctx := context.Background()
+
+	files, err := NewFileCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := &statCounter{Cache: files, stats: map[string]int{}}
+
+	contract := &uriContract{uris: map[int64]string{1: "uri 1", 2: "uri 2"}}
+	inv := NewInvalidator(cache, map[int]*CitizenContracts{1: {Old: &uriContract{uris: map[int64]string{}}, New: contract}})
+
+	put := func(key string, metadata map[string]string) {
+		if err := cache.Put(ctx, key, []byte("png"), CacheEntry{ContentType: "image/png", Metadata: metadata}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	put("s1/1/a.png", map[string]string{"token-uri-sha256": sha256Hex([]byte("uri 1"))})
+	put("s1/1/b.png", map[string]string{"token-uri-sha256": sha256Hex([]byte("uri 1"))})
+	put("s1/1/pinned.png", map[string]string{"token-uri-sha256": sha256Hex([]byte("uri 0")), "block": "100"})
+	put("s1/2/a.png", map[string]string{"token-uri-sha256": sha256Hex([]byte("uri 2"))})
+	put("s1/2/old.png", map[string]string{"token-uri-sha256": sha256Hex([]byte("uri 1"))})
+	put("s1/2/unhashed.png", nil)
+	// not a render of a citizen
+	put("s1/parts/land/1/render.png", nil)
+
+	remaining := func() []string {
+		keys, err := cache.List(ctx, "s1/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+
+	if err := inv.Check(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"s1/1/a.png", "s1/1/b.png", "s1/1/pinned.png", "s1/2/a.png", "s1/parts/land/1/render.png"}
+
+	if got := remaining(); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Fatalf("kept %v, want %v", got, want)
+	}
+
+	if log := inv.Log(); len(log) != 1 || log[0].ID != 2 || len(log[0].Purged) != 2 || log[0].NewHash != sha256Hex([]byte("uri 2")) {
+		t.Errorf("got log %+v", log)
+	}
+
+	// nothing changed, nothing is read again
+	before := len(cache.stats)
+	for key := range cache.stats {
+		cache.stats[key] = 0
+	}
+
+	if err := inv.Check(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, n := range cache.stats {
+		if n != 0 {
+			t.Errorf("read %s again although its token didn't change", key)
+		}
+	}
+
+	// only the renders of the token that changed are read and purged
+	contract.set(1, "uri 1b")
+	put("s1/1/c.png", map[string]string{"token-uri-sha256": sha256Hex([]byte("uri 1b"))})
+
+	if err := inv.Check(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	want = []string{"s1/1/c.png", "s1/1/pinned.png", "s1/2/a.png", "s1/parts/land/1/render.png"}
+
+	if got := remaining(); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Fatalf("kept %v, want %v", got, want)
+	}
+
+	if cache.stats["s1/2/a.png"] != 0 || cache.stats["s1/1/a.png"] != 1 || len(cache.stats) != before+1 {
+		t.Errorf("read %v", cache.stats)
+	}
+
+	if log := inv.Log(); len(log) != 2 || log[0].ID != 1 || log[0].OldHash != sha256Hex([]byte("uri 1")) {
+		t.Errorf("got log %+v", log)
+	}
+}
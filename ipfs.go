@@ -0,0 +1,527 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// This file implements just enough of IPFS to verify gateway responses
+// without trusting the gateway: CID parsing, CARv1 decoding, dag-pb and
+// UnixFS directory traversal and file reassembly.
+
+// Multicodecs and multihashes understood by the verifier.
+const (
+	codecRaw   = 0x55
+	codecDagPB = 0x70
+
+	hashIdentity = 0x00
+	hashSHA256   = 0x12
+)
+
+// UnixFS node types.
+const (
+	unixfsRaw       = 0
+	unixfsDirectory = 1
+	unixfsFile      = 2
+	unixfsHAMTShard = 5
+)
+
+var (
+	ErrCIDMismatch  = errors.New("ipfs: block does not match its CID")
+	ErrMissingBlock = errors.New("ipfs: CAR is missing a block")
+	ErrNoSuchLink   = errors.New("ipfs: path does not exist")
+)
+
+// CID is a parsed content identifier.
+type CID struct {
+	Version   int
+	Codec     uint64
+	Multihash []byte
+}
+
+func (c CID) String() string {
+	if c.Version == 0 {
+		return base58Encode(c.Multihash)
+	}
+	return "b" + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(c.Bytes()))
+}
+
+// Bytes returns the binary form of the CID.
+func (c CID) Bytes() []byte {
+	if c.Version == 0 {
+		return c.Multihash
+	}
+	buf := binary.AppendUvarint(nil, uint64(c.Version))
+	buf = binary.AppendUvarint(buf, c.Codec)
+	return append(buf, c.Multihash...)
+}
+
+// ParseCID parses a base58btc CIDv0 ("Qm...") or a base32 CIDv1 ("b...").
+func ParseCID(s string) (CID, error) {
+	if strings.HasPrefix(s, "Qm") && len(s) == 46 {
+		mh, err := base58Decode(s)
+		if err != nil {
+			return CID{}, err
+		}
+		if len(mh) != 34 || mh[0] != hashSHA256 || mh[1] != 32 {
+			return CID{}, fmt.Errorf("ipfs: malformed CIDv0 %q", s)
+		}
+		return CID{Version: 0, Codec: codecDagPB, Multihash: mh}, nil
+	}
+
+	if strings.HasPrefix(s, "b") {
+		raw, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(s[1:]))
+		if err != nil {
+			return CID{}, err
+		}
+		cid, n, err := readCID(raw)
+		if err != nil {
+			return CID{}, err
+		}
+		if n != len(raw) {
+			return CID{}, errors.New("ipfs: trailing bytes after CID")
+		}
+		return cid, nil
+	}
+
+	return CID{}, fmt.Errorf("ipfs: unsupported CID %q", s)
+}
+
+// readCID reads a binary CID from the start of b and returns its length.
+func readCID(b []byte) (CID, int, error) {
+	// a CIDv0 is a bare sha2-256 multihash
+	if len(b) >= 34 && b[0] == hashSHA256 && b[1] == 32 {
+		return CID{Version: 0, Codec: codecDagPB, Multihash: b[:34]}, 34, nil
+	}
+
+	version, n := binary.Uvarint(b)
+	if n <= 0 || version != 1 {
+		return CID{}, 0, errors.New("ipfs: unsupported CID version")
+	}
+	offset := n
+
+	codec, n := binary.Uvarint(b[offset:])
+	if n <= 0 {
+		return CID{}, 0, errors.New("ipfs: malformed CID codec")
+	}
+	offset += n
+
+	mhStart := offset
+	if _, n = binary.Uvarint(b[offset:]); n <= 0 {
+		return CID{}, 0, errors.New("ipfs: malformed multihash")
+	}
+	offset += n
+
+	length, n := binary.Uvarint(b[offset:])
+	if n <= 0 || uint64(len(b)-offset-n) < length {
+		return CID{}, 0, errors.New("ipfs: malformed multihash")
+	}
+	offset += n + int(length)
+
+	return CID{Version: 1, Codec: codec, Multihash: b[mhStart:offset]}, offset, nil
+}
+
+// verifyBlock checks that data hashes to the multihash of cid.
+func verifyBlock(cid CID, data []byte) error {
+	code, n := binary.Uvarint(cid.Multihash)
+	length, m := binary.Uvarint(cid.Multihash[n:])
+	digest := cid.Multihash[n+m:]
+
+	if uint64(len(digest)) != length {
+		return ErrCIDMismatch
+	}
+
+	switch code {
+	case hashSHA256:
+		sum := sha256.Sum256(data)
+		if !bytes.Equal(sum[:], digest) {
+			return ErrCIDMismatch
+		}
+	case hashIdentity:
+		if !bytes.Equal(data, digest) {
+			return ErrCIDMismatch
+		}
+	default:
+		return fmt.Errorf("ipfs: unsupported multihash 0x%x", code)
+	}
+	return nil
+}
+
+// Block is a verified block out of a CAR file.
+type Block struct {
+	CID  CID
+	Data []byte
+}
+
+// ReadCAR decodes a CARv1 stream and verifies every block against its CID.
+// Blocks are keyed by multihash so CIDv0 and CIDv1 references resolve to
+// the same block.
+func ReadCAR(car []byte) (map[string]*Block, error) {
+	headerLen, n := binary.Uvarint(car)
+	if n <= 0 || uint64(len(car)-n) < headerLen {
+		return nil, errors.New("ipfs: malformed CAR header")
+	}
+	rest := car[n+int(headerLen):]
+
+	blocks := map[string]*Block{}
+
+	for len(rest) > 0 {
+		sectionLen, n := binary.Uvarint(rest)
+		if n <= 0 || uint64(len(rest)-n) < sectionLen {
+			return nil, errors.New("ipfs: truncated CAR section")
+		}
+		section := rest[n : n+int(sectionLen)]
+		rest = rest[n+int(sectionLen):]
+
+		cid, cidLen, err := readCID(section)
+		if err != nil {
+			return nil, err
+		}
+
+		data := section[cidLen:]
+		if err := verifyBlock(cid, data); err != nil {
+			return nil, fmt.Errorf("%w: %s", err, cid)
+		}
+
+		blocks[string(cid.Multihash)] = &Block{cid, data}
+	}
+
+	return blocks, nil
+}
+
+// PBLink is a named link of a dag-pb node.
+type PBLink struct {
+	CID   CID
+	Name  string
+	Tsize uint64
+}
+
+// PBNode is a decoded dag-pb node together with its UnixFS data.
+type PBNode struct {
+	Links []PBLink
+
+	Type     uint64
+	Data     []byte
+	Fanout   uint64
+	FileSize uint64
+}
+
+// protobufFields iterates the fields of a protobuf message, calling fn with
+// the field number and either the varint value or the length delimited bytes.
+func protobufFields(b []byte, fn func(field int, value uint64, bytes []byte) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errors.New("ipfs: malformed protobuf")
+		}
+		b = b[n:]
+
+		field, wire := int(key>>3), key&7
+
+		switch wire {
+		case 0:
+			value, n := binary.Uvarint(b)
+			if n <= 0 {
+				return errors.New("ipfs: malformed protobuf varint")
+			}
+			b = b[n:]
+			if err := fn(field, value, nil); err != nil {
+				return err
+			}
+		case 2:
+			length, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < length {
+				return errors.New("ipfs: malformed protobuf bytes")
+			}
+			if err := fn(field, 0, b[n:n+int(length)]); err != nil {
+				return err
+			}
+			b = b[n+int(length):]
+		default:
+			return fmt.Errorf("ipfs: unsupported protobuf wire type %d", wire)
+		}
+	}
+	return nil
+}
+
+// DecodePBNode decodes a dag-pb block and the UnixFS message in its data.
+func DecodePBNode(data []byte) (*PBNode, error) {
+	node := &PBNode{}
+	var unixfs []byte
+
+	err := protobufFields(data, func(field int, _ uint64, value []byte) error {
+		switch field {
+		case 1:
+			unixfs = value
+		case 2:
+			var link PBLink
+			err := protobufFields(value, func(field int, v uint64, b []byte) error {
+				var err error
+				switch field {
+				case 1:
+					link.CID, _, err = readCID(b)
+				case 2:
+					link.Name = string(b)
+				case 3:
+					link.Tsize = v
+				}
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			node.Links = append(node.Links, link)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = protobufFields(unixfs, func(field int, v uint64, b []byte) error {
+		switch field {
+		case 1:
+			node.Type = v
+		case 2:
+			node.Data = b
+		case 3:
+			node.FileSize = v
+		case 6:
+			node.Fanout = v
+		}
+		return nil
+	})
+	return node, err
+}
+
+// blockStore resolves UnixFS paths over a set of verified blocks.
+type blockStore map[string]*Block
+
+func (s blockStore) node(cid CID) (*PBNode, error) {
+	block, ok := s[string(cid.Multihash)]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrMissingBlock, cid)
+	}
+	if cid.Codec != codecDagPB {
+		return nil, fmt.Errorf("ipfs: %s is not a dag-pb node", cid)
+	}
+	return DecodePBNode(block.Data)
+}
+
+// Resolve follows path from root through UnixFS directories.
+func (s blockStore) Resolve(root CID, path string) (CID, error) {
+	current := root
+
+	for _, segment := range strings.Split(strings.Trim(path, "/"), "/") {
+		if segment == "" {
+			continue
+		}
+
+		node, err := s.node(current)
+		if err != nil {
+			return CID{}, err
+		}
+
+		switch node.Type {
+		case unixfsDirectory:
+			current, err = findLink(node.Links, segment)
+		case unixfsHAMTShard:
+			current, err = s.findShardLink(node, segment)
+		default:
+			err = fmt.Errorf("ipfs: %s is not a directory", current)
+		}
+
+		if err != nil {
+			return CID{}, err
+		}
+	}
+
+	return current, nil
+}
+
+func findLink(links []PBLink, name string) (CID, error) {
+	for _, link := range links {
+		if link.Name == name {
+			return link.CID, nil
+		}
+	}
+	return CID{}, fmt.Errorf("%w: %s", ErrNoSuchLink, name)
+}
+
+// findShardLink looks name up in a HAMT sharded directory. Link names are a
+// hex bucket prefix, followed by the entry name for entries; links with a
+// bare prefix point at child shards.
+func (s blockStore) findShardLink(shard *PBNode, name string) (CID, error) {
+	return s.findInShard(shard, name, map[string]bool{})
+}
+
+// findInShard visits every child shard once, however often it is linked.
+func (s blockStore) findInShard(shard *PBNode, name string, seen map[string]bool) (CID, error) {
+	prefixLen := len(fmt.Sprintf("%X", shard.Fanout-1))
+
+	for _, link := range shard.Links {
+		if len(link.Name) < prefixLen {
+			continue
+		}
+
+		if link.Name[prefixLen:] == name {
+			return link.CID, nil
+		}
+
+		if len(link.Name) == prefixLen && !seen[string(link.CID.Multihash)] {
+			seen[string(link.CID.Multihash)] = true
+
+			child, err := s.node(link.CID)
+			if errors.Is(err, ErrMissingBlock) {
+				// a trustless gateway only includes the shards on the path
+				continue
+			} else if err != nil {
+				return CID{}, err
+			}
+
+			if found, err := s.findInShard(child, name, seen); err == nil {
+				return found, nil
+			}
+		}
+	}
+	return CID{}, fmt.Errorf("%w: %s", ErrNoSuchLink, name)
+}
+
+// Limits on the file ReadFile reassembles. A DAG can link the same blocks
+// any number of times, so without them a small CAR could expand without
+// bound.
+const (
+	maxUnixFSFileSize = 64 << 20
+	maxUnixFSLinks    = 1 << 16
+)
+
+var ErrFileTooLarge = errors.New("ipfs: file exceeds the size or link limit")
+
+// ReadFile reassembles the UnixFS file rooted at cid.
+func (s blockStore) ReadFile(cid CID) ([]byte, error) {
+	var content []byte
+	links := 0
+
+	if err := s.readFile(cid, &content, &links); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+func (s blockStore) readFile(cid CID, content *[]byte, links *int) error {
+	if cid.Codec == codecRaw {
+		block, ok := s[string(cid.Multihash)]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrMissingBlock, cid)
+		}
+		return appendLimited(content, block.Data)
+	}
+
+	node, err := s.node(cid)
+	if err != nil {
+		return err
+	}
+
+	if node.Type != unixfsFile && node.Type != unixfsRaw {
+		return fmt.Errorf("ipfs: %s is not a file", cid)
+	}
+
+	if node.FileSize > maxUnixFSFileSize {
+		return ErrFileTooLarge
+	}
+
+	if err := appendLimited(content, node.Data); err != nil {
+		return err
+	}
+
+	for _, link := range node.Links {
+		if *links++; *links > maxUnixFSLinks {
+			return ErrFileTooLarge
+		}
+
+		if err := s.readFile(link.CID, content, links); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appendLimited(content *[]byte, data []byte) error {
+	if len(*content)+len(data) > maxUnixFSFileSize {
+		return ErrFileTooLarge
+	}
+	*content = append(*content, data...)
+	return nil
+}
+
+// VerifyCAR checks a CAR returned for "<root>/<path>?format=car" and returns
+// the file content at path. Every block is hashed and the path is walked
+// from the requested root, so a gateway can't substitute any content.
+func VerifyCAR(car []byte, root CID, path string) ([]byte, error) {
+	blocks, err := ReadCAR(car)
+	if err != nil {
+		return nil, err
+	}
+
+	store := blockStore(blocks)
+
+	target, err := store.Resolve(root, path)
+	if err != nil {
+		return nil, err
+	}
+
+	return store.ReadFile(target)
+}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+func base58Decode(s string) ([]byte, error) {
+	n := new(big.Int)
+	radix := big.NewInt(58)
+
+	for _, r := range s {
+		idx := strings.IndexRune(base58Alphabet, r)
+		if idx < 0 {
+			return nil, fmt.Errorf("ipfs: invalid base58 character %q", r)
+		}
+		n.Mul(n, radix)
+		n.Add(n, big.NewInt(int64(idx)))
+	}
+
+	leadingZeros := 0
+	for leadingZeros < len(s) && s[leadingZeros] == '1' {
+		leadingZeros++
+	}
+
+	return append(make([]byte, leadingZeros), n.Bytes()...), nil
+}
+
+func base58Encode(b []byte) string {
+	n := new(big.Int).SetBytes(b)
+	radix := big.NewInt(58)
+	mod := new(big.Int)
+
+	var out []byte
+	for n.Sign() > 0 {
+		n.DivMod(n, radix, mod)
+		out = append(out, base58Alphabet[mod.Int64()])
+	}
+
+	for _, c := range b {
+		if c != 0 {
+			break
+		}
+		out = append(out, '1')
+	}
+
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return string(out)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// sha256Multihash returns the sha2-256 multihash of data.
+func sha256Multihash(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return append([]byte{hashSHA256, 32}, sum[:]...)
+}
+
+func rawCID(data []byte) CID {
+	return CID{Version: 1, Codec: codecRaw, Multihash: sha256Multihash(data)}
+}
+
+func pbCID(block []byte) CID {
+	return CID{Version: 0, Codec: codecDagPB, Multihash: sha256Multihash(block)}
+}
+
+func protobufVarint(b []byte, field int, value uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3)
+	return binary.AppendUvarint(b, value)
+}
+
+func protobufBytes(b []byte, field int, value []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+// pbBlock encodes a dag-pb node carrying a UnixFS message.
+func pbBlock(unixfsType uint64, data []byte, fanout uint64, links ...PBLink) []byte {
+	var block []byte
+
+	for _, link := range links {
+		var l []byte
+		l = protobufBytes(l, 1, link.CID.Bytes())
+		l = protobufBytes(l, 2, []byte(link.Name))
+		l = protobufVarint(l, 3, link.Tsize)
+		block = protobufBytes(block, 2, l)
+	}
+
+	unixfs := protobufVarint(nil, 1, unixfsType)
+	if data != nil {
+		unixfs = protobufBytes(unixfs, 2, data)
+	}
+	if fanout != 0 {
+		unixfs = protobufVarint(unixfs, 6, fanout)
+	}
+	return protobufBytes(block, 1, unixfs)
+}
+
+// testCAR builds a CARv1 with root in its header and the given blocks.
+type testCAR struct {
+	root   CID
+	blocks [][2][]byte
+}
+
+func (c *testCAR) add(cid CID, data []byte) CID {
+	c.blocks = append(c.blocks, [2][]byte{cid.Bytes(), data})
+	return cid
+}
+
+func (c *testCAR) raw(data []byte) CID {
+	return c.add(rawCID(data), data)
+}
+
+func (c *testCAR) node(block []byte) CID {
+	return c.add(pbCID(block), block)
+}
+
+func (c *testCAR) bytes() []byte {
+	// {"roots": [CID], "version": 1} in dag-cbor
+	root := append([]byte{0x00}, c.root.Bytes()...)
+	header := []byte{0xa2, 0x65}
+	header = append(header, "roots"...)
+	header = append(header, 0x81, 0xd8, 0x2a, 0x58, byte(len(root)))
+	header = append(header, root...)
+	header = append(header, 0x67)
+	header = append(header, "version"...)
+	header = append(header, 0x01)
+
+	car := binary.AppendUvarint(nil, uint64(len(header)))
+	car = append(car, header...)
+
+	for _, block := range c.blocks {
+		car = binary.AppendUvarint(car, uint64(len(block[0])+len(block[1])))
+		car = append(car, block[0]...)
+		car = append(car, block[1]...)
+	}
+	return car
+}
+
+// layersCAR is a directory with a raw file and a subdirectory holding a
+// file chunked into two raw blocks.
+func layersCAR() (car *testCAR, chunks [][]byte) {
+	car = &testCAR{}
+	chunks = [][]byte{bytes.Repeat([]byte("a"), 300), bytes.Repeat([]byte("b"), 200)}
+
+	png := car.raw([]byte("\x89PNG layer"))
+	big := car.node(pbBlock(unixfsFile, nil, 0,
+		PBLink{CID: car.raw(chunks[0]), Tsize: 300},
+		PBLink{CID: car.raw(chunks[1]), Tsize: 200},
+	))
+	sub := car.node(pbBlock(unixfsDirectory, nil, 0, PBLink{CID: big, Name: "big.bin"}))
+
+	car.root = car.node(pbBlock(unixfsDirectory, nil, 0,
+		PBLink{CID: png, Name: "1.png"},
+		PBLink{CID: sub, Name: "sub"},
+	))
+	return car, chunks
+}
+
+func TestVerifyCAR(t *testing.T) {
+	car, chunks := layersCAR()
+
+	data, err := VerifyCAR(car.bytes(), car.root, "1.png")
+
+	if err != nil || string(data) != "\x89PNG layer" {
+		t.Fatalf("got %q %v", data, err)
+	}
+
+	data, err = VerifyCAR(car.bytes(), car.root, "/sub/big.bin")
+
+	if err != nil || !bytes.Equal(data, append(append([]byte(nil), chunks[0]...), chunks[1]...)) {
+		t.Fatalf("got %d bytes %v for the nested file", len(data), err)
+	}
+}
+
+func TestVerifyCARRejects(t *testing.T) {
+	tests := []struct {
+		name  string
+		car   func() ([]byte, CID)
+		path  string
+		error error
+	}{
+		{"tampered block", func() ([]byte, CID) {
+			car, _ := layersCAR()
+			car.blocks[0][1] = []byte("\x89PNG other")
+			return car.bytes(), car.root
+		}, "1.png", ErrCIDMismatch},
+		{"missing block", func() ([]byte, CID) {
+			car, _ := layersCAR()
+			// the second chunk of big.bin
+			car.blocks = append(car.blocks[:2], car.blocks[3:]...)
+			return car.bytes(), car.root
+		}, "sub/big.bin", ErrMissingBlock},
+		{"wrong path", func() ([]byte, CID) {
+			car, _ := layersCAR()
+			return car.bytes(), car.root
+		}, "sub/2.png", ErrNoSuchLink},
+		{"root mismatch", func() ([]byte, CID) {
+			car, _ := layersCAR()
+			// a CAR for another directory with the same file
+			return car.bytes(), pbCID(pbBlock(unixfsDirectory, nil, 0, PBLink{CID: rawCID([]byte("\x89PNG layer")), Name: "1.png"}))
+		}, "1.png", ErrMissingBlock},
+		{"truncated", func() ([]byte, CID) {
+			car, _ := layersCAR()
+			b := car.bytes()
+			return b[:len(b)-10], car.root
+		}, "1.png", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			car, root := test.car()
+			data, err := VerifyCAR(car, root, test.path)
+
+			if err == nil {
+				t.Fatalf("accepted %q", data)
+			}
+
+			if test.error != nil && !errors.Is(err, test.error) {
+				t.Fatalf("got %v, want %v", err, test.error)
+			}
+		})
+	}
+
+	car, _ := layersCAR()
+
+	if _, err := VerifyCAR(car.bytes(), car.root, "1.png/x"); err == nil {
+		t.Error("walked into a file")
+	}
+}
+
+func TestVerifyCARShardedDirectory(t *testing.T) {
+	car := &testCAR{}
+	a, b := car.raw([]byte("layer a")), car.raw([]byte("layer b"))
+
+	child := car.node(pbBlock(unixfsHAMTShard, nil, 256, PBLink{CID: b, Name: "03b.png"}))
+	// a child shard that isn't on the path, left out like a trustless
+	// gateway would
+	absent := pbCID(pbBlock(unixfsHAMTShard, nil, 256, PBLink{CID: rawCID([]byte("c")), Name: "00c.png"}))
+
+	car.root = car.node(pbBlock(unixfsHAMTShard, nil, 256,
+		PBLink{CID: a, Name: "0Aa.png"},
+		PBLink{CID: absent, Name: "11"},
+		PBLink{CID: child, Name: "1F"},
+		PBLink{CID: child, Name: "2F"},
+	))
+
+	for path, want := range map[string]string{"a.png": "layer a", "b.png": "layer b"} {
+		data, err := VerifyCAR(car.bytes(), car.root, path)
+
+		if err != nil || string(data) != want {
+			t.Errorf("got %q %v for %s", data, err, path)
+		}
+	}
+
+	if _, err := VerifyCAR(car.bytes(), car.root, "d.png"); !errors.Is(err, ErrNoSuchLink) {
+		t.Errorf("got %v for an entry that isn't there", err)
+	}
+}
+
+func TestReadFileLimits(t *testing.T) {
+	chunk := bytes.Repeat([]byte{1}, 1<<20)
+	links := make([]PBLink, 65)
+
+	car := &testCAR{}
+	for i := range links {
+		links[i] = PBLink{CID: rawCID(chunk)}
+	}
+	car.raw(chunk)
+	car.root = car.node(pbBlock(unixfsFile, nil, 0, links...))
+
+	if _, err := VerifyCAR(car.bytes(), car.root, ""); !errors.Is(err, ErrFileTooLarge) {
+		t.Errorf("got %v for a file larger than the limit", err)
+	}
+
+	links = make([]PBLink, maxUnixFSLinks+1)
+	for i := range links {
+		links[i] = PBLink{CID: rawCID(nil)}
+	}
+
+	car = &testCAR{}
+	car.raw(nil)
+	car.root = car.node(pbBlock(unixfsFile, nil, 0, links...))
+
+	if _, err := VerifyCAR(car.bytes(), car.root, ""); !errors.Is(err, ErrFileTooLarge) {
+		t.Errorf("got %v for a file with too many links", err)
+	}
+}
+
+func TestParseCID(t *testing.T) {
+	car, _ := layersCAR()
+	raw := rawCID([]byte("\x89PNG layer"))
+
+	for _, cid := range []CID{car.root, raw} {
+		parsed, err := ParseCID(cid.String())
+
+		if err != nil || parsed.Version != cid.Version || parsed.Codec != cid.Codec || !bytes.Equal(parsed.Multihash, cid.Multihash) {
+			t.Errorf("ParseCID(%s) = %+v %v", cid, parsed, err)
+		}
+	}
+
+	if s := car.root.String(); s[:2] != "Qm" || len(s) != 46 {
+		t.Errorf("got CIDv0 %s", s)
+	}
+
+	for _, s := range []string{"", "Qm" + "0OIl" + car.root.String()[6:], "zb2rhe5P4gXftAwvA4eXQ5HJwsER2owDyS9sKaQRRVQPn93bA", "b" + "!!!", raw.String() + "aa"} {
+		if _, err := ParseCID(s); err == nil {
+			t.Errorf("parsed %q", s)
+		}
+	}
+}
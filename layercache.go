@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"image"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// layers caches trait images shared by every render. It is configured in
+// main from LAYER_CACHE_BYTES and LAYER_CACHE_DIR.
+var layers = NewLayerCache(256<<20, "")
+
+// LayerCache is a content-addressed cache of trait layers keyed by IPFS
+// CID and path. Decoded images are kept in memory in LRU order within a
+// byte budget; the raw PNG bytes are also written to Dir so evicted or
+// restarted entries can be decoded again without touching the network.
+type LayerCache struct {
+	Budget int64
+	Dir    string
+
+	mu    sync.Mutex
+	used  int64
+	order *list.List
+	items map[string]*list.Element
+
+	hits, diskHits, misses, evictions uint64
+}
+
+type layerCacheItem struct {
+	key  string
+	img  image.Image
+	size int64
+}
+
+// LayerCacheStats is a snapshot of the LayerCache counters.
+type LayerCacheStats struct {
+	Hits      uint64 `json:"hits"`
+	DiskHits  uint64 `json:"disk_hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Entries   int    `json:"entries"`
+	Bytes     int64  `json:"bytes"`
+	Budget    int64  `json:"budget"`
+}
+
+func NewLayerCache(budget int64, dir string) *LayerCache {
+	return &LayerCache{
+		Budget: budget,
+		Dir:    dir,
+		order:  list.New(),
+		items:  map[string]*list.Element{},
+	}
+}
+
+// layerKey returns the content address "<CID>/<path>" of an IPFS layer
+// URL. URLs outside IPFS aren't immutable and therefore not cacheable, and
+// neither are paths leaving the CID, which would file the content of one
+// CID under another.
+func layerKey(url string) (string, bool) {
+	groups := IPFSRegex.FindStringSubmatch(url)
+	if groups == nil {
+		return "", false
+	}
+
+	key, err := cleanKey(groups[2] + "/" + groups[3])
+	if err != nil || !strings.HasPrefix(key, groups[2]+"/") {
+		return "", false
+	}
+	return key, true
+}
+
+// Get returns the decoded layer for key, consulting memory and then disk.
+func (l *LayerCache) Get(key string) (image.Image, bool) {
+	l.mu.Lock()
+	if el, ok := l.items[key]; ok {
+		l.order.MoveToFront(el)
+		l.mu.Unlock()
+		atomic.AddUint64(&l.hits, 1)
+		return el.Value.(*layerCacheItem).img, true
+	}
+	l.mu.Unlock()
+
+	if raw, err := l.readRaw(key); err == nil {
+		if img, _, err := image.Decode(bytes.NewReader(raw)); err == nil {
+			atomic.AddUint64(&l.diskHits, 1)
+			l.add(key, img)
+			return img, true
+		}
+	}
+
+	atomic.AddUint64(&l.misses, 1)
+	return nil, false
+}
+
+// Put stores a freshly downloaded layer, both decoded and raw.
+func (l *LayerCache) Put(key string, raw []byte, img image.Image) {
+	l.add(key, img)
+
+	if l.Dir == "" {
+		return
+	}
+
+	p := filepath.Join(l.Dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err == nil {
+		writeFileAtomic(p, raw)
+	}
+}
+
+func (l *LayerCache) Stats() LayerCacheStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return LayerCacheStats{
+		Hits:      atomic.LoadUint64(&l.hits),
+		DiskHits:  atomic.LoadUint64(&l.diskHits),
+		Misses:    atomic.LoadUint64(&l.misses),
+		Evictions: atomic.LoadUint64(&l.evictions),
+		Entries:   len(l.items),
+		Bytes:     l.used,
+		Budget:    l.Budget,
+	}
+}
+
+func (l *LayerCache) readRaw(key string) ([]byte, error) {
+	if l.Dir == "" {
+		return nil, fs.ErrNotExist
+	}
+	return os.ReadFile(filepath.Join(l.Dir, filepath.FromSlash(key)))
+}
+
+func (l *LayerCache) add(key string, img image.Image) {
+	size := decodedSize(img)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if el, ok := l.items[key]; ok {
+		l.order.MoveToFront(el)
+		return
+	}
+
+	// a single layer larger than the whole budget is never kept in memory
+	if size > l.Budget {
+		return
+	}
+
+	l.items[key] = l.order.PushFront(&layerCacheItem{key, img, size})
+	l.used += size
+
+	for l.used > l.Budget {
+		oldest := l.order.Back()
+		item := oldest.Value.(*layerCacheItem)
+		l.order.Remove(oldest)
+		delete(l.items, item.key)
+		l.used -= item.size
+		atomic.AddUint64(&l.evictions, 1)
+	}
+}
+
+// decodedSize estimates the memory held by a decoded image.
+func decodedSize(img image.Image) int64 {
+	bounds := img.Bounds()
+	pixels := int64(bounds.Dx()) * int64(bounds.Dy())
+
+	switch img.(type) {
+	case *image.Paletted, *image.Gray, *image.Alpha:
+		return pixels
+	case *image.RGBA64, *image.NRGBA64:
+		return pixels * 8
+	}
+	return pixels * 4
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLayerCacheHitsAndMisses(t *testing.T) {
+	gw := newTestGateway(t, map[string][]byte{"hair/a.png": layerPNG(4, color.Black)})
+	useGateways(t, gw)
+
+	for i := 0; i < 3; i++ {
+		if _, err := fetchImage(context.Background(), layerURL("hair/a.png")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := gw.count("hair/a.png"); n != 1 {
+		t.Errorf("the layer was downloaded %d times", n)
+	}
+
+	if stats := layers.Stats(); stats.Misses != 1 || stats.Hits != 2 || stats.Entries != 1 || stats.Bytes != 4*4*4 {
+		t.Errorf("got %+v", stats)
+	}
+
+	// the same layer through another gateway is the same content
+	if _, err := fetchImage(context.Background(), "https://ipfs.io/ipfs/"+testLayersCID+"/hair/a.png"); err != nil || gw.count("hair/a.png") != 1 {
+		t.Errorf("downloaded again from another gateway URL: %v", err)
+	}
+}
+
+func TestLayerCacheEviction(t *testing.T) {
+	dir := t.TempDir()
+	// room for two 4x4 layers
+	cache := NewLayerCache(2*4*4*4, dir)
+
+	for _, key := range []string{"cid/a.png", "cid/b.png"} {
+		cache.Put(key, layerPNG(4, color.Black), mustDecodePNG(t, layerPNG(4, color.Black)))
+	}
+
+	// a is used last, so b is evicted for c
+	cache.Get("cid/a.png")
+	cache.Put("cid/c.png", layerPNG(4, color.White), mustDecodePNG(t, layerPNG(4, color.White)))
+
+	if stats := cache.Stats(); stats.Evictions != 1 || stats.Entries != 2 || stats.Bytes != 2*4*4*4 {
+		t.Fatalf("got %+v", stats)
+	}
+
+	// evicted layers are decoded again from disk
+	if _, ok := cache.Get("cid/b.png"); !ok {
+		t.Error("lost the evicted layer")
+	}
+
+	if stats := cache.Stats(); stats.DiskHits != 1 || stats.Misses != 0 {
+		t.Errorf("got %+v", stats)
+	}
+
+	os.Remove(filepath.Join(dir, "cid", "a.png"))
+
+	// b pushed a out of memory, and it's gone from disk too
+	if _, ok := cache.Get("cid/a.png"); ok {
+		t.Error("got a layer that is neither in memory nor on disk")
+	}
+
+	// a layer larger than the budget is only kept on disk
+	cache.Put("cid/big.png", layerPNG(8, color.Black), mustDecodePNG(t, layerPNG(8, color.Black)))
+
+	if stats := cache.Stats(); stats.Entries != 2 || stats.Bytes > cache.Budget {
+		t.Errorf("got %+v after a layer larger than the budget", stats)
+	}
+}
+
+func TestLayerKey(t *testing.T) {
+	tests := map[string]string{
+		layerURL("hair/a.png"): testLayersCID + "/hair/a.png",
+		"https://ipfs.io/ipfs/" + testLayersCID + "/hair/../../etc/passwd": "",
+		"https://example.com/hair/a.png":                                   "",
+	}
+
+	for url, want := range tests {
+		if key, ok := layerKey(url); key != want || ok != (want != "") {
+			t.Errorf("layerKey(%s) = %q %v, want %q", url, key, ok, want)
+		}
+	}
+}
+
+func mustDecodePNG(t *testing.T, data []byte) image.Image {
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
@@ -1,28 +1,29 @@
 package main
 
 import (
-	"encoding/base64"
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"image"
 	"image/color"
 	"image/png"
-	"io/ioutil"
+	"io"
 	"log"
 	"math/big"
 	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/NT-community/citizen-gen/erc721"
 	"github.com/disintegration/imaging"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/joho/godotenv"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -31,10 +32,12 @@ import (
 )
 
 var (
-	descriptionRegex              = regexp.MustCompile(`(\"description\":\s\")(.+)(\",)`)
 	hexColorRegex                 = regexp.MustCompile(`([a-fA-F0-9]{6})`)
 	santaHat, emptyFist, snowBall image.Image
 
+	// renderCache holds every PNG the service has rendered
+	renderCache Cache
+
 	ColorCodedRarity = map[string]string{
 		"elite":   "faac27", // gold color for elite
 		"default": "849ef3",
@@ -57,44 +60,32 @@ func init() {
 	// load the .env file
 	godotenv.Load()
 
-	os.Mkdir("images", os.ModePerm)
+	loadFetchConfig()
 
 	santaHat = mustLoadImage("assets/santa_hat.png")
 	emptyFist = mustLoadImage("assets/empty_fist.png")
 	snowBall = mustLoadImage("assets/emptyhand_snowball.png")
 }
 
-func teardown(oldContract, newContract *erc721.Erc721, season int) func(c echo.Context) error {
+func teardown(contracts *CitizenContracts, season int) func(c echo.Context) error {
 	return func(c echo.Context) error {
 		id, err := strconv.Atoi(c.Param("id"))
 		if err != nil {
 			return c.String(http.StatusBadRequest, err.Error())
 		}
 
-		tokenUri, err := newContract.TokenURI(nil, big.NewInt(int64(id)))
+		tokenUri, _, err := contracts.TokenURI(&bind.CallOpts{Context: c.Request().Context()}, big.NewInt(int64(id)))
 
 		if err != nil {
-			tokenUri, err = oldContract.TokenURI(nil, big.NewInt(int64(id)))
-
-			if err != nil {
-				return c.String(http.StatusNotFound, err.Error())
-			}
+			return c.String(chainStatus(err, http.StatusNotFound), err.Error())
 		}
 
-		rawJson, _ := base64.StdEncoding.DecodeString(strings.Split(tokenUri, ",")[1])
+		_, imgs, err := decodeCitizen(tokenUri)
 
-		rawJson = []byte(descriptionRegex.ReplaceAllString(string(rawJson), ""))
-
-		var decodedJson map[string]json.RawMessage
-
-		if err := json.Unmarshal(rawJson, &decodedJson); err != nil {
+		if err != nil {
 			return c.String(http.StatusBadRequest, err.Error())
 		}
 
-		xml, _ := base64.StdEncoding.DecodeString(strings.Split(string(decodedJson["image_data"]), ",")[1])
-
-		imgs, err := CollectImages(xml)
-
 		partToUrl := map[string]string{}
 
 		for _, img := range imgs {
@@ -112,9 +103,79 @@ func teardown(oldContract, newContract *erc721.Erc721, season int) func(c echo.C
 	}
 }
 
-func season(oldContract, newContract *erc721.Erc721, season int) func(c echo.Context) error {
+// metadata serves the decoded metadata of a citizen along with its layers
+// in draw order.
+func metadata(contracts *CitizenContracts, season int) func(c echo.Context) error {
 	return func(c echo.Context) error {
-		return generate(c, season, oldContract, newContract)
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+
+		tokenUri, v2, err := contracts.TokenURI(&bind.CallOpts{Context: c.Request().Context()}, big.NewInt(int64(id)))
+
+		if err != nil {
+			return c.String(chainStatus(err, http.StatusNotFound), err.Error())
+		}
+
+		metadata, imgs, err := decodeCitizen(tokenUri)
+
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+
+		// the image_data SVG is the citizen itself, base64 encoded and
+		// far larger than the rest; it is served rendered instead
+		metadata.ImageData = ""
+
+		layers := make([]LayerInfo, 0, len(imgs))
+
+		for _, img := range imgs {
+			layers = append(layers, describeLayer(img.Href, season))
+		}
+
+		contract := contracts.OldAddress
+		if v2 {
+			contract = contracts.NewAddress
+		}
+
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"season":   season,
+			"id":       id,
+			"contract": contract,
+			"v2":       v2,
+			"metadata": metadata,
+			"layers":   layers,
+		})
+	}
+}
+
+func season(contracts *CitizenContracts, season int) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		return generate(c, season, contracts)
+	}
+}
+
+func stats(rpcBackend *MultiBackend) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		stats := map[string]interface{}{
+			"layers":   layers.Stats(),
+			"gateways": gateways.Stats(),
+		}
+
+		if rpcBackend != nil {
+			stats["rpc"] = rpcBackend.Stats()
+		}
+
+		if indexer != nil {
+			stats["indexer"] = indexer.Stats()
+		}
+
+		if chrome := chromeRendererOf(partRenderer); chrome != nil {
+			stats["chrome"] = chrome.Stats()
+		}
+
+		return c.JSON(http.StatusOK, stats)
 	}
 }
 
@@ -139,13 +200,70 @@ func upscale(c echo.Context) error {
 		return c.String(http.StatusBadRequest, err.Error())
 	}
 
-	img, _, err := image.Decode(c.Request().Body)
+	enc, err := NegotiateEncoding(c, false)
 
 	if err != nil {
-		return nil
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	body, err := io.ReadAll(c.Request().Body)
+
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	key := enc.Key(fmt.Sprintf("upscale/%s/%dx%d", sha256Hex(body), width, height))
+
+	if ok, err := serveCached(c, key); ok || err != nil {
+		return err
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(body))
+
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	return storeAndServe(c, key, imaging.Resize(img, width, height, imaging.NearestNeighbor), enc, nil)
+}
+
+// serveCached writes the cached entry for key to the response and reports
+// whether one was found. Cache failures are logged and treated as a miss so
+// a broken backend degrades to re-rendering rather than erroring.
+func serveCached(c echo.Context, key string) (bool, error) {
+	data, entry, err := renderCache.Get(c.Request().Context(), key)
+
+	if err != nil {
+		if !errors.Is(err, ErrCacheMiss) {
+			c.Logger().Errorf("cache get %s: %v", key, err)
+		}
+		return false, nil
+	}
+
+	return true, c.Blob(http.StatusOK, entry.ContentType, data)
+}
+
+// storeAndServe encodes img with enc, stores it in the render cache under
+// key and writes it to the response. An empty key skips the cache.
+func storeAndServe(c echo.Context, key string, img image.Image, enc Encoding, metadata map[string]string) error {
+	var buf bytes.Buffer
+
+	if err := enc.Encode(&buf, img); err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+
+	return storeAndServeBlob(c, key, buf.Bytes(), CacheEntry{ContentType: enc.ContentType(), Metadata: metadata})
+}
+
+// storeAndServeBlob is storeAndServe for already encoded data.
+func storeAndServeBlob(c echo.Context, key string, data []byte, entry CacheEntry) error {
+	if key != "" {
+		if err := renderCache.Put(c.Request().Context(), key, data, entry); err != nil {
+			c.Logger().Errorf("cache put %s: %v", key, err)
+		}
 	}
 
-	return png.Encode(c.Response().Writer, imaging.Resize(img, width, height, imaging.NearestNeighbor))
+	return c.Blob(http.StatusOK, entry.ContentType, data)
 }
 
 func validateBGColor(bgColor string) (*color.RGBA, error) {
@@ -174,218 +292,504 @@ func validateBGColor(bgColor string) (*color.RGBA, error) {
 	return nil, errors.New("background color string is invalid hex")
 }
 
-func generate(c echo.Context, season int, oldContract, newContract *erc721.Erc721) error {
-	var pfp bool
-	var whArray []string
+// CitizenContract is what the handlers need from a citizen contract.
+type CitizenContract interface {
+	TokenURISource
+	OwnershipSource
+}
+
+// CitizenContracts are the original and V2 citizen contracts of a season.
+// Migrated citizens answer on the V2 contract, the rest on the original.
+type CitizenContracts struct {
+	Old, New               CitizenContract
+	OldAddress, NewAddress common.Address
+
+	// Batcher, when set, asks both contracts in a single Multicall3 call
+	// instead of one after the other.
+	Batcher *TokenURIBatcher
+
+	// Chain maps times to blocks for historical renders.
+	Chain HeaderReader
+
+	// Code finds the block the contracts were deployed in, see
+	// DeploymentBlock.
+	Code bind.ContractCaller
+
+	deployMu sync.Mutex
+	deployed *uint64
+}
+
+func NewCitizenContracts(backend bind.ContractBackend, oldAddress, newAddress common.Address, batcher *TokenURIBatcher) (*CitizenContracts, error) {
+	oldContract, err := erc721.NewErc721(oldAddress, backend)
 
-	path := c.Request().URL.Path
-	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
-		return c.String(http.StatusBadRequest, err.Error())
+		return nil, err
 	}
 
-	dimensions := c.Param("dimensions")
+	newContract, err := erc721.NewErc721(newAddress, backend)
 
-	if strings.ToLower(dimensions) == "pfp" {
-		pfp = true
-		whArray = []string{"1200", "1200"}
-	} else {
-		whArray = strings.Split(dimensions, "x")
+	if err != nil {
+		return nil, err
+	}
 
-		if len(whArray) != 2 {
-			return c.String(http.StatusBadRequest, "invalid length")
+	return &CitizenContracts{
+		Old:        oldContract,
+		New:        newContract,
+		OldAddress: oldAddress,
+		NewAddress: newAddress,
+		Batcher:    batcher,
+		Chain:      NewHeaderCache(backend, 4096),
+		Code:       backend,
+	}, nil
+}
+
+// TokenURI resolves id on the V2 contract, falling back to the original
+// one, and reports whether the V2 contract answered.
+func (c *CitizenContracts) TokenURI(opts *bind.CallOpts, id *big.Int) (string, bool, error) {
+	if c.Batcher == nil {
+		tokenUri, err := c.New.TokenURI(opts, id)
+
+		if err == nil {
+			return tokenUri, true, nil
 		}
+
+		// only a citizen missing from V2 is served by the original
+		// contract, not one the node failed to answer for
+		if IsTransient(err) {
+			return "", false, err
+		}
+
+		tokenUri, err = c.Old.TokenURI(opts, id)
+		return tokenUri, false, err
 	}
-	noBg := c.QueryParam("no-bg") != ""
-	santaHat := c.QueryParam("santa-hat") != ""
-	snowball := c.QueryParam("snowball") != ""
-	female := c.QueryParam("female") != ""
-	noClothes := c.QueryParam("no-clothes") != ""
-	bgColorHex := c.QueryParam("bg-color")
-	preview := c.QueryParam("crop_preview") != ""
-	var backgroundColor *color.RGBA
-
-	if preview {
-		// Crop preview is a special flag that will generate 640x640 PFP cropped image
-		path += "_crop_preview"
-	} else {
-		if bgColorHex != "" {
 
-			parsedColor, err := validateBGColor(bgColorHex)
+	var ctx context.Context
+	var block *big.Int
 
-			if err != nil {
-				return c.String(http.StatusBadRequest, err.Error())
+	if opts != nil {
+		ctx, block = opts.Context, opts.BlockNumber
+	}
+
+	results, err := c.Batcher.TokenURIs(ctx, []TokenURICall{
+		{Contract: c.NewAddress, ID: id},
+		{Contract: c.OldAddress, ID: id},
+	}, block)
+
+	if err != nil {
+		return "", false, err
+	}
+
+	if results[0].Err == nil {
+		return results[0].URI, true, nil
+	}
+
+	return results[1].URI, false, results[1].Err
+}
+
+// TokenURIs resolves many ids like TokenURI, in as few calls as the
+// batcher allows. Per id failures end up in the results.
+func (c *CitizenContracts) TokenURIs(ctx context.Context, ids []*big.Int) ([]TokenURIResult, error) {
+	results := make([]TokenURIResult, len(ids))
+
+	if c.Batcher == nil {
+		for i, id := range ids {
+			uri, _, err := c.TokenURI(&bind.CallOpts{Context: ctx}, id)
+
+			if IsTransient(err) {
+				return nil, err
 			}
 
-			backgroundColor = parsedColor
+			results[i] = TokenURIResult{URI: uri, Err: err}
+		}
+		return results, nil
+	}
+
+	calls := make([]TokenURICall, 0, 2*len(ids))
+	for _, id := range ids {
+		calls = append(calls, TokenURICall{Contract: c.NewAddress, ID: id}, TokenURICall{Contract: c.OldAddress, ID: id})
+	}
+
+	both, err := c.Batcher.TokenURIs(ctx, calls, nil)
 
-			path += "_bg_color_" + bgColorHex
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range ids {
+		if results[i] = both[2*i]; results[i].Err != nil {
+			results[i] = both[2*i+1]
 		}
+	}
+	return results, nil
+}
+
+// renderRequest is the body accepted by POST /render. Size is either "WxH"
+// or "pfp" and, when present, replaces width and height.
+type renderRequest struct {
+	RenderSpec
+	Size string `json:"size"`
+	// At is a time, unix seconds or RFC 3339, to render the citizen as of.
+	At string `json:"at"`
+}
+
+func render(citizens map[int]*CitizenContracts) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		var req renderRequest
 
-		if pfp {
-			path += "_pfp_crop"
+		decoder := json.NewDecoder(c.Request().Body)
+		decoder.DisallowUnknownFields()
+
+		if err := decoder.Decode(&req); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+
+		spec := &req.RenderSpec
+
+		if req.Size != "" {
+			if err := spec.setDimensions(req.Size); err != nil {
+				return c.String(http.StatusBadRequest, err.Error())
+			}
+		}
+
+		if err := spec.Validate(); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+
+		contracts, ok := citizens[spec.Season]
+
+		if !ok {
+			return c.String(http.StatusBadRequest, "unknown season")
 		}
 
-		if noBg {
-			path += "_no_bg" // build on to the paths based on the passed in parameters
+		if err := resolveAt(c.Request().Context(), spec, contracts, req.At); err != nil {
+			return c.String(statusOf(err), err.Error())
 		}
+
+		return renderCitizen(c, spec, contracts)
+	}
+}
+
+func generate(c echo.Context, season int, contracts *CitizenContracts) error {
+	spec, err := ParseRenderSpec(c, season)
+
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
 	}
 
-	if santaHat {
-		path += "_santa"
+	if err := resolveAt(c.Request().Context(), spec, contracts, c.QueryParam("at")); err != nil {
+		return c.String(statusOf(err), err.Error())
 	}
 
-	if snowball {
-		path += "_snowball"
+	return renderCitizen(c, spec, contracts)
+}
+
+// resolveAt pins spec to the block mined at the time at, if set.
+func resolveAt(ctx context.Context, spec *RenderSpec, contracts *CitizenContracts, at string) error {
+	if at == "" {
+		return nil
 	}
 
-	// a citizen that was forced to be rendered using female traits
-	if female {
-		path += "_female"
+	if spec.Block != 0 {
+		return &statusError{http.StatusBadRequest, errors.New("block and at are mutually exclusive")}
 	}
 
-	if noClothes {
-		path += "_nc"
+	t, err := parseTime(at)
+
+	if err != nil {
+		return &statusError{http.StatusBadRequest, err}
 	}
 
-	seasonString := fmt.Sprintf("s%d", season)
+	if spec.Block, err = BlockAt(ctx, contracts.Chain, t); err != nil {
+		return &statusError{chainStatus(err, http.StatusBadRequest), err}
+	}
+	return nil
+}
 
-	if _, err := os.Stat(fmt.Sprintf("./images/%s.png", path)); err == nil {
+// renderCitizen renders the citizen described by spec, serving it from the
+// render cache when possible.
+func renderCitizen(c echo.Context, spec *RenderSpec, contracts *CitizenContracts) error {
+	cacheKey := spec.CacheKey()
 
-		file, _ := os.Open(fmt.Sprintf("./images/%s.png", path))
-		b, _ := ioutil.ReadAll(file)
-		_, err := c.Response().Writer.Write(b)
+	if ok, err := serveCached(c, cacheKey); ok || err != nil {
 		return err
 	}
 
-	width, err := strconv.Atoi(whArray[0])
+	ctx := c.Request().Context()
+	citizen := citizenImage
 
-	if err != nil {
-		return c.String(http.StatusBadRequest, err.Error())
+	if spec.Format == FormatSVG {
+		citizen = citizenSVG
 	}
 
-	height, err := strconv.Atoi(whArray[1])
+	render, err := citizen(ctx, spec, contracts)
 
 	if err != nil {
-		return c.String(http.StatusBadRequest, err.Error())
+		return c.String(statusOf(err), err.Error())
 	}
 
-	tokenUri, err := newContract.TokenURI(nil, big.NewInt(int64(id)))
+	// the client went away, don't cache a render with missing layers
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-	if err != nil {
-		tokenUri, err = oldContract.TokenURI(nil, big.NewInt(int64(id)))
+	if render.Missing != nil {
+		// still answer with what we have, but don't cache an incomplete citizen
+		c.Logger().Warnf("render %s: missing layers: %v", cacheKey, render.Missing)
+		cacheKey = ""
+	}
 
-		if err != nil {
-			return c.String(http.StatusBadRequest, err.Error())
-		}
+	if render.SVG != nil {
+		return storeAndServeBlob(c, cacheKey, render.SVG, CacheEntry{
+			ContentType: spec.Encoding().ContentType(),
+			Metadata:    render.Metadata(spec),
+		})
 	}
 
-	rawJson, _ := base64.StdEncoding.DecodeString(strings.Split(tokenUri, ",")[1])
+	return storeAndServe(c, cacheKey, render.Image, spec.Encoding(), render.Metadata(spec))
+}
+
+// statusError carries the HTTP status a failure should be answered with.
+type statusError struct {
+	Status int
+	Err    error
+}
 
-	rawJson = []byte(descriptionRegex.ReplaceAllString(string(rawJson), ""))
+func (e *statusError) Error() string { return e.Err.Error() }
 
-	var decodedJson map[string]json.RawMessage
+func (e *statusError) Unwrap() error { return e.Err }
 
-	if err := json.Unmarshal(rawJson, &decodedJson); err != nil {
-		return c.String(http.StatusBadRequest, err.Error())
+func statusOf(err error) int {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.Status
 	}
+	return http.StatusInternalServerError
+}
 
-	xml, _ := base64.StdEncoding.DecodeString(strings.Split(string(decodedJson["image_data"]), ",")[1])
+// CitizenRender is a rendered citizen. Missing is set when some layers
+// couldn't be fetched and the image was rendered without them. SVG renders
+// set SVG instead of Image.
+type CitizenRender struct {
+	Image    image.Image
+	SVG      []byte
+	TokenURI string
+	Missing  error
+}
 
-	imgs, err := CollectImages(xml)
+// Metadata is stored with cached renders. The tokenURI hash lets the
+// invalidator find renders made from metadata that has since changed;
+// renders pinned to a block never go stale.
+func (r *CitizenRender) Metadata(spec *RenderSpec) map[string]string {
+	metadata := map[string]string{
+		"season":           strconv.Itoa(spec.Season),
+		"token-id":         strconv.Itoa(spec.TokenID),
+		"token-uri-sha256": sha256Hex([]byte(r.TokenURI)),
+	}
+
+	if spec.Block != 0 {
+		metadata["block"] = strconv.FormatUint(spec.Block, 10)
+	}
+	return metadata
+}
+
+// citizenImage renders the citizen described by spec.
+func citizenImage(ctx context.Context, spec *RenderSpec, contracts *CitizenContracts) (*CitizenRender, error) {
+	tokenUri, _, err := contracts.TokenURI(spec.CallOpts(ctx), big.NewInt(int64(spec.TokenID)))
 
 	if err != nil {
-		return c.String(http.StatusBadRequest, err.Error())
+		return nil, &statusError{chainStatus(err, http.StatusBadRequest), err}
 	}
 
-	var fetchedImages []*FetchedImage
+	_, imgs, err := decodeCitizen(tokenUri)
+
+	if err == nil {
+		err = checkHiddenLayers(spec, imgs)
+	}
+
+	if err != nil {
+		return nil, &statusError{http.StatusBadRequest, err}
+	}
+
+	var layerUrls []string
 
 	for _, imgUrl := range imgs {
-		fetchUrl := imgUrl.Href
+		layerUrls = append(layerUrls, resolveLayerURL(imgUrl.Href, spec))
+	}
 
-		if female {
-			// force a replace to the female IPFS bucket
+	fetchedImages, missing := fetchLayers(ctx, layerUrls)
 
-			// highly experimental
-			fetchUrl = IPFSRegex.ReplaceAllString(fetchUrl, fmt.Sprintf("$1/%s/$3", IPFSBuckets[season].Female))
+	return &CitizenRender{
+		Image:    NewImageGenerator(spec, fetchedImages).Generate(),
+		TokenURI: tokenUri,
+		Missing:  missing,
+	}, nil
+}
 
-			if strings.Contains(fetchUrl, "body") || strings.Contains(fetchUrl, "hand") || strings.Contains(fetchUrl, "head") {
-				groups := IPFSRegex.FindAllStringSubmatch(fetchUrl, -1)
-				if strings.Contains(groups[0][3], "0.png") {
-					replaceString := "0-0.png"
+// citizenSVG reproduces the on-chain SVG of the citizen described by spec,
+// see CitizenSVG.
+func citizenSVG(ctx context.Context, spec *RenderSpec, contracts *CitizenContracts) (*CitizenRender, error) {
+	tokenUri, _, err := contracts.TokenURI(spec.CallOpts(ctx), big.NewInt(int64(spec.TokenID)))
 
-					if strings.Contains(fetchUrl, "hand") {
-						replaceString = "fist/" + replaceString
-					}
+	if err != nil {
+		return nil, &statusError{chainStatus(err, http.StatusBadRequest), err}
+	}
 
-					fetchUrl = strings.ReplaceAll(fetchUrl, groups[0][3], fmt.Sprintf("%s/%s", strings.Split(groups[0][3], "/")[0], replaceString))
-				}
-			}
-		}
+	metadata, imgs, err := decodeCitizen(tokenUri)
 
-		img, err := fetchImage(fetchUrl)
-		if err != nil {
-			continue
-		}
-		fetchedImages = append(fetchedImages, img)
+	if err == nil {
+		err = checkHiddenLayers(spec, imgs)
+	}
+
+	if err != nil {
+		return nil, &statusError{http.StatusBadRequest, err}
 	}
 
-	imgGen := NewImageGenerator(width, height, fetchedImages)
+	// decodeCitizen already checked it decodes
+	svg, _ := DecodeData(string(metadata.ImageData))
 
-	imgGen.Preview = preview
-	imgGen.NoBackground = noBg
-	imgGen.SantaHat = santaHat
-	imgGen.Snowball = snowball
-	imgGen.SeasonNumber = season
-	imgGen.Female = female
-	imgGen.BackgroundColor = backgroundColor
-	imgGen.NoClothes = noClothes
+	return &CitizenRender{
+		SVG:      CitizenSVG(svg.Raw, spec),
+		TokenURI: tokenUri,
+	}, nil
+}
 
-	imgGen.PFP = pfp
+// decodeCitizen decodes a citizen tokenURI into its metadata and the
+// layers of its SVG.
+func decodeCitizen(tokenUri string) (*Metadata, []XMLImage, error) {
+	metadata, err := DecodeTokenURI(tokenUri)
 
-	finalImage := imgGen.Generate()
+	if err != nil {
+		return nil, nil, err
+	}
 
-	os.Mkdir(filepath.Join("images", seasonString), os.ModePerm)
-	os.Mkdir(filepath.Join("images", seasonString, dimensions), os.ModePerm)
+	// the layers are only known for inline SVGs
+	svg, err := DecodeData(string(metadata.ImageData))
 
-	f, _ := os.Create(fmt.Sprintf("images/%s.png", path[1:]))
+	if err != nil {
+		return nil, nil, fmt.Errorf("image_data: %w", err)
+	}
 
-	png.Encode(f, finalImage)
+	imgs, err := CollectImages(svg.Raw)
 
-	return png.Encode(c.Response().Writer, finalImage)
+	return metadata, imgs, err
 }
 
 func main() {
-	client, err := ethclient.Dial(os.Getenv("RPC"))
+	command := "serve"
+
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+
+	switch command {
+	case "serve":
+		serve()
+	case "mirror":
+		runMirror(os.Args[2:])
+	case "export-metadata":
+		runExportMetadata(os.Args[2:])
+	default:
+		log.Fatalf("unknown command %q, expected serve, mirror or export-metadata", command)
+	}
+}
+
+func serve() {
+	var err error
+
+	renderCache, err = NewCacheFromEnv()
 
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	s1contract, err := erc721.NewErc721(common.HexToAddress(os.Getenv("S1_CONTRACT")), client)
+	layerDir, ok := os.LookupEnv("LAYER_CACHE_DIR")
+
+	if !ok {
+		layerDir = "layers"
+	}
+
+	gateways = NewGatewayPoolFromEnv()
+
+	MirrorDir = os.Getenv("MIRROR_DIR")
+
+	partRenderer, err = NewPartRendererFromEnv()
 
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	s2contract, err := erc721.NewErc721(common.HexToAddress(os.Getenv("S2_CONTRACT")), client)
+	presets, err = LoadPresets(envString("PRESETS_FILE", "assets/presets.json"))
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	var client bind.ContractBackend
+	var rpcBackend *MultiBackend
+
+	if snapshot := os.Getenv("SNAPSHOT"); snapshot != "" {
+		// offline: tokenURIs come from the snapshot and layers from the
+		// mirror, gateways are only used when explicitly configured
+		client, err = LoadSnapshot(snapshot)
+
+		if os.Getenv("IPFS_GATEWAYS") == "" {
+			gateways = NewGatewayPool(nil)
+		}
+	} else {
+		rpcBackend, err = NewMultiBackendFromEnv()
+		client = rpcBackend
+	}
 
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	s1v2contract, err := erc721.NewErc721(common.HexToAddress(os.Getenv("S1V2_CONTRACT")), client)
+	layers = NewLayerCache(int64(envCount("LAYER_CACHE_BYTES", 256<<20)), layerDir)
+
+	var batcher *TokenURIBatcher
+
+	if rpcBackend != nil && os.Getenv("MULTICALL") != "false" {
+		batcher = NewTokenURIBatcher(rpcBackend)
+
+		if addr := os.Getenv("MULTICALL_ADDRESS"); addr != "" {
+			batcher.Address = common.HexToAddress(addr)
+		}
+	}
+
+	s1, err := NewCitizenContracts(client, common.HexToAddress(os.Getenv("S1_CONTRACT")), common.HexToAddress(os.Getenv("S1V2_CONTRACT")), batcher)
 
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	s2v2contract, err := erc721.NewErc721(common.HexToAddress(os.Getenv("S2V2_CONTRACT")), client)
+	s2, err := NewCitizenContracts(client, common.HexToAddress(os.Getenv("S2_CONTRACT")), common.HexToAddress(os.Getenv("S2V2_CONTRACT")), batcher)
 
 	if err != nil {
 		log.Fatalln(err)
 	}
 
+	citizens := map[int]*CitizenContracts{1: s1, 2: s2}
+
+	if os.Getenv("INDEXER_DB") != "" && rpcBackend != nil {
+		indexer, err = NewIndexerFromEnv(rpcBackend)
+
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		go indexer.Run(context.Background())
+	}
+
+	invalidator := NewInvalidator(renderCache, citizens)
+	invalidator.Interval = envDuration("INVALIDATE_INTERVAL", invalidator.Interval)
+
+	// a snapshot never changes, there is nothing to invalidate
+	if rpcBackend != nil && os.Getenv("INVALIDATE_INTERVAL") != "0" {
+		go invalidator.Run(context.Background())
+	}
+
+	HistorySamples = envInt("HISTORY_SAMPLES", HistorySamples)
+
 	e := echo.New() // create our new echo handler
 
 	e.Use(middleware.CORS())
@@ -394,11 +798,35 @@ func main() {
 		return c.String(http.StatusOK, "OK")
 	})
 
-	e.GET("/s1/:dimensions/:id", season(s1contract, s1v2contract, 1))
-	e.GET("/s2/:dimensions/:id", season(s2contract, s2v2contract, 2))
+	e.GET("/stats", stats(rpcBackend))
+
+	e.GET("/s1/:dimensions/:id", season(s1, 1))
+	e.GET("/s2/:dimensions/:id", season(s2, 2))
+
+	e.GET("/s1/:id/teardown", teardown(s1, 1))
+	e.GET("/s2/:id/teardown", teardown(s2, 2))
+
+	e.GET("/s1/:id/metadata", metadata(s1, 1))
+	e.GET("/s2/:id/metadata", metadata(s2, 2))
 
-	e.GET("/s1/:id/teardown", teardown(s1contract, s1v2contract, 1))
-	e.GET("/s2/:id/teardown", teardown(s2contract, s2v2contract, 2))
+	e.GET("/s1/:id/history", history(s1, 1))
+	e.GET("/s2/:id/history", history(s2, 2))
+
+	e.GET("/s1/:id/history/compare", compare(s1, 1))
+	e.GET("/s2/:id/history/compare", compare(s2, 2))
+
+	e.GET("/s1/:id/owner", owner(s1, 1))
+	e.GET("/s2/:id/owner", owner(s2, 2))
+
+	e.GET("/s1/supply", supply(s1, 1))
+	e.GET("/s2/supply", supply(s2, 2))
+
+	e.GET("/invalidations", invalidations(invalidator))
+
+	e.GET("/presets", listPresets)
+
+	e.GET("/wallet/:address", wallet(citizens, client))
+	e.GET("/wallet/:address/collage", collage(citizens, client))
 
 	e.GET("/s1/parts/:part/:id", part(1, false, client))
 	e.GET("/s1/parts/:part/:id/render", part(1, true, client))
@@ -406,6 +834,8 @@ func main() {
 	e.GET("/s2/parts/:part/:id", part(2, false, client))
 	e.GET("/s2/parts/:part/:id/render", part(2, true, client))
 
+	e.POST("/render", render(citizens))
+
 	e.POST("/upscale", upscale)
 	if os.Getenv("CERT") != "" && os.Getenv("KEY") != "" {
 		log.Fatalln(e.StartTLS(os.Getenv("HOST"), os.Getenv("CERT"), os.Getenv("KEY")))
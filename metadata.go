@@ -1,65 +1,322 @@
 package main
 
 import (
+	"context"
 	"encoding/base32"
-	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
 	"net/url"
+	"path"
+	"strconv"
 	"strings"
 )
 
 type Data struct {
 	Raw         []byte
 	ContentType string
+	// Charset is the charset parameter of the media type, if any.
+	Charset string
 }
 
-func DecodeData(uri *url.URL) (*Data, error) {
-	split := strings.Split(uri.Opaque, ";")
-	dataType := split[0]
-	dataParts := strings.Split(split[1], ",")
-	var rawData []byte
+// MIMEType returns the content type including the charset.
+func (d *Data) MIMEType() string {
+	if d.Charset == "" {
+		return d.ContentType
+	}
+	return d.ContentType + "; charset=" + d.Charset
+}
+
+var (
+	// ErrInvalidDataURI is returned for data URIs that don't follow RFC 2397.
+	ErrInvalidDataURI = errors.New("invalid data URI")
+	// ErrUnsupportedEncoding is returned for data URIs with an encoding
+	// other than base64 or base32.
+	ErrUnsupportedEncoding = errors.New("unsupported data URI encoding")
+	// ErrUnsupportedResource is returned for resources that are neither
+	// data URIs nor http(s) or ipfs URLs.
+	ErrUnsupportedResource = errors.New("unsupported resource")
+	// ErrEmptyResource is returned for resources that are missing from the
+	// metadata.
+	ErrEmptyResource = errors.New("empty resource")
+)
+
+// ResourceError is returned when a resource can't be decoded or fetched.
+type ResourceError struct {
+	Resource string
+	Err      error
+}
+
+func (e *ResourceError) Error() string {
+	resource := e.Resource
+	if resource == "" {
+		return e.Err.Error()
+	}
+	if len(resource) > 64 {
+		resource = resource[:64] + "..."
+	}
+	return fmt.Sprintf("%s: %v", resource, e.Err)
+}
+
+func (e *ResourceError) Unwrap() error {
+	return e.Err
+}
+
+// DecodeData decodes an RFC 2397 data URI:
+//
+//	data:[<mediatype>][;<param>=<value>]*[;base64],<data>
+//
+// The media type defaults to text/plain;charset=US-ASCII. Payloads that
+// aren't base64 (or base32, which some contracts use) are percent-decoded.
+func DecodeData(uri string) (*Data, error) {
+	if len(uri) < 5 || !strings.EqualFold(uri[:5], "data:") {
+		return nil, &ResourceError{uri, fmt.Errorf("%w: missing data: scheme", ErrInvalidDataURI)}
+	}
+
+	header, payload, ok := strings.Cut(uri[5:], ",")
+
+	if !ok {
+		return nil, &ResourceError{uri, fmt.Errorf("%w: missing comma", ErrInvalidDataURI)}
+	}
+
+	params := strings.Split(header, ";")
+	data := &Data{ContentType: strings.ToLower(strings.TrimSpace(params[0]))}
+	encoding := ""
+
+	for i, param := range params[1:] {
+		key, value, hasValue := strings.Cut(strings.TrimSpace(param), "=")
+		key = strings.ToLower(key)
+
+		switch {
+		case !hasValue && i == len(params)-2:
+			encoding = key
+		case !hasValue:
+			// utf8 is a common misspelling of charset=utf-8
+			if key == "utf8" || key == "utf-8" {
+				data.Charset = "utf-8"
+				continue
+			}
+			return nil, &ResourceError{uri, fmt.Errorf("%w: parameter %q without a value", ErrInvalidDataURI, key)}
+		case key == "charset":
+			data.Charset = strings.ToLower(strings.Trim(value, `"`))
+		}
+	}
+
+	if encoding == "utf8" || encoding == "utf-8" {
+		data.Charset = "utf-8"
+		encoding = ""
+	}
+
+	if data.ContentType == "" {
+		data.ContentType = "text/plain"
+		if data.Charset == "" {
+			data.Charset = "us-ascii"
+		}
+	}
+
 	var err error
 
-	switch dataParts[0] {
+	switch encoding {
+	case "":
+		data.Raw = percentDecode(payload)
 	case "base64":
-		rawData, err = base64.StdEncoding.DecodeString(dataParts[1])
+		if data.Raw, err = decodeBase64(payload); err != nil {
+			return nil, &ResourceError{uri, fmt.Errorf("%w: %v", ErrInvalidDataURI, err)}
+		}
 	case "base32":
-		rawData, err = base32.StdEncoding.DecodeString(dataParts[1])
+		if data.Raw, err = base32.StdEncoding.DecodeString(payload); err != nil {
+			return nil, &ResourceError{uri, fmt.Errorf("%w: %v", ErrInvalidDataURI, err)}
+		}
+	default:
+		return nil, &ResourceError{uri, fmt.Errorf("%w %q", ErrUnsupportedEncoding, encoding)}
 	}
 
-	return &Data{
-		ContentType: dataType,
-		Raw:         rawData,
-	}, err
+	return data, nil
+}
+
+// percentDecode decodes %XX escapes, leaving everything else as is. A '%'
+// not starting an escape is kept too: inline SVGs are often not encoded at
+// all and use it in lengths.
+func percentDecode(s string) []byte {
+	out := make([]byte, 0, len(s))
+
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]) {
+			out = append(out, unhex(s[i+1])<<4|unhex(s[i+2]))
+			i += 2
+			continue
+		}
+		out = append(out, s[i])
+	}
+
+	return out
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c <= '9':
+		return c - '0'
+	case c <= 'F':
+		return c - 'A' + 10
+	}
+	return c - 'a' + 10
 }
 
 type Resource string
 
-func (r Resource) Decode() (*Data, error) {
-	url, err := url.Parse(string(r))
+// Decode returns the content of the resource: the payload of data URIs
+// and the downloaded file for http(s) and ipfs URLs, the latter going
+// through the mirror and the gateway pool.
+func (r Resource) Decode(ctx context.Context) (*Data, error) {
+	uri := strings.TrimSpace(string(r))
+
+	if uri == "" {
+		return nil, &ResourceError{uri, ErrEmptyResource}
+	}
+
+	scheme, rest, ok := strings.Cut(uri, ":")
+
+	if !ok {
+		return nil, &ResourceError{uri, ErrUnsupportedResource}
+	}
+
+	var (
+		raw []byte
+		err error
+	)
+
+	switch strings.ToLower(scheme) {
+	case "data":
+		return DecodeData(uri)
+	case "ipfs":
+		cid, file, _ := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(rest, "//"), "ipfs/"), "/")
+
+		if data, ok := readMirror(cid, file); ok {
+			raw = data
+		} else {
+			raw, err = gateways.Fetch(ctx, cid, file)
+		}
+	case "http", "https":
+		raw, err = fetchRaw(ctx, uri)
+	default:
+		return nil, &ResourceError{uri, fmt.Errorf("%w: scheme %q", ErrUnsupportedResource, scheme)}
+	}
 
 	if err != nil {
-		return nil, err
+		return nil, &ResourceError{uri, err}
 	}
 
-	if url.Scheme == "data" {
-		return DecodeData(url)
+	return &Data{Raw: raw, ContentType: sniffContentType(uri, raw)}, nil
+}
+
+// sniffContentType guesses the type of a downloaded resource from its
+// extension and, failing that, its content.
+func sniffContentType(uri string, raw []byte) string {
+	if u, err := url.Parse(uri); err == nil {
+		if contentType := mime.TypeByExtension(path.Ext(u.Path)); contentType != "" {
+			contentType, _, _ = mime.ParseMediaType(contentType)
+			return contentType
+		}
 	}
 
-	return nil, nil
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(raw))
+
+	// SVGs sniff as XML or text
+	if (contentType == "text/xml" || contentType == "text/plain") && strings.Contains(string(raw[:min(len(raw), 1024)]), "<svg") {
+		return "image/svg+xml"
+	}
+
+	return contentType
 }
 
+// Attribute is a trait of the metadata. Its value is a Number for numeric
+// traits, ones with a number value or a numeric display_type, and Text
+// for the rest.
 type Attribute struct {
-	TraitType string      `json:"trait_type"`
-	Value     interface{} `json:"value"`
+	TraitType   string
+	DisplayType string
+	Number      *float64
+	Text        string
+}
+
+// numericDisplayTypes are the OpenSea display types of numeric traits.
+var numericDisplayTypes = map[string]bool{
+	"number":           true,
+	"boost_number":     true,
+	"boost_percentage": true,
+	"date":             true,
+}
+
+type attributeJSON struct {
+	TraitType   string          `json:"trait_type"`
+	Value       json.RawMessage `json:"value"`
+	DisplayType string          `json:"display_type,omitempty"`
+}
+
+func (a *Attribute) UnmarshalJSON(b []byte) error {
+	var raw attributeJSON
+
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	*a = Attribute{TraitType: raw.TraitType, DisplayType: raw.DisplayType}
+
+	var value interface{}
+
+	if len(raw.Value) > 0 {
+		if err := json.Unmarshal(raw.Value, &value); err != nil {
+			return err
+		}
+	}
+
+	switch v := value.(type) {
+	case nil:
+	case float64:
+		a.Number = &v
+	case string:
+		a.Text = v
+
+		// numbers quoted by hand built metadata
+		if numericDisplayTypes[a.DisplayType] {
+			if number, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				a.Number, a.Text = &number, ""
+			}
+		}
+	default:
+		a.Text = string(raw.Value)
+	}
+	return nil
 }
+
+func (a Attribute) MarshalJSON() ([]byte, error) {
+	var value interface{} = a.Text
+
+	if a.Number != nil {
+		value = *a.Number
+	}
+
+	raw, err := json.Marshal(value)
+
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(attributeJSON{a.TraitType, raw, a.DisplayType})
+}
+
 type Metadata struct {
 	Name        string      `json:"name"`
 	Description string      `json:"description"`
 	Attributes  []Attribute `json:"attributes"`
 
 	Image        Resource `json:"image"`
-	ImageData    Resource `json:"image_data"`
+	ImageData    Resource `json:"image_data,omitempty"`
 	AnimationURL Resource `json:"animation_url"`
 }
 
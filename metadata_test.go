@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestAttributeJSON(t *testing.T) {
+	tests := []struct {
+		in      string
+		numeric bool
+		number  float64
+		text    string
+		out     string
+	}{
+		{`{"trait_type":"Class","value":"Hacker"}`, false, 0, "Hacker", `{"trait_type":"Class","value":"Hacker"}`},
+		{`{"trait_type":"Level","value":3}`, true, 3, "", `{"trait_type":"Level","value":3}`},
+		{`{"trait_type":"Strength","value":"12.5","display_type":"number"}`, true, 12.5, "", `{"trait_type":"Strength","value":12.5,"display_type":"number"}`},
+		{`{"trait_type":"Born","value":1640995200,"display_type":"date"}`, true, 1640995200, "", `{"trait_type":"Born","value":1640995200,"display_type":"date"}`},
+		{`{"trait_type":"Speed","value":"fast","display_type":"boost_number"}`, false, 0, "fast", `{"trait_type":"Speed","value":"fast","display_type":"boost_number"}`},
+		{`{"trait_type":"Code","value":"007"}`, false, 0, "007", `{"trait_type":"Code","value":"007"}`},
+		{`{"trait_type":"Rare","value":true}`, false, 0, "true", `{"trait_type":"Rare","value":"true"}`},
+		{`{"trait_type":"Empty"}`, false, 0, "", `{"trait_type":"Empty","value":""}`},
+	}
+
+	for _, test := range tests {
+		var attribute Attribute
+
+		if err := json.Unmarshal([]byte(test.in), &attribute); err != nil {
+			t.Fatalf("%s: %v", test.in, err)
+		}
+
+		if got := attribute.Number; (got != nil) != test.numeric || got != nil && *got != test.number {
+			t.Errorf("%s: got number %v, want %v", test.in, got, test.number)
+		}
+
+		if attribute.Text != test.text {
+			t.Errorf("%s: got text %q, want %q", test.in, attribute.Text, test.text)
+		}
+
+		out, err := json.Marshal(attribute)
+
+		if err != nil || string(out) != test.out {
+			t.Errorf("%s: marshaled to %s %v, want %s", test.in, out, err, test.out)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MirrorDir, when set, is a local copy of the trait buckets laid out as
+// <CID>/<path> (see the mirror command). Layers are read from it before
+// any gateway is asked.
+var MirrorDir string
+
+// readMirror returns the mirrored copy of <cid>/<path>, if any.
+func readMirror(cid, path string) ([]byte, bool) {
+	if MirrorDir == "" {
+		return nil, false
+	}
+
+	key, err := cleanKey(cid + "/" + path)
+	if err != nil {
+		return nil, false
+	}
+
+	data, err := os.ReadFile(filepath.Join(MirrorDir, filepath.FromSlash(key)))
+	return data, err == nil
+}
+
+// runMirror implements the "mirror" command, which downloads every trait
+// layer of every season into a local directory.
+func runMirror(args []string) {
+	flags := flag.NewFlagSet("mirror", flag.ExitOnError)
+	dir := flags.String("dir", envString("MIRROR_DIR", "mirror"), "directory to mirror the trait buckets into")
+	workers := flags.Int("workers", FetchWorkers, "concurrent file downloads")
+	flags.Parse(args)
+
+	gateways = NewGatewayPoolFromEnv()
+
+	mirror := &Mirror{Dir: *dir, Pool: gateways, Workers: *workers}
+
+	var roots []string
+	seen := map[string]bool{}
+	for _, bucket := range IPFSBuckets {
+		for _, cid := range []string{bucket.Male, bucket.Female} {
+			if !seen[cid] {
+				seen[cid] = true
+				roots = append(roots, cid)
+			}
+		}
+	}
+	sort.Strings(roots)
+
+	for _, root := range roots {
+		log.Printf("mirroring %s into %s", root, *dir)
+
+		stats, err := mirror.Sync(context.Background(), root)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		log.Printf("mirrored %s: %d downloaded, %d already present", root, stats.Downloaded, stats.Skipped)
+	}
+}
+
+// Mirror copies UnixFS directories from IPFS to Dir/<CID>/<path>. Every
+// block is fetched as a CAR and verified against its CID. Completed files
+// are recorded in a journal next to the tree, which makes an interrupted
+// sync resumable and lets existing files be checked for corruption.
+type Mirror struct {
+	Dir     string
+	Pool    *GatewayPool
+	Workers int
+}
+
+// MirrorStats counts the files handled by a sync.
+type MirrorStats struct {
+	Downloaded, Skipped int
+}
+
+type mirrorJournalEntry struct {
+	Path   string `json:"path"`
+	CID    string `json:"cid"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Sync mirrors the directory tree rooted at root.
+func (m *Mirror) Sync(ctx context.Context, root string) (*MirrorStats, error) {
+	rootCID, err := ParseCID(root)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Join(m.Dir, root), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	journalPath := filepath.Join(m.Dir, root+".journal")
+	done, err := readMirrorJournal(journalPath)
+	if err != nil {
+		return nil, err
+	}
+
+	journal, err := os.OpenFile(journalPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	defer journal.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		stats    MirrorStats
+		mu       sync.Mutex
+		firstErr error
+		wg       sync.WaitGroup
+		sem      = make(chan struct{}, max(m.Workers, 1))
+	)
+
+	var visit func(cid CID, path string)
+	visit = func(cid CID, path string) {
+		defer wg.Done()
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+
+		children, entry, err := m.visit(ctx, root, cid, path, done[path])
+		<-sem
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch {
+		case err != nil:
+			if firstErr == nil {
+				firstErr = fmt.Errorf("mirror %s/%s: %w", root, path, err)
+				cancel()
+			}
+		case children != nil:
+			for _, link := range children {
+				wg.Add(1)
+				go visit(link.CID, strings.TrimPrefix(path+"/"+link.Name, "/"))
+			}
+		case entry == done[path]:
+			stats.Skipped++
+		default:
+			stats.Downloaded++
+			line, _ := json.Marshal(entry)
+			journal.Write(append(line, '\n'))
+		}
+	}
+
+	wg.Add(1)
+	visit(rootCID, "")
+	wg.Wait()
+
+	return &stats, firstErr
+}
+
+// visit handles one entry of the tree: directories return their children,
+// files are written to disk unless the journal shows they already are.
+func (m *Mirror) visit(ctx context.Context, root string, cid CID, path string, previous *mirrorJournalEntry) ([]PBLink, *mirrorJournalEntry, error) {
+	target := filepath.Join(m.Dir, root, filepath.FromSlash(path))
+
+	// resume: trust files recorded in the journal whose content still matches
+	if previous != nil && previous.CID == cid.String() {
+		if data, err := os.ReadFile(target); err == nil && len(data) == previous.Size && sha256Hex(data) == previous.SHA256 {
+			return nil, previous, nil
+		}
+	}
+
+	store, err := m.fetch(ctx, cid)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if cid.Codec == codecDagPB {
+		node, err := store.node(cid)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if node.Type == unixfsDirectory || node.Type == unixfsHAMTShard {
+			children, err := store.listDirectory(node)
+			if children == nil && err == nil {
+				children = []PBLink{}
+			}
+			return children, nil, err
+		}
+	}
+
+	data, err := store.ReadFile(cid)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+		return nil, nil, err
+	}
+
+	if err := writeFileAtomic(target, data); err != nil {
+		return nil, nil, err
+	}
+
+	return nil, &mirrorJournalEntry{
+		Path:   path,
+		CID:    cid.String(),
+		Size:   len(data),
+		SHA256: sha256Hex(data),
+	}, nil
+}
+
+// maxMirrorCARBytes bounds the CAR of a whole trait directory.
+const maxMirrorCARBytes = 1 << 30
+
+// fetch downloads the whole entity (file or directory) at cid as a CAR and
+// verifies every block in it.
+func (m *Mirror) fetch(ctx context.Context, cid CID) (blockStore, error) {
+	var store blockStore
+
+	_, err := m.Pool.Do(ctx, func(ctx context.Context, gw *Gateway) ([]byte, error) {
+		car, err := download(ctx, layerClient, fmt.Sprintf("%s/%s?format=car&dag-scope=entity", gw.URL, cid), maxMirrorCARBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		blocks, err := ReadCAR(car)
+		if err != nil {
+			return nil, err
+		}
+
+		store = blocks
+		return car, nil
+	})
+
+	return store, err
+}
+
+// listDirectory returns the entries of a plain or HAMT sharded directory.
+func (s blockStore) listDirectory(node *PBNode) ([]PBLink, error) {
+	switch node.Type {
+	case unixfsDirectory:
+		return node.Links, nil
+	case unixfsHAMTShard:
+		prefixLen := len(fmt.Sprintf("%X", node.Fanout-1))
+
+		var entries []PBLink
+		for _, link := range node.Links {
+			if len(link.Name) > prefixLen {
+				link.Name = link.Name[prefixLen:]
+				entries = append(entries, link)
+				continue
+			}
+
+			child, err := s.node(link.CID)
+			if err != nil {
+				return nil, err
+			}
+
+			childEntries, err := s.listDirectory(child)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, childEntries...)
+		}
+		return entries, nil
+	}
+	return nil, errors.New("ipfs: not a directory")
+}
+
+func readMirrorJournal(path string) (map[string]*mirrorJournalEntry, error) {
+	entries := map[string]*mirrorJournalEntry{}
+
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return entries, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry mirrorJournalEntry
+		// a torn last line from an interrupted run is simply ignored
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err == nil {
+			entries[entry.Path] = &entry
+		}
+	}
+	return entries, scanner.Err()
+}
+
+func envString(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
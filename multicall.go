@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+
+	"github.com/NT-community/citizen-gen/erc721"
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Multicall3Address is where Multicall3 is deployed on mainnet and most
+// other chains.
+var Multicall3Address = common.HexToAddress("0xcA11bde05977b3631167028862bE2a173976CA11")
+
+const multicall3ABI = `[{"inputs":[{"components":[{"internalType":"address","name":"target","type":"address"},{"internalType":"bool","name":"allowFailure","type":"bool"},{"internalType":"bytes","name":"callData","type":"bytes"}],"internalType":"struct Multicall3.Call3[]","name":"calls","type":"tuple[]"}],"name":"aggregate3","outputs":[{"components":[{"internalType":"bool","name":"success","type":"bool"},{"internalType":"bytes","name":"returnData","type":"bytes"}],"internalType":"struct Multicall3.Result[]","name":"returnData","type":"tuple[]"}],"stateMutability":"payable","type":"function"}]`
+
+var (
+	multicallABI = mustParseABI(multicall3ABI)
+	erc721ABI    = mustParseABI(erc721.Erc721MetaData.ABI)
+)
+
+func mustParseABI(definition string) abi.ABI {
+	parsed, err := abi.JSON(strings.NewReader(definition))
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}
+
+// multicallCall and multicallResult mirror Multicall3.Call3 and
+// Multicall3.Result for ABI packing.
+type multicallCall struct {
+	Target       common.Address
+	AllowFailure bool
+	CallData     []byte
+}
+
+type multicallResult struct {
+	Success    bool
+	ReturnData []byte
+}
+
+// TokenURICall identifies a single tokenURI(id) call.
+type TokenURICall struct {
+	Contract common.Address
+	ID       *big.Int
+}
+
+// TokenURIResult is the outcome of a TokenURICall; Err is set when the
+// call reverted, e.g. because the token doesn't exist on that contract.
+type TokenURIResult struct {
+	URI string
+	Err error
+}
+
+// ErrCallFailed is the error of a TokenURIResult whose call reverted.
+var ErrCallFailed = errors.New("execution reverted")
+
+// TokenURIBatcher resolves many tokenURI calls, across any number of
+// contracts, with Multicall3's aggregate3 and allowFailure set, so one
+// eth_call answers up to MaxBatch of them. Backends without Multicall3
+// (such as the offline snapshot) are served with one call per token.
+//
+// Reverts, such as the tokenURI of a token that doesn't exist, are final.
+// Running out of gas isn't: batches that do are split, and sub-calls that
+// fail without revert data, starved by the ones before them, are made
+// again in another aggregate.
+type TokenURIBatcher struct {
+	Backend  bind.ContractCaller
+	Address  common.Address
+	MaxBatch int
+	Workers  int
+}
+
+func NewTokenURIBatcher(backend bind.ContractCaller) *TokenURIBatcher {
+	return &TokenURIBatcher{
+		Backend:  backend,
+		Address:  Multicall3Address,
+		MaxBatch: 50,
+		Workers:  4,
+	}
+}
+
+// TokenURIs resolves calls at the given block (nil for latest). The error
+// is only set when the calls couldn't be made at all; per call failures
+// end up in the results.
+func (b *TokenURIBatcher) TokenURIs(ctx context.Context, calls []TokenURICall, block *big.Int) ([]TokenURIResult, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	results := make([]TokenURIResult, len(calls))
+	chunks := make(chan int)
+	batchSize := max(b.MaxBatch, 1)
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+
+	for w := 0; w < max(b.Workers, 1); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for start := range chunks {
+				end := min(start+batchSize, len(calls))
+				if err := b.batch(ctx, calls[start:end], results[start:end], block); err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for start := 0; start < len(calls); start += batchSize {
+		chunks <- start
+	}
+	close(chunks)
+	wg.Wait()
+
+	return results, firstErr
+}
+
+func (b *TokenURIBatcher) batch(ctx context.Context, calls []TokenURICall, results []TokenURIResult, block *big.Int) error {
+	aggregate := make([]multicallCall, len(calls))
+	pending := make([]int, len(calls))
+
+	for i, call := range calls {
+		data, err := erc721ABI.Pack("tokenURI", call.ID)
+		if err != nil {
+			return err
+		}
+		aggregate[i] = multicallCall{call.Contract, true, data}
+		pending[i] = i
+	}
+
+	return b.resolve(ctx, aggregate, pending, results, block)
+}
+
+// resolve makes the pending calls of aggregate. A batch that runs out of
+// gas as a whole is split in two; sub-calls starved by the ones before them
+// are aggregated again for as long as that makes progress.
+func (b *TokenURIBatcher) resolve(ctx context.Context, aggregate []multicallCall, pending []int, results []TokenURIResult, block *big.Int) error {
+	for len(pending) > 0 {
+		subCalls := make([]multicallCall, len(pending))
+		for j, i := range pending {
+			subCalls[j] = aggregate[i]
+		}
+
+		returned, err := b.aggregate3(ctx, subCalls, block)
+
+		switch {
+		case isOutOfGas(err) && len(pending) > 1:
+			half := len(pending) / 2
+			if err := b.resolve(ctx, aggregate, pending[:half], results, block); err != nil {
+				return err
+			}
+			return b.resolve(ctx, aggregate, pending[half:], results, block)
+		case isOutOfGas(err):
+			results[pending[0]] = TokenURIResult{Err: ErrCallFailed}
+			return nil
+		case errors.Is(err, errNoMulticall):
+			return b.individually(ctx, aggregate, pending, results, block)
+		case err != nil:
+			return err
+		}
+
+		var starved []int
+
+		for j, result := range returned {
+			i := pending[j]
+			results[i] = decodeTokenURIResult(result.Success, result.ReturnData)
+
+			if !result.Success && len(result.ReturnData) == 0 {
+				starved = append(starved, i)
+			}
+		}
+
+		// nothing went through, so it wasn't for lack of gas
+		if len(starved) == len(pending) {
+			break
+		}
+		pending = starved
+	}
+	return nil
+}
+
+// isOutOfGas reports whether an eth_call ran out of gas as a whole.
+func isOutOfGas(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "out of gas")
+}
+
+// errNoMulticall is returned by aggregate3 on backends without Multicall3.
+var errNoMulticall = errors.New("multicall: no Multicall3")
+
+func (b *TokenURIBatcher) aggregate3(ctx context.Context, calls []multicallCall, block *big.Int) ([]multicallResult, error) {
+	input, err := multicallABI.Pack("aggregate3", calls)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := b.Backend.CallContract(ctx, ethereum.CallMsg{To: &b.Address, Data: input}, block)
+
+	if err != nil || len(output) == 0 {
+		if IsTransient(err) || isOutOfGas(err) {
+			return nil, err
+		}
+		return nil, errNoMulticall
+	}
+
+	unpacked, err := multicallABI.Unpack("aggregate3", output)
+	if err != nil {
+		return nil, err
+	}
+
+	returned := *abi.ConvertType(unpacked[0], new([]multicallResult)).(*[]multicallResult)
+	if len(returned) != len(calls) {
+		return nil, fmt.Errorf("multicall: %d results for %d calls", len(returned), len(calls))
+	}
+	return returned, nil
+}
+
+func (b *TokenURIBatcher) individually(ctx context.Context, calls []multicallCall, pending []int, results []TokenURIResult, block *big.Int) error {
+	for _, i := range pending {
+		output, err := b.Backend.CallContract(ctx, ethereum.CallMsg{To: &calls[i].Target, Data: calls[i].CallData}, block)
+
+		if IsTransient(err) {
+			return err
+		}
+
+		results[i] = decodeTokenURIResult(err == nil, output)
+	}
+	return nil
+}
+
+func decodeTokenURIResult(success bool, output []byte) TokenURIResult {
+	if !success || len(output) == 0 {
+		return TokenURIResult{Err: ErrCallFailed}
+	}
+
+	unpacked, err := erc721ABI.Unpack("tokenURI", output)
+	if err != nil {
+		return TokenURIResult{Err: err}
+	}
+	return TokenURIResult{URI: unpacked[0].(string)}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"sync"
+	"testing"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// tokenURICode answers tokenURI(id) for ids 1 to tokens with the id as a
+// 32 byte string, and reverts with a reason for any other id. Every fourth
+// token burns about 5M gas first, so a batch of 50 needs more than the 50M
+// an eth_call gets.
+func tokenURICode(tokens byte) []byte {
+	return []byte{
+		0x60, 0x04, 0x35, // PUSH1 4 CALLDATALOAD, the id
+		0x80, 0x15, 0x61, 0x00, 0x3c, 0x57, // DUP1 ISZERO PUSH2 revert JUMPI
+		0x80, 0x60, tokens, 0x10, 0x61, 0x00, 0x3c, 0x57, // DUP1 PUSH1 tokens LT PUSH2 revert JUMPI
+		0x80, 0x60, 0x04, 0x90, 0x06, 0x61, 0x00, 0x29, 0x57, // DUP1 PUSH1 4 SWAP1 MOD PUSH2 return JUMPI
+		0x62, 0x02, 0xee, 0x00, // PUSH3 192000
+		0x5b,                   // loop: JUMPDEST
+		0x60, 0x01, 0x90, 0x03, // PUSH1 1 SWAP1 SUB
+		0x80, 0x61, 0x00, 0x1e, 0x57, // DUP1 PUSH2 loop JUMPI
+		0x50,                         // POP
+		0x5b,                         // return: JUMPDEST
+		0x60, 0x20, 0x60, 0x00, 0x52, // PUSH1 32 PUSH1 0 MSTORE, the offset
+		0x60, 0x20, 0x60, 0x20, 0x52, // PUSH1 32 PUSH1 32 MSTORE, the length
+		0x60, 0x40, 0x52, // PUSH1 64 MSTORE, the id
+		0x60, 0x60, 0x60, 0x00, 0xf3, // PUSH1 96 PUSH1 0 RETURN
+		0x5b,                         // revert: JUMPDEST
+		0x63, 0x08, 0xc3, 0x79, 0xa0, // PUSH4 Error(string)
+		0x60, 0xe0, 0x1b, 0x60, 0x00, 0x52, // PUSH1 224 SHL PUSH1 0 MSTORE
+		0x60, 0x04, 0x60, 0x00, 0xfd, // PUSH1 4 PUSH1 0 REVERT
+	}
+}
+
+// tokenURIOf is what tokenURICode answers for id.
+func tokenURIOf(id int64) string {
+	return string(common.LeftPadBytes(big.NewInt(id).Bytes(), 32))
+}
+
+// countingCaller counts the eth_calls made to a simulated chain.
+type countingCaller struct {
+	*simulatedChain
+
+	mu         sync.Mutex
+	aggregates int
+	singles    int
+}
+
+func (c *countingCaller) CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	c.mu.Lock()
+	if *call.To == Multicall3Address {
+		c.aggregates++
+	} else {
+		c.singles++
+	}
+	c.mu.Unlock()
+
+	return c.simulatedChain.CallContract(ctx, call, blockNumber)
+}
+
+func TestTokenURIBatcherSplitsBatches(t *testing.T) {
+	chain := newSimulatedChain(t)
+	token := chain.deploy(tokenURICode(100))
+	caller := &countingCaller{simulatedChain: chain}
+
+	entries, err := exportTokenURIs(NewTokenURIBatcher(caller), token, 1, 120)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 100 {
+		t.Fatalf("exported %d tokens, want 100", len(entries))
+	}
+
+	for i, entry := range entries {
+		if id := int64(i + 1); entry.ID != id || entry.TokenURI != tokenURIOf(id) {
+			t.Fatalf("got entry %+v, want #%d", entry, id)
+		}
+	}
+
+	// the two full batches run out of gas as a whole and are split in two,
+	// the ids that don't exist revert and aren't retried
+	if caller.aggregates != 3+2+2 || caller.singles != 0 {
+		t.Errorf("made %d aggregate and %d single calls, want 7 and 0", caller.aggregates, caller.singles)
+	}
+}
+
+func TestTokenURIBatcherRetriesStarvedCalls(t *testing.T) {
+	chain := newSimulatedChain(t)
+	token := chain.deploy(tokenURICode(100))
+	caller := &countingCaller{simulatedChain: chain}
+
+	// the tenth expensive call is starved, the cheap ones after it still
+	// have gas left
+	var calls []TokenURICall
+	for id := int64(4); id <= 40; id += 4 {
+		calls = append(calls, TokenURICall{token, big.NewInt(id)})
+	}
+	calls = append(calls, TokenURICall{token, big.NewInt(101)}, TokenURICall{token, big.NewInt(1)})
+
+	results, err := NewTokenURIBatcher(caller).TokenURIs(context.Background(), calls, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, call := range calls[:10] {
+		if results[i].URI != tokenURIOf(call.ID.Int64()) {
+			t.Errorf("got %+v for #%s", results[i], call.ID)
+		}
+	}
+
+	if !errors.Is(results[10].Err, ErrCallFailed) || results[11].URI != tokenURIOf(1) {
+		t.Errorf("got %+v", results[10:])
+	}
+
+	if caller.aggregates != 2 || caller.singles != 0 {
+		t.Errorf("made %d aggregate and %d single calls, want 2 and 0", caller.aggregates, caller.singles)
+	}
+}
+
+func TestCitizenContractsTokenURIOneCall(t *testing.T) {
+	chain := newSimulatedChain(t)
+	old, v2 := chain.deploy(tokenURICode(100)), chain.deploy(tokenURICode(10))
+	caller := &countingCaller{simulatedChain: chain}
+	contracts := &CitizenContracts{OldAddress: old, NewAddress: v2, Batcher: NewTokenURIBatcher(caller)}
+
+	for _, test := range []struct {
+		id int64
+		v2 bool
+	}{{5, true}, {51, false}} {
+		caller.aggregates = 0
+		uri, v2, err := contracts.TokenURI(nil, big.NewInt(test.id))
+
+		if err != nil || uri != tokenURIOf(test.id) || v2 != test.v2 {
+			t.Errorf("got %q %v %v for #%d", uri, v2, err, test.id)
+		}
+
+		// the V2 revert is final, the original contract already answered
+		if caller.aggregates != 1 || caller.singles != 0 {
+			t.Errorf("made %d aggregate and %d single calls for #%d", caller.aggregates, caller.singles, test.id)
+		}
+	}
+
+	if _, _, err := contracts.TokenURI(nil, big.NewInt(101)); !errors.Is(err, ErrCallFailed) {
+		t.Errorf("got %v for a citizen that doesn't exist", err)
+	}
+}
+
+func TestTokenURIBatcherWithoutMulticall(t *testing.T) {
+	chain := newSimulatedChain(t)
+	token := chain.deploy(tokenURICode(3))
+	caller := &countingCaller{simulatedChain: chain}
+
+	batcher := NewTokenURIBatcher(caller)
+	// an address without code answers every call with nothing
+	batcher.Address = common.HexToAddress("0x5ca1ab1e")
+
+	calls := []TokenURICall{{token, big.NewInt(2)}, {token, big.NewInt(4)}}
+	results, err := batcher.TokenURIs(context.Background(), calls, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if results[0].URI != tokenURIOf(2) || !errors.Is(results[1].Err, ErrCallFailed) {
+		t.Fatalf("got %+v", results)
+	}
+
+	if caller.aggregates != 0 || caller.singles != 1+2 {
+		t.Errorf("made %d single calls, want 3", caller.singles)
+	}
+}
+
+// flakyContract fails like a node that is down.
+type flakyContract struct{}
+
+func (flakyContract) TokenURI(opts *bind.CallOpts, id *big.Int) (string, error) {
+	return "", errors.New("502 Bad Gateway")
+}
+
+func (flakyContract) OwnerOf(opts *bind.CallOpts, id *big.Int) (common.Address, error) {
+	return common.Address{}, errors.New("502 Bad Gateway")
+}
+
+func (flakyContract) TotalSupply(opts *bind.CallOpts) (*big.Int, error) {
+	return nil, errors.New("502 Bad Gateway")
+}
+
+func TestCitizenContractsTokenURITransient(t *testing.T) {
+	contracts := &CitizenContracts{
+		Old: &fakeCitizenContract{owners: map[int64]common.Address{1: common.HexToAddress("0xa11ce")}},
+		New: flakyContract{},
+	}
+
+	// the original contract would answer with the metadata from before
+	// the citizen migrated
+	if uri, _, err := contracts.TokenURI(nil, big.NewInt(1)); err == nil {
+		t.Fatalf("got %q while V2 was unreachable", uri)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"math/big"
+	"net/http"
+	"strconv"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/labstack/echo/v4"
+)
+
+// OwnershipSource answers who owns the tokens of a contract and how many
+// there are. The erc721 bindings implement it.
+type OwnershipSource interface {
+	OwnerOf(opts *bind.CallOpts, id *big.Int) (common.Address, error)
+	TotalSupply(opts *bind.CallOpts) (*big.Int, error)
+}
+
+// OwnerOf returns the owner of id, preferring the V2 contract for migrated
+// citizens, and reports whether the V2 contract answered.
+func (c *CitizenContracts) OwnerOf(opts *bind.CallOpts, id *big.Int) (common.Address, bool, error) {
+	owner, err := c.New.OwnerOf(opts, id)
+
+	if err == nil {
+		return owner, true, nil
+	}
+
+	if IsTransient(err) {
+		return common.Address{}, false, err
+	}
+
+	owner, err = c.Old.OwnerOf(opts, id)
+	return owner, false, err
+}
+
+// SeasonSupply is the number of citizens on each contract of a season.
+type SeasonSupply struct {
+	Season   int      `json:"season"`
+	Original *big.Int `json:"original"`
+	V2       *big.Int `json:"v2"`
+}
+
+func (c *CitizenContracts) TotalSupply(opts *bind.CallOpts) (*SeasonSupply, error) {
+	original, err := c.Old.TotalSupply(opts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	v2, err := c.New.TotalSupply(opts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &SeasonSupply{Original: original, V2: v2}, nil
+}
+
+// chainStatus picks the status for a failed contract call: a chain that
+// couldn't be reached is the gateway's fault, not the client's, and calls
+// the offline snapshot can't answer are unavailable.
+func chainStatus(err error, fallback int) int {
+	if errors.Is(err, ErrOffline) {
+		return http.StatusServiceUnavailable
+	}
+	if IsTransient(err) {
+		return http.StatusBadGateway
+	}
+	return fallback
+}
+
+func owner(contracts *CitizenContracts, season int) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+
+		opts := &bind.CallOpts{Context: c.Request().Context()}
+
+		address, v2, err := contracts.OwnerOf(opts, big.NewInt(int64(id)))
+
+		if err != nil {
+			return c.String(chainStatus(err, http.StatusNotFound), err.Error())
+		}
+
+		contract := contracts.OldAddress
+		if v2 {
+			contract = contracts.NewAddress
+		}
+
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"season":   season,
+			"id":       id,
+			"owner":    address,
+			"contract": contract,
+			"v2":       v2,
+		})
+	}
+}
+
+func supply(contracts *CitizenContracts, season int) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		opts := &bind.CallOpts{Context: c.Request().Context()}
+
+		supply, err := contracts.TotalSupply(opts)
+
+		if err != nil {
+			return c.String(chainStatus(err, http.StatusBadGateway), err.Error())
+		}
+
+		supply.Season = season
+
+		return c.JSON(http.StatusOK, supply)
+	}
+}
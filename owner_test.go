@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/NT-community/citizen-gen/erc721"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+var _ CitizenContract = (*erc721.Erc721)(nil)
+
+// fakeCitizenContract knows the owner and tokenURI of some tokens.
+type fakeCitizenContract struct {
+	owners map[int64]common.Address
+}
+
+func (f *fakeCitizenContract) TokenURI(opts *bind.CallOpts, id *big.Int) (string, error) {
+	if _, ok := f.owners[id.Int64()]; !ok {
+		return "", errors.New("execution reverted")
+	}
+	return "ipfs://citizen/" + id.String(), nil
+}
+
+func (f *fakeCitizenContract) OwnerOf(opts *bind.CallOpts, id *big.Int) (common.Address, error) {
+	owner, ok := f.owners[id.Int64()]
+	if !ok {
+		return common.Address{}, errors.New("execution reverted")
+	}
+	return owner, nil
+}
+
+func (f *fakeCitizenContract) TotalSupply(opts *bind.CallOpts) (*big.Int, error) {
+	return big.NewInt(int64(len(f.owners))), nil
+}
+
+func TestCitizenContractsPreferV2(t *testing.T) {
+	alice, bob := common.HexToAddress("0xa11ce"), common.HexToAddress("0xb0b")
+	contracts := &CitizenContracts{
+		Old: &fakeCitizenContract{owners: map[int64]common.Address{1: alice, 2: alice}},
+		New: &fakeCitizenContract{owners: map[int64]common.Address{2: bob}},
+	}
+
+	if owner, v2, err := contracts.OwnerOf(nil, big.NewInt(1)); err != nil || v2 || owner != alice {
+		t.Errorf("got %v %v %v for an unmigrated citizen", owner, v2, err)
+	}
+
+	if owner, v2, err := contracts.OwnerOf(nil, big.NewInt(2)); err != nil || !v2 || owner != bob {
+		t.Errorf("got %v %v %v for a migrated citizen", owner, v2, err)
+	}
+
+	if _, v2, err := contracts.TokenURI(nil, big.NewInt(2)); err != nil || !v2 {
+		t.Errorf("got %v %v for the tokenURI of a migrated citizen", v2, err)
+	}
+
+	if _, _, err := contracts.TokenURI(nil, big.NewInt(3)); err == nil {
+		t.Error("got a tokenURI for a citizen that doesn't exist")
+	}
+
+	supply, err := contracts.TotalSupply(nil)
+
+	if err != nil || supply.Original.Int64() != 2 || supply.V2.Int64() != 1 {
+		t.Errorf("got supply %+v %v", supply, err)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"strings"
+)
+
+// PartScale is how many pixels a part render has per SVG pixel.
+const PartScale = 2
+
+// PartRenderer rasterizes the SVG image of a part.
+type PartRenderer interface {
+	RenderSVG(ctx context.Context, svg []byte) (image.Image, error)
+}
+
+// partRenderer renders the parts route, see NewPartRendererFromEnv.
+var partRenderer PartRenderer = CanvasRenderer{}
+
+// CanvasRenderer rasterizes SVGs in process, see RasterizeSVG.
+type CanvasRenderer struct{}
+
+func (CanvasRenderer) RenderSVG(ctx context.Context, svg []byte) (image.Image, error) {
+	return RasterizeSVG(ctx, svg, PartScale)
+}
+
+// FallbackRenderer tries renderers in order until one draws the SVG
+// completely. When none does, the first best effort render is used.
+type FallbackRenderer []PartRenderer
+
+func (f FallbackRenderer) RenderSVG(ctx context.Context, svg []byte) (image.Image, error) {
+	var (
+		best image.Image
+		errs []error
+	)
+
+	for _, renderer := range f {
+		img, err := renderer.RenderSVG(ctx, svg)
+
+		if err == nil {
+			return img, nil
+		}
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		if best == nil && img != nil {
+			best = img
+		}
+
+		errs = append(errs, err)
+	}
+
+	if best != nil {
+		return best, errors.Join(errs...)
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// NewPartRendererFromEnv reads PART_RENDERER, a comma separated list of
+// "canvas" and "chrome" tried in order. It defaults to canvas only.
+func NewPartRendererFromEnv() (PartRenderer, error) {
+	var renderers FallbackRenderer
+
+	for _, name := range strings.Split(os.Getenv("PART_RENDERER"), ",") {
+		switch strings.TrimSpace(strings.ToLower(name)) {
+		case "":
+		case "canvas":
+			renderers = append(renderers, CanvasRenderer{})
+		case "chrome":
+			renderers = append(renderers, NewChromeRendererFromEnv())
+		default:
+			return nil, fmt.Errorf("unknown part renderer %q, expected canvas or chrome", name)
+		}
+	}
+
+	switch len(renderers) {
+	case 0:
+		return CanvasRenderer{}, nil
+	case 1:
+		return renderers[0], nil
+	}
+
+	return renderers, nil
+}
@@ -3,19 +3,18 @@ package main
 import (
 	"bytes"
 	"context"
-	"encoding/base64"
-	"image/png"
+	"errors"
+	"fmt"
+	"image"
 	"math/big"
 	"net/http"
 	"strconv"
 	"strings"
 
 	"github.com/NT-community/citizen-gen/erc721"
-	"github.com/chromedp/chromedp"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/labstack/echo/v4"
-	"github.com/tdewolff/canvas"
 )
 
 var (
@@ -50,7 +49,7 @@ var (
 	}
 )
 
-func part(season int, render bool, ethClient *ethclient.Client) func(ctx echo.Context) error {
+func part(season int, render bool, ethClient bind.ContractBackend) func(ctx echo.Context) error {
 	return func(ctx echo.Context) error {
 		partType := strings.ToLower(ctx.Param("part"))
 		partId, err := strconv.Atoi(ctx.Param("id"))
@@ -60,17 +59,36 @@ func part(season int, render bool, ethClient *ethclient.Client) func(ctx echo.Co
 		}
 
 		if contract, ok := PartsContracts[season][partType]; ok {
+			var enc Encoding
+
+			if render {
+				if enc, err = NegotiateEncoding(ctx, false); err != nil {
+					return ctx.String(http.StatusBadRequest, err.Error())
+				}
+			}
+
+			cacheKey := enc.Key(fmt.Sprintf("s%d/parts/%s/%d/render", season, partType, partId))
+
+			if render {
+				if ok, err := serveCached(ctx, cacheKey); ok || err != nil {
+					return err
+				}
+			}
+
 			contract, err := erc721.NewErc721(common.HexToAddress(contract), ethClient)
 
 			if err != nil {
 				return ctx.String(http.StatusInternalServerError, err.Error())
 			}
 
-			tokenUri, err := contract.TokenURI(nil, big.NewInt(int64(partId)))
+			opts := &bind.CallOpts{Context: ctx.Request().Context()}
+
+			tokenUri, err := contract.TokenURI(opts, big.NewInt(int64(partId)))
 
 			if err != nil {
-				if legacyContractAddr, ok := LegacyPartsContracts[season][partType]; !ok {
-					return ctx.String(http.StatusInternalServerError, err.Error())
+				// only a revert means the part may still be on the legacy contract
+				if legacyContractAddr, ok := LegacyPartsContracts[season][partType]; !ok || IsTransient(err) {
+					return ctx.String(chainStatus(err, http.StatusInternalServerError), err.Error())
 				} else {
 					legacyContract, err := erc721.NewErc721(common.HexToAddress(legacyContractAddr), ethClient)
 
@@ -78,72 +96,56 @@ func part(season int, render bool, ethClient *ethclient.Client) func(ctx echo.Co
 						return ctx.String(http.StatusInternalServerError, err.Error())
 					}
 
-					tokenUri, err = legacyContract.TokenURI(nil, big.NewInt(int64(partId)))
+					tokenUri, err = legacyContract.TokenURI(opts, big.NewInt(int64(partId)))
 
 					if err != nil {
-						return ctx.String(http.StatusInternalServerError, err.Error())
+						return ctx.String(chainStatus(err, http.StatusInternalServerError), err.Error())
 					}
 				}
 			}
 
-			rawMetadata, err := base64.StdEncoding.DecodeString(strings.Split(tokenUri, ",")[1])
+			metadata, err := DecodeTokenURI(tokenUri)
 
 			if err != nil {
 				return ctx.String(http.StatusInternalServerError, err.Error())
 			}
 
-			metadata, err := ParseMetadata(rawMetadata)
+			decoded, err := metadata.Image.Decode(ctx.Request().Context())
 
 			if err != nil {
-				return ctx.String(http.StatusInternalServerError, err.Error())
+				return ctx.String(resourceStatus(err), err.Error())
 			}
 
-			decoded, err := metadata.Image.Decode()
-
-			if err != nil {
-				return ctx.String(http.StatusInternalServerError, err.Error())
-			}
+			if render {
+				var img image.Image
 
-			if decoded.ContentType == "image/svg+xml" && render {
+				if decoded.ContentType == "image/svg+xml" {
+					img, err = partRenderer.RenderSVG(ctx.Request().Context(), decoded.Raw)
 
-				svgCanvas, err := canvas.ParseSVG(bytes.NewReader(decoded.Raw))
-
-				if err != nil {
-					return ctx.String(http.StatusInternalServerError, err.Error())
-				}
-
-				c, cancel := chromedp.NewContext(
-					context.Background(),
-					// chromedp.WithDebugf(log.Printf),
-				)
-				defer cancel()
-
-				// capture screenshot of an element
-				var buf []byte
-				// cnvs, err := canvas.ParseSVG(bytes.NewReader(decoded.Raw))\
-
-				w, h := int(svgCanvas.W*canvas.DefaultResolution.DPMM())*2, int(svgCanvas.H*canvas.DefaultResolution.DPMM())*2
-
-				// capture entire browser viewport, returning png with quality=90
-				if err := chromedp.Run(c, fullScreenshot(string(metadata.Image), 100, w, h, &buf)); err != nil {
-					return ctx.String(http.StatusInternalServerError, err.Error())
-				}
-
-				img, err := png.Decode(bytes.NewReader(buf))
+					if img == nil {
+						return ctx.String(http.StatusInternalServerError, err.Error())
+					}
 
-				if err != nil {
-					return ctx.String(http.StatusInternalServerError, err.Error())
+					if err != nil {
+						// still answer with the best effort render, but don't cache it
+						ctx.Logger().Warnf("render %s: %v", cacheKey, err)
+						cacheKey = ""
+					}
+				} else if img, _, err = image.Decode(bytes.NewReader(decoded.Raw)); err != nil {
+					// the part's image is broken, not the request
+					return ctx.String(http.StatusBadGateway, fmt.Sprintf("decode %s: %v", decoded.MIMEType(), err))
 				}
 
-				// croppedImg := imaging.Crop(img, image.Rect(0, 0, )
-
-				return png.Encode(ctx.Response().Writer, img)
-
+				return storeAndServe(ctx, cacheKey, img, enc, map[string]string{
+					"season":   strconv.Itoa(season),
+					"part":     partType,
+					"token-id": strconv.Itoa(partId),
+				})
 			}
 
 			resp := ctx.Response()
 
-			resp.Header().Set("Content-Type", decoded.ContentType)
+			resp.Header().Set("Content-Type", decoded.MIMEType())
 
 			resp.WriteHeader(200)
 			resp.Write(decoded.Raw)
@@ -154,10 +156,18 @@ func part(season int, render bool, ethClient *ethclient.Client) func(ctx echo.Co
 	}
 }
 
-func fullScreenshot(urlstr string, quality int, w, h int, res *[]byte) chromedp.Tasks {
-	return chromedp.Tasks{
-		chromedp.Navigate(urlstr),
-		chromedp.EmulateViewport(int64(w), int64(h)),
-		chromedp.Screenshot("svg", res, chromedp.NodeVisible),
+// resourceStatus returns the status to answer with when a part's image
+// can't be loaded.
+func resourceStatus(err error) int {
+	var statusErr *HTTPStatusError
+
+	switch {
+	case errors.Is(err, ErrEmptyResource):
+		return http.StatusNotFound
+	case errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound:
+		return http.StatusNotFound
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
 	}
+	return http.StatusBadGateway
 }
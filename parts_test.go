@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/labstack/echo/v4"
+)
+
+// partChain answers every eth_call with tokenURI, or fails with err like
+// an RPC that is down, and records the contracts that were called.
+type partChain struct {
+	*simulatedChain
+	tokenURI string
+	err      error
+	called   []common.Address
+}
+
+func (p *partChain) CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	p.called = append(p.called, *call.To)
+
+	if p.err != nil {
+		return nil, p.err
+	}
+	return erc721ABI.Methods["tokenURI"].Outputs.Pack(p.tokenURI)
+}
+
+func TestPartSkipsLegacyContractWhenChainIsDown(t *testing.T) {
+	chain := &partChain{simulatedChain: newSimulatedChain(t), err: errors.New("502 Bad Gateway")}
+
+	e := echo.New()
+	e.GET("/:part/:id", part(1, false, chain))
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/land/1", nil))
+
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("got %d %s", rec.Code, rec.Body)
+	}
+
+	if len(chain.called) != 1 || chain.called[0] != common.HexToAddress(PartsContracts[1]["land"]) {
+		t.Errorf("called %v, want only the V2 contract", chain.called)
+	}
+}
+
+func TestPartRenderEncodesRasterImages(t *testing.T) {
+	cache, err := NewFileCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(cache Cache) { renderCache = cache }(renderCache)
+	renderCache = cache
+
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	img.Set(1, 1, color.NRGBA{R: 0xff, A: 0xff})
+
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+
+	chain := &partChain{
+		simulatedChain: newSimulatedChain(t),
+		tokenURI:       `{"name": "Land", "image": "data:image/png;base64,` + base64.StdEncoding.EncodeToString(buf.Bytes()) + `"}`,
+	}
+
+	e := echo.New()
+	e.GET("/:part/:id/render", part(1, true, chain))
+	e.GET("/:part/:id", part(1, false, chain))
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/land/1/render?format=jpeg&quality=80", nil))
+
+	if rec.Code != http.StatusOK || rec.Header().Get(echo.HeaderContentType) != "image/jpeg" {
+		t.Fatalf("got %d %s %s", rec.Code, rec.Header().Get(echo.HeaderContentType), rec.Body)
+	}
+
+	if decoded, err := jpeg.Decode(rec.Body); err != nil || decoded.Bounds() != img.Bounds() {
+		t.Errorf("got %v %v", decoded, err)
+	}
+
+	// the raw route serves the image as it is
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/land/1?format=jpeg", nil))
+
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), buf.Bytes()) {
+		t.Errorf("got %d %s", rec.Code, rec.Header().Get(echo.HeaderContentType))
+	}
+
+	for _, quality := range []string{"0", "101", "best"} {
+		rec = httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/land/1/render?format=jpeg&quality="+quality, nil))
+
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("got %d for quality %s", rec.Code, quality)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Preset is a named size usable in place of the dimensions of a render,
+// e.g. /s1/twitter-header/1.
+type Preset struct {
+	Name         string   `json:"name"`
+	Description  string   `json:"description,omitempty"`
+	Width        int      `json:"width"`
+	Height       int      `json:"height"`
+	Fit          FitMode  `json:"fit,omitempty"`
+	Anchor       Anchor   `json:"anchor,omitempty"`
+	IntegerScale bool     `json:"integer_scale,omitempty"`
+	Padding      *Padding `json:"padding,omitempty"`
+}
+
+var presetNameRegex = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// presets are loaded in serve from PRESETS_FILE.
+var presets []Preset
+
+func (p Preset) apply(spec *RenderSpec) {
+	spec.Width, spec.Height = p.Width, p.Height
+	spec.Fit, spec.Anchor, spec.IntegerScale = p.Fit, p.Anchor, p.IntegerScale
+
+	if p.Padding != nil {
+		padding := *p.Padding
+		spec.Padding = &padding
+	}
+}
+
+func lookupPreset(name string) (Preset, bool) {
+	for _, preset := range presets {
+		if preset.Name == name {
+			return preset, true
+		}
+	}
+	return Preset{}, false
+}
+
+// LoadPresets reads a JSON list of presets. A missing file is no presets.
+func LoadPresets(path string) ([]Preset, error) {
+	data, err := os.ReadFile(path)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var list []Preset
+
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	seen := map[string]bool{}
+
+	for i := range list {
+		preset := &list[i]
+
+		if !presetNameRegex.MatchString(preset.Name) || preset.Name == "pfp" {
+			return nil, fmt.Errorf("%s: invalid preset name %q", path, preset.Name)
+		}
+
+		if seen[preset.Name] {
+			return nil, fmt.Errorf("%s: preset %q is defined twice", path, preset.Name)
+		}
+		seen[preset.Name] = true
+
+		// a preset is valid when the spec it makes is, and it's stored the
+		// way the spec normalizes it
+		spec := &RenderSpec{Season: 1}
+		preset.apply(spec)
+
+		if err := spec.Validate(); err != nil {
+			return nil, fmt.Errorf("%s: preset %q: %w", path, preset.Name, err)
+		}
+
+		preset.Fit, preset.Anchor, preset.IntegerScale, preset.Padding = spec.Fit, spec.Anchor, spec.IntegerScale, spec.Padding
+	}
+
+	return list, nil
+}
+
+func listPresets(c echo.Context) error {
+	list := presets
+	if list == nil {
+		list = []Preset{}
+	}
+	return c.JSON(http.StatusOK, list)
+}
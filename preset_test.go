@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestLoadPresetsAssets(t *testing.T) {
+	list, err := LoadPresets("assets/presets.json")
+
+	if err != nil || len(list) == 0 {
+		t.Fatalf("got %d presets %v", len(list), err)
+	}
+
+	for _, preset := range list {
+		// stored normalized, so what /presets lists is what renders use
+		if preset.Fit == "" || preset.Width == 0 || preset.Height == 0 {
+			t.Errorf("got preset %+v", preset)
+		}
+	}
+
+	if list, err := LoadPresets(filepath.Join(t.TempDir(), "missing.json")); list != nil || err != nil {
+		t.Errorf("got %v %v for a missing file", list, err)
+	}
+}
+
+func TestLoadPresetsRejects(t *testing.T) {
+	tests := map[string]string{
+		"duplicate name":   `[{"name": "a", "width": 10, "height": 10}, {"name": "a", "width": 20, "height": 20}]`,
+		"reserved pfp":     `[{"name": "pfp", "width": 10, "height": 10}]`,
+		"invalid name":     `[{"name": "Big Banner", "width": 10, "height": 10}]`,
+		"unknown fit":      `[{"name": "a", "width": 10, "height": 10, "fit": "fill"}]`,
+		"unknown anchor":   `[{"name": "a", "width": 10, "height": 10, "fit": "cover", "anchor": "top"}]`,
+		"negative padding": `[{"name": "a", "width": 10, "height": 10, "fit": "pad", "padding": {"top": -1}}]`,
+		"padding too wide": `[{"name": "a", "width": 10, "height": 10, "fit": "pad", "padding": {"left": 5, "right": 5}}]`,
+		"no size":          `[{"name": "a"}]`,
+		"not a list":       `{"name": "a", "width": 10, "height": 10}`,
+	}
+
+	for name, presets := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "presets.json")
+
+			if err := os.WriteFile(path, []byte(presets), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			if list, err := LoadPresets(path); err == nil {
+				t.Errorf("loaded %+v", list)
+			}
+		})
+	}
+}
+
+func TestListPresets(t *testing.T) {
+	defer func(list []Preset) { presets = list }(presets)
+
+	e := echo.New()
+	e.GET("/presets", listPresets)
+
+	for _, list := range [][]Preset{nil, {{Name: "banner", Width: 1500, Height: 500, Fit: FitPad, Anchor: AnchorFeet, Padding: &Padding{Top: 60}}}} {
+		presets = list
+
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/presets", nil))
+
+		var got []Preset
+
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); rec.Code != http.StatusOK || err != nil || got == nil || len(got) != len(list) {
+			t.Fatalf("got %d %s %v", rec.Code, rec.Body, err)
+		}
+
+		if len(list) > 0 && (got[0].Name != "banner" || got[0].Padding == nil || got[0].Padding.Top != 60) {
+			t.Errorf("got %+v", got[0])
+		}
+	}
+}
+
+func TestPresetDimensions(t *testing.T) {
+	defer func(list []Preset) { presets = list }(presets)
+	presets = []Preset{{Name: "banner", Width: 1500, Height: 500, Fit: FitCover, Anchor: AnchorHead}}
+
+	spec := &RenderSpec{Season: 1, TokenID: 1}
+
+	if err := spec.setDimensions("Banner"); err != nil || spec.Width != 1500 || spec.Height != 500 || spec.Fit != FitCover || spec.Anchor != AnchorHead {
+		t.Errorf("got %+v %v", spec, err)
+	}
+
+	if err := spec.setDimensions("banner-2"); err == nil || !strings.Contains(err.Error(), "invalid") {
+		t.Errorf("got %v for an unknown preset", err)
+	}
+}
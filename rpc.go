@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// TokenURISource resolves the tokenURI of a token. The erc721 bindings
+// implement it, and so can anything else able to answer for a contract.
+type TokenURISource interface {
+	TokenURI(opts *bind.CallOpts, id *big.Int) (string, error)
+}
+
+// IsTransient reports whether err is worth retrying on another endpoint,
+// as opposed to an answer from the chain such as a reverted call.
+func IsTransient(err error) bool {
+	// no code is what a call before the contract was deployed gets
+	if err == nil || errors.Is(err, ErrOffline) || errors.Is(err, bind.ErrNoCode) {
+		return false
+	}
+
+	var httpErr rpc.HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode == 429 || httpErr.StatusCode >= 500
+	}
+
+	var rpcErr rpc.Error
+	if errors.As(err, &rpcErr) {
+		// 3 is a revert with data, -32000 is used by geth for reverts
+		// without data but also for "header not found" and friends
+		if rpcErr.ErrorCode() == 3 {
+			return false
+		}
+		return !isChainAnswer(rpcErr)
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	return !isChainAnswer(err)
+}
+
+// isChainAnswer reports whether err is the outcome of running a call, the
+// same on every node: a revert, or running out of gas.
+func isChainAnswer(err error) bool {
+	return strings.Contains(err.Error(), "execution reverted") || isOutOfGas(err)
+}
+
+// Endpoint is a single RPC URL of a MultiBackend.
+type Endpoint struct {
+	URL    string
+	client *ethclient.Client
+
+	requests, failures uint64
+
+	mu sync.Mutex
+	// errorRate is an exponentially weighted moving average of failures
+	errorRate float64
+	downUntil time.Time
+	lastError string
+}
+
+// EndpointStats is a snapshot of an endpoint's health.
+type EndpointStats struct {
+	URL       string  `json:"url"`
+	Healthy   bool    `json:"healthy"`
+	Requests  uint64  `json:"requests"`
+	Failures  uint64  `json:"failures"`
+	ErrorRate float64 `json:"error_rate"`
+	LastError string  `json:"last_error,omitempty"`
+}
+
+func (e *Endpoint) healthy(now time.Time) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return !now.Before(e.downUntil)
+}
+
+func (e *Endpoint) record(err error, cooldown time.Duration) {
+	atomic.AddUint64(&e.requests, 1)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	const weight = 0.1
+
+	if err == nil {
+		e.errorRate *= 1 - weight
+		return
+	}
+
+	atomic.AddUint64(&e.failures, 1)
+	e.errorRate = e.errorRate*(1-weight) + weight
+	e.lastError = err.Error()
+	e.downUntil = time.Now().Add(cooldown)
+}
+
+func (e *Endpoint) stats(now time.Time) EndpointStats {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return EndpointStats{
+		URL:       e.URL,
+		Healthy:   !now.Before(e.downUntil),
+		Requests:  atomic.LoadUint64(&e.requests),
+		Failures:  atomic.LoadUint64(&e.failures),
+		ErrorRate: e.errorRate,
+		LastError: e.lastError,
+	}
+}
+
+// MultiBackend is a bind.ContractBackend spreading calls round-robin over
+// several RPC endpoints. Transient failures mark an endpoint unhealthy for
+// Cooldown and the call moves on to the next endpoint; when every endpoint
+// failed the whole round is retried up to Retries times with backoff.
+type MultiBackend struct {
+	Endpoints []*Endpoint
+
+	Timeout  time.Duration
+	Retries  int
+	Backoff  time.Duration
+	Cooldown time.Duration
+
+	next uint32
+}
+
+var _ bind.ContractBackend = (*MultiBackend)(nil)
+
+// NewMultiBackend dials every URL. Endpoints that can't be dialed are
+// skipped; it only fails when none of them can.
+func NewMultiBackend(urls []string) (*MultiBackend, error) {
+	m := &MultiBackend{
+		Timeout:  10 * time.Second,
+		Retries:  2,
+		Backoff:  200 * time.Millisecond,
+		Cooldown: 10 * time.Second,
+	}
+
+	var errs []error
+
+	for _, u := range urls {
+		if u = strings.TrimSpace(u); u == "" {
+			continue
+		}
+
+		client, err := ethclient.Dial(u)
+
+		if err != nil {
+			log.Printf("rpc: skipping %s: %v", redactURL(u), err)
+			errs = append(errs, err)
+			continue
+		}
+
+		m.Endpoints = append(m.Endpoints, &Endpoint{URL: redactURL(u), client: client})
+	}
+
+	if len(m.Endpoints) == 0 {
+		return nil, fmt.Errorf("rpc: no usable endpoint: %w", errors.Join(errs...))
+	}
+	return m, nil
+}
+
+// NewMultiBackendFromEnv dials the comma separated endpoints in RPC.
+func NewMultiBackendFromEnv() (*MultiBackend, error) {
+	m, err := NewMultiBackend(strings.Split(os.Getenv("RPC"), ","))
+
+	if err != nil {
+		return nil, err
+	}
+
+	m.Timeout = envDuration("RPC_TIMEOUT", m.Timeout)
+	m.Retries = envCount("RPC_RETRIES", m.Retries)
+	return m, nil
+}
+
+// redactURL strips anything after the host, API keys tend to live there.
+func redactURL(u string) string {
+	if idx := strings.Index(u, "://"); idx >= 0 {
+		if slash := strings.Index(u[idx+3:], "/"); slash >= 0 {
+			return u[:idx+3+slash] + "/..."
+		}
+	}
+	return u
+}
+
+// order returns the endpoints for the next call, rotating the starting
+// point and moving unhealthy endpoints to the back.
+func (m *MultiBackend) order() []*Endpoint {
+	now := time.Now()
+	start := int(atomic.AddUint32(&m.next, 1))
+
+	var healthy, down []*Endpoint
+	for i := range m.Endpoints {
+		e := m.Endpoints[(start+i)%len(m.Endpoints)]
+		if e.healthy(now) {
+			healthy = append(healthy, e)
+		} else {
+			down = append(down, e)
+		}
+	}
+	return append(healthy, down...)
+}
+
+// do runs call against the endpoints until it succeeds or fails with a
+// non-transient error.
+func (m *MultiBackend) do(ctx context.Context, call func(ctx context.Context, client *ethclient.Client) error) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	var errs []error
+
+	for attempt := 0; attempt <= m.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(m.Backoff << (attempt - 1)):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		for _, e := range m.order() {
+			callCtx, cancel := context.WithTimeout(ctx, m.Timeout)
+			err := call(callCtx, e.client)
+			cancel()
+
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			if !IsTransient(err) {
+				e.record(nil, m.Cooldown)
+				return err
+			}
+
+			e.record(err, m.Cooldown)
+			errs = append(errs, fmt.Errorf("%s: %w", e.URL, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (m *MultiBackend) Stats() []EndpointStats {
+	now := time.Now()
+
+	stats := make([]EndpointStats, 0, len(m.Endpoints))
+	for _, e := range m.Endpoints {
+		stats = append(stats, e.stats(now))
+	}
+	return stats
+}
+
+func (m *MultiBackend) CodeAt(ctx context.Context, contract common.Address, blockNumber *big.Int) (code []byte, err error) {
+	err = m.do(ctx, func(ctx context.Context, c *ethclient.Client) (err error) {
+		code, err = c.CodeAt(ctx, contract, blockNumber)
+		return err
+	})
+	return code, err
+}
+
+func (m *MultiBackend) CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) (out []byte, err error) {
+	err = m.do(ctx, func(ctx context.Context, c *ethclient.Client) (err error) {
+		out, err = c.CallContract(ctx, call, blockNumber)
+		return err
+	})
+	return out, err
+}
+
+func (m *MultiBackend) HeaderByNumber(ctx context.Context, number *big.Int) (header *types.Header, err error) {
+	err = m.do(ctx, func(ctx context.Context, c *ethclient.Client) (err error) {
+		header, err = c.HeaderByNumber(ctx, number)
+		return err
+	})
+	return header, err
+}
+
+func (m *MultiBackend) PendingCodeAt(ctx context.Context, account common.Address) (code []byte, err error) {
+	err = m.do(ctx, func(ctx context.Context, c *ethclient.Client) (err error) {
+		code, err = c.PendingCodeAt(ctx, account)
+		return err
+	})
+	return code, err
+}
+
+func (m *MultiBackend) PendingNonceAt(ctx context.Context, account common.Address) (nonce uint64, err error) {
+	err = m.do(ctx, func(ctx context.Context, c *ethclient.Client) (err error) {
+		nonce, err = c.PendingNonceAt(ctx, account)
+		return err
+	})
+	return nonce, err
+}
+
+func (m *MultiBackend) SuggestGasPrice(ctx context.Context) (price *big.Int, err error) {
+	err = m.do(ctx, func(ctx context.Context, c *ethclient.Client) (err error) {
+		price, err = c.SuggestGasPrice(ctx)
+		return err
+	})
+	return price, err
+}
+
+func (m *MultiBackend) SuggestGasTipCap(ctx context.Context) (tip *big.Int, err error) {
+	err = m.do(ctx, func(ctx context.Context, c *ethclient.Client) (err error) {
+		tip, err = c.SuggestGasTipCap(ctx)
+		return err
+	})
+	return tip, err
+}
+
+func (m *MultiBackend) EstimateGas(ctx context.Context, call ethereum.CallMsg) (gas uint64, err error) {
+	err = m.do(ctx, func(ctx context.Context, c *ethclient.Client) (err error) {
+		gas, err = c.EstimateGas(ctx, call)
+		return err
+	})
+	return gas, err
+}
+
+func (m *MultiBackend) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	return m.do(ctx, func(ctx context.Context, c *ethclient.Client) error {
+		return c.SendTransaction(ctx, tx)
+	})
+}
+
+func (m *MultiBackend) FilterLogs(ctx context.Context, query ethereum.FilterQuery) (logs []types.Log, err error) {
+	err = m.do(ctx, func(ctx context.Context, c *ethclient.Client) (err error) {
+		logs, err = c.FilterLogs(ctx, query)
+		return err
+	})
+	return logs, err
+}
+
+// SubscribeFilterLogs subscribes on the first endpoint that supports it. A
+// subscription is bound to its connection, so it does not fail over.
+func (m *MultiBackend) SubscribeFilterLogs(ctx context.Context, query ethereum.FilterQuery, ch chan<- types.Log) (ethereum.Subscription, error) {
+	var errs []error
+
+	for _, e := range m.order() {
+		sub, err := e.client.SubscribeFilterLogs(ctx, query, ch)
+		if err == nil {
+			return sub, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
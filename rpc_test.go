@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// fakeRPC is a JSON-RPC endpoint answering eth_getCode. Its failure mode
+// can be switched while it serves, and the first failFirst requests fail
+// no matter the mode.
+type fakeRPC struct {
+	URL string
+
+	mode      atomic.Value
+	failFirst int64
+	requests  int64
+}
+
+const (
+	rpcOK            = "ok"
+	rpcStatus500     = "500"
+	rpcStatus429     = "429"
+	rpcStatus404     = "404"
+	rpcRevert        = "revert"
+	rpcRevertNoData  = "revert without data"
+	rpcHeaderMissing = "header not found"
+	rpcOutOfGas      = "out of gas"
+	rpcHang          = "hang"
+	rpcHangUp        = "hang up"
+)
+
+func newFakeRPC(t *testing.T, mode string) *fakeRPC {
+	f := &fakeRPC{}
+	f.mode.Store(mode)
+
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+
+	f.URL = server.URL
+	return f
+}
+
+func (f *fakeRPC) count() int64 {
+	return atomic.LoadInt64(&f.requests)
+}
+
+func (f *fakeRPC) setMode(mode string) {
+	f.mode.Store(mode)
+}
+
+func (f *fakeRPC) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID json.RawMessage `json:"id"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+
+	mode := f.mode.Load().(string)
+	if atomic.AddInt64(&f.requests, 1) <= f.failFirst {
+		mode = rpcStatus500
+	}
+
+	reply := func(body string) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"jsonrpc":"2.0","id":%s,%s}`, req.ID, body)
+	}
+
+	switch mode {
+	case rpcOK:
+		reply(`"result":"0x6001"`)
+	case rpcStatus500:
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	case rpcStatus429:
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+	case rpcStatus404:
+		http.Error(w, "not found", http.StatusNotFound)
+	case rpcRevert:
+		reply(`"error":{"code":3,"message":"execution reverted: nope","data":"0x08c379a0"}`)
+	case rpcRevertNoData:
+		reply(`"error":{"code":-32000,"message":"execution reverted"}`)
+	case rpcOutOfGas:
+		reply(`"error":{"code":-32000,"message":"out of gas"}`)
+	case rpcHeaderMissing:
+		reply(`"error":{"code":-32000,"message":"header not found"}`)
+	case rpcHang:
+		<-r.Context().Done()
+	case rpcHangUp:
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		mode      string
+		transient bool
+	}{
+		{rpcOK, false},
+		{rpcStatus500, true},
+		{rpcStatus429, true},
+		{rpcStatus404, false},
+		{rpcRevert, false},
+		{rpcRevertNoData, false},
+		{rpcOutOfGas, false},
+		{rpcHeaderMissing, true},
+		{rpcHang, true},
+		{rpcHangUp, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			client, err := ethclient.Dial(newFakeRPC(t, test.mode).URL)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			_, err = client.CodeAt(ctx, common.Address{}, nil)
+
+			if got := IsTransient(err); got != test.transient {
+				t.Errorf("IsTransient(%v) = %v, want %v", err, got, test.transient)
+			}
+		})
+	}
+
+	for _, err := range []error{ErrOffline, bind.ErrNoCode, fmt.Errorf("call: %w", bind.ErrNoCode), errors.New("execution reverted")} {
+		if IsTransient(err) {
+			t.Errorf("IsTransient(%v) = true", err)
+		}
+	}
+}
+
+// newTestMultiBackend spreads calls over the stand-ins without waiting
+// between retries.
+func newTestMultiBackend(t *testing.T, endpoints ...*fakeRPC) *MultiBackend {
+	var urls []string
+	for _, e := range endpoints {
+		urls = append(urls, e.URL)
+	}
+
+	m, err := NewMultiBackend(urls)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.Timeout = 100 * time.Millisecond
+	m.Backoff = time.Millisecond
+	m.Cooldown = time.Hour
+	return m
+}
+
+func TestMultiBackendRoundRobin(t *testing.T) {
+	endpoints := []*fakeRPC{newFakeRPC(t, rpcOK), newFakeRPC(t, rpcOK), newFakeRPC(t, rpcOK)}
+	m := newTestMultiBackend(t, endpoints...)
+
+	for i := 0; i < 9; i++ {
+		if _, err := m.CodeAt(context.Background(), common.Address{}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, e := range endpoints {
+		if e.count() != 3 {
+			t.Errorf("endpoint %d got %d requests, want 3", i, e.count())
+		}
+	}
+}
+
+func TestMultiBackendFailover(t *testing.T) {
+	for _, mode := range []string{rpcStatus500, rpcStatus429, rpcHeaderMissing, rpcHang, rpcHangUp} {
+		t.Run(mode, func(t *testing.T) {
+			bad, good := newFakeRPC(t, mode), newFakeRPC(t, rpcOK)
+			m := newTestMultiBackend(t, bad, good)
+
+			for i := 0; i < 6; i++ {
+				if code, err := m.CodeAt(context.Background(), common.Address{}, nil); err != nil || len(code) != 2 {
+					t.Fatalf("got %x %v", code, err)
+				}
+			}
+
+			// the failure puts it in cooldown, later calls go elsewhere
+			if bad.count() != 1 || good.count() != 6 {
+				t.Errorf("got %d requests on the failing endpoint and %d on the other, want 1 and 6", bad.count(), good.count())
+			}
+
+			stats := m.Stats()
+
+			if stats[0].Healthy || stats[0].Failures != 1 || stats[0].LastError == "" || !stats[1].Healthy {
+				t.Errorf("got stats %+v", stats)
+			}
+		})
+	}
+}
+
+func TestMultiBackendCooldown(t *testing.T) {
+	flaky, good := newFakeRPC(t, rpcStatus500), newFakeRPC(t, rpcOK)
+	m := newTestMultiBackend(t, flaky, good)
+	m.Cooldown = 50 * time.Millisecond
+
+	for i := 0; i < 2; i++ {
+		if _, err := m.CodeAt(context.Background(), common.Address{}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	flaky.setMode(rpcOK)
+
+	for i := 0; i < 4; i++ {
+		m.CodeAt(context.Background(), common.Address{}, nil)
+	}
+
+	if flaky.count() != 1 {
+		t.Fatalf("the endpoint got %d requests while cooling down, want 1", flaky.count())
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	for i := 0; i < 4; i++ {
+		m.CodeAt(context.Background(), common.Address{}, nil)
+	}
+
+	if flaky.count() != 3 || !m.Stats()[0].Healthy {
+		t.Errorf("the endpoint got %d requests after cooling down, want 3", flaky.count())
+	}
+}
+
+func TestMultiBackendRetries(t *testing.T) {
+	a, b := newFakeRPC(t, rpcOK), newFakeRPC(t, rpcOK)
+	a.failFirst, b.failFirst = 2, 2
+	m := newTestMultiBackend(t, a, b)
+
+	// the first two rounds fail on both endpoints, the third succeeds
+	if _, err := m.CodeAt(context.Background(), common.Address{}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if a.count()+b.count() != 5 {
+		t.Errorf("made %d requests, want 5", a.count()+b.count())
+	}
+
+	atomic.StoreInt64(&a.requests, 0)
+	atomic.StoreInt64(&b.requests, 0)
+	m.Retries = 1
+
+	_, err := m.CodeAt(context.Background(), common.Address{}, nil)
+
+	if err == nil || !strings.Contains(err.Error(), a.URL) || !strings.Contains(err.Error(), b.URL) {
+		t.Fatalf("got %v, want the errors of both endpoints", err)
+	}
+
+	if a.count()+b.count() != 4 {
+		t.Errorf("made %d requests, want 4", a.count()+b.count())
+	}
+}
+
+func TestMultiBackendDoesNotRetryReverts(t *testing.T) {
+	a, b := newFakeRPC(t, rpcRevert), newFakeRPC(t, rpcRevert)
+	m := newTestMultiBackend(t, a, b)
+
+	_, err := m.CodeAt(context.Background(), common.Address{}, nil)
+
+	if err == nil || !strings.Contains(err.Error(), "execution reverted") {
+		t.Fatalf("got %v, want the revert", err)
+	}
+
+	if a.count()+b.count() != 1 {
+		t.Errorf("made %d requests for a revert, want 1", a.count()+b.count())
+	}
+
+	if stats := m.Stats(); !stats[0].Healthy || !stats[1].Healthy {
+		t.Errorf("a revert marked an endpoint unhealthy: %+v", stats)
+	}
+}
+
+func TestMultiBackendCanceled(t *testing.T) {
+	m := newTestMultiBackend(t, newFakeRPC(t, rpcHang))
+	m.Timeout = time.Minute
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := m.CodeAt(ctx, common.Address{}, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want the deadline of the caller", err)
+	}
+
+	if m.Stats()[0].Failures != 0 {
+		t.Error("the caller giving up counted against the endpoint")
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const s3MetaPrefix = "X-Amz-Meta-"
+
+// S3Cache stores entries in an S3-compatible bucket (AWS S3, MinIO, R2, ...).
+// Requests are signed with AWS Signature Version 4.
+type S3Cache struct {
+	Endpoint  *url.URL
+	Bucket    string
+	Region    string
+	Prefix    string
+	PathStyle bool
+
+	AccessKeyID, SecretAccessKey string
+
+	Client *http.Client
+}
+
+// NewS3CacheFromEnv configures an S3Cache from S3_* environment variables.
+// S3_ENDPOINT is optional for AWS; set it to point at MinIO or another
+// compatible service, in which case path-style addressing is the default.
+func NewS3CacheFromEnv() (*S3Cache, error) {
+	bucket := os.Getenv("S3_BUCKET")
+	if bucket == "" {
+		return nil, errors.New("S3_BUCKET is required for the s3 cache backend")
+	}
+
+	region := os.Getenv("S3_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	rawEndpoint := os.Getenv("S3_ENDPOINT")
+	pathStyle := rawEndpoint != ""
+	if rawEndpoint == "" {
+		rawEndpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+
+	if v := os.Getenv("S3_PATH_STYLE"); v != "" {
+		parsed, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid S3_PATH_STYLE: %w", err)
+		}
+		pathStyle = parsed
+	}
+
+	endpoint, err := url.Parse(rawEndpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	return &S3Cache{
+		Endpoint:        endpoint,
+		Bucket:          bucket,
+		Region:          region,
+		Prefix:          strings.Trim(os.Getenv("S3_PREFIX"), "/"),
+		PathStyle:       pathStyle,
+		AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		Client:          &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (s *S3Cache) objectURL(key string) (*url.URL, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.Prefix != "" {
+		key = s.Prefix + "/" + key
+	}
+
+	u := *s.Endpoint
+	if s.PathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.Bucket + "/" + key
+	} else {
+		u.Host = s.Bucket + "." + u.Host
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	}
+	return &u, nil
+}
+
+func (s *S3Cache) do(ctx context.Context, method, key string, body []byte, header http.Header) (*http.Response, error) {
+	u, err := s.objectURL(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.send(ctx, method, u, body, header)
+}
+
+func (s *S3Cache) send(ctx context.Context, method string, u *url.URL, body []byte, header http.Header) (*http.Response, error) {
+	// sent exactly as signed, Go's own escaping isn't SigV4's
+	escaped := *u
+	escaped.RawPath = s3Escape(u.Path, false)
+	escaped.RawQuery = s3CanonicalQuery(u.Query())
+	u = &escaped
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	s.sign(req, body, time.Now().UTC())
+
+	return s.Client.Do(req)
+}
+
+func (s *S3Cache) Get(ctx context.Context, key string) ([]byte, *CacheEntry, error) {
+	resp, err := s.do(ctx, http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := s3Error(resp); err != nil {
+		return nil, nil, err
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entry := s3Entry(resp)
+	entry.Size = int64(len(data))
+	return data, entry, nil
+}
+
+func (s *S3Cache) Put(ctx context.Context, key string, data []byte, entry CacheEntry) error {
+	header := http.Header{}
+	if entry.ContentType != "" {
+		header.Set("Content-Type", entry.ContentType)
+	}
+	for k, v := range entry.Metadata {
+		header.Set(s3MetaPrefix+k, v)
+	}
+
+	resp, err := s.do(ctx, http.MethodPut, key, data, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return s3Error(resp)
+}
+
+func (s *S3Cache) Stat(ctx context.Context, key string) (*CacheEntry, error) {
+	resp, err := s.do(ctx, http.MethodHead, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := s3Error(resp); err != nil {
+		return nil, err
+	}
+
+	return s3Entry(resp), nil
+}
+
+func (s *S3Cache) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := s3Error(resp); err != nil && !errors.Is(err, ErrCacheMiss) {
+		return err
+	}
+	return nil
+}
+
+// s3ListResult is the part of a ListObjectsV2 response List needs.
+type s3ListResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *S3Cache) List(ctx context.Context, prefix string) ([]string, error) {
+	u := *s.Endpoint
+	if s.PathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.Bucket + "/"
+	} else {
+		u.Host = s.Bucket + "." + u.Host
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/"
+	}
+
+	fullPrefix := prefix
+	if s.Prefix != "" {
+		fullPrefix = s.Prefix + "/" + prefix
+	}
+
+	var keys []string
+	token := ""
+
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {fullPrefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		u.RawQuery = query.Encode()
+
+		resp, err := s.send(ctx, http.MethodGet, &u, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var result s3ListResult
+
+		err = s3Error(resp)
+		if err == nil {
+			err = xml.NewDecoder(resp.Body).Decode(&result)
+		}
+		resp.Body.Close()
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range result.Contents {
+			keys = append(keys, strings.TrimPrefix(object.Key, s.Prefix+"/"))
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func s3Error(resp *http.Response) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrCacheMiss
+	}
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("s3: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func s3Entry(resp *http.Response) *CacheEntry {
+	entry := &CacheEntry{
+		ContentType: resp.Header.Get("Content-Type"),
+		Size:        resp.ContentLength,
+		Metadata:    map[string]string{},
+	}
+
+	if modified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		entry.ModTime = modified
+	}
+
+	for k, v := range resp.Header {
+		if strings.HasPrefix(k, s3MetaPrefix) && len(v) > 0 {
+			entry.Metadata[strings.ToLower(k[len(s3MetaPrefix):])] = v[0]
+		}
+	}
+	return entry
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req.
+func (s *S3Cache) sign(req *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256Hex(body)
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	var names []string
+	canonicalHeaders := map[string]string{}
+	for k, v := range req.Header {
+		name := strings.ToLower(k)
+		names = append(names, name)
+		canonicalHeaders[name] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	sort.Strings(names)
+
+	var headerBlock strings.Builder
+	for _, name := range names {
+		headerBlock.WriteString(name + ":" + canonicalHeaders[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, false),
+		s3CanonicalQuery(req.URL.Query()),
+		headerBlock.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{date, s.Region, "s3", "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretAccessKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKeyID, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign)),
+	))
+	req.Header.Del("Host")
+}
+
+// s3Escape percent-encodes everything but the RFC 3986 unreserved
+// characters, and slashes unless escapeSlash is set, as SigV4 expects.
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3CanonicalQuery encodes query the SigV4 way: escaped names and values,
+// sorted by name and then value.
+func s3CanonicalQuery(query url.Values) string {
+	var pairs [][2]string
+
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, [2]string{s3Escape(name, true), s3Escape(value, true)})
+		}
+	}
+
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i][0] != pairs[j][0] {
+			return pairs[i][0] < pairs[j][0]
+		}
+		return pairs[i][1] < pairs[j][1]
+	})
+
+	encoded := make([]string, len(pairs))
+	for i, pair := range pairs {
+		encoded[i] = pair[0] + "=" + pair[1]
+	}
+	return strings.Join(encoded, "&")
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
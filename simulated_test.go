@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// simulatedChain is an in-memory chain with a funded account.
+type simulatedChain struct {
+	*backends.SimulatedBackend
+	t    *testing.T
+	opts *bind.TransactOpts
+}
+
+func newSimulatedChain(t *testing.T) *simulatedChain {
+	key, err := crypto.GenerateKey()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts, err := bind.NewKeyedTransactorWithChainID(key, big.NewInt(1337))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	balance := new(big.Int).Lsh(big.NewInt(1), 100)
+	alloc := core.GenesisAlloc{
+		opts.From:         {Balance: balance},
+		Multicall3Address: {Balance: new(big.Int), Code: multicall3Code(t)},
+	}
+	backend := backends.NewSimulatedBackend(alloc, 30_000_000)
+	t.Cleanup(func() { backend.Close() })
+
+	return &simulatedChain{SimulatedBackend: backend, t: t, opts: opts}
+}
+
+// multicall3Code is the runtime code of Multicall3 (github.com/mds1/multicall,
+// MIT licensed) as deployed on mainnet.
+func multicall3Code(t *testing.T) []byte {
+	hexCode, err := os.ReadFile("testdata/multicall3.hex")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	return common.FromHex(strings.TrimSpace(string(hexCode)))
+}
+
+// deploy creates a contract running code and mines it.
+func (s *simulatedChain) deploy(code []byte) common.Address {
+	// the init code copies the code after it to memory and returns it
+	init := []byte{
+		0x61, byte(len(code) >> 8), byte(len(code)), // PUSH2 len
+		0x80,       // DUP1
+		0x60, 0x0c, // PUSH1 12, the length of the init code
+		0x60, 0x00, // PUSH1 0
+		0x39,       // CODECOPY
+		0x60, 0x00, // PUSH1 0
+		0xf3, // RETURN
+	}
+
+	address, _, _, err := bind.DeployContract(s.opts, abi.ABI{}, append(init, code...), s)
+
+	if err != nil {
+		s.t.Fatal(err)
+	}
+
+	s.Commit()
+	return address
+}
+
+// transact sends data to a contract, the block has to be committed.
+func (s *simulatedChain) transact(to common.Address, data []byte) {
+	opts := *s.opts
+	opts.GasLimit = 1_000_000
+
+	if _, err := bind.NewBoundContract(to, abi.ABI{}, s, s, s).RawTransact(&opts, data); err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+// transferEmitterCode logs a Transfer of the id in the second calldata word
+// from the address in the third word to the one in the first.
+func transferEmitterCode() []byte {
+	code := []byte{
+		0x60, 0x20, 0x35, // PUSH1 32 CALLDATALOAD, the id
+		0x60, 0x00, 0x35, // PUSH1 0 CALLDATALOAD, to
+		0x60, 0x40, 0x35, // PUSH1 64 CALLDATALOAD, from
+		0x7f, // PUSH32 the event signature
+	}
+	code = append(code, transferTopic.Bytes()...)
+	return append(code,
+		0x60, 0x00, 0x60, 0x00, // PUSH1 0 PUSH1 0, no data
+		0xa4, // LOG4
+		0x00, // STOP
+	)
+}
+
+// emitTransfer has a transfer emitter log a transfer of id.
+func (s *simulatedChain) emitTransfer(contract, from, to common.Address, id int64) {
+	data := append(common.LeftPadBytes(to.Bytes(), 32), common.LeftPadBytes(big.NewInt(id).Bytes(), 32)...)
+	s.transact(contract, append(data, common.LeftPadBytes(from.Bytes(), 32)...))
+}
+
+func (s *simulatedChain) blockHash(number uint64) common.Hash {
+	header, err := s.HeaderByNumber(context.Background(), new(big.Int).SetUint64(number))
+
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return header.Hash()
+}
+
+// storeCode stores the second calldata word at the slot in the first.
+func storeCode() []byte {
+	return []byte{
+		0x60, 0x20, 0x35, // PUSH1 32 CALLDATALOAD, the value
+		0x60, 0x00, 0x35, // PUSH1 0 CALLDATALOAD, the slot
+		0x55, // SSTORE
+		0x00, // STOP
+	}
+}
+
+// storedCitizen is a citizen contract whose tokenURIs are made up from a
+// version kept in the storage of a store contract, one slot per id. The
+// simulated backend can only call contracts at the latest block, but it
+// can read the storage of any.
+type storedCitizen struct {
+	chain   *simulatedChain
+	address common.Address
+}
+
+func (s *simulatedChain) deployStoredCitizen() *storedCitizen {
+	return &storedCitizen{chain: s, address: s.deploy(storeCode())}
+}
+
+// setVersion changes the tokenURI of id, 0 burns it; the block has to be
+// committed.
+func (c *storedCitizen) setVersion(id, version int64) {
+	data := append(common.LeftPadBytes(big.NewInt(id).Bytes(), 32), common.LeftPadBytes(big.NewInt(version).Bytes(), 32)...)
+	c.chain.transact(c.address, data)
+}
+
+func (c *storedCitizen) TokenURI(opts *bind.CallOpts, id *big.Int) (string, error) {
+	ctx, block := context.Background(), (*big.Int)(nil)
+
+	if opts != nil {
+		block = opts.BlockNumber
+		if opts.Context != nil {
+			ctx = opts.Context
+		}
+	}
+
+	value, err := c.chain.StorageAt(ctx, c.address, common.BigToHash(id), block)
+
+	if err != nil {
+		return "", err
+	}
+
+	version := new(big.Int).SetBytes(value)
+
+	if version.Sign() == 0 {
+		return "", errors.New("execution reverted")
+	}
+	return fmt.Sprintf(`data:application/json,{"name":"Citizen #%s","description":"version %s"}`, id, version), nil
+}
+
+func (c *storedCitizen) OwnerOf(opts *bind.CallOpts, id *big.Int) (common.Address, error) {
+	return common.Address{}, errors.New("execution reverted")
+}
+
+func (c *storedCitizen) TotalSupply(opts *bind.CallOpts) (*big.Int, error) {
+	return new(big.Int), nil
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/NT-community/citizen-gen/erc721"
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// ErrOffline is returned by the snapshot backend for anything that would
+// need a live chain.
+var ErrOffline = errors.New("not available in offline mode")
+
+// SnapshotEntry is one line of a metadata snapshot.
+type SnapshotEntry struct {
+	Contract common.Address `json:"contract"`
+	ID       int64          `json:"id"`
+	TokenURI string         `json:"token_uri"`
+}
+
+// snapshotContract is a contract whose tokenURIs are exported.
+type snapshotContract struct {
+	Name    string
+	Address common.Address
+}
+
+// snapshotContracts lists the citizen contracts of both seasons and,
+// optionally, every parts contract.
+func snapshotContracts(parts bool) []snapshotContract {
+	var contracts []snapshotContract
+
+	for _, name := range []string{"S1_CONTRACT", "S1V2_CONTRACT", "S2_CONTRACT", "S2V2_CONTRACT"} {
+		if addr := os.Getenv(name); addr != "" {
+			contracts = append(contracts, snapshotContract{strings.ToLower(name), common.HexToAddress(addr)})
+		}
+	}
+
+	if !parts {
+		return contracts
+	}
+
+	// identity and id share a contract, only export it once
+	seen := map[common.Address]bool{}
+	for _, set := range []map[int]map[string]string{PartsContracts, LegacyPartsContracts} {
+		for season, byPart := range set {
+			for part, addr := range byPart {
+				address := common.HexToAddress(addr)
+				if !seen[address] {
+					seen[address] = true
+					contracts = append(contracts, snapshotContract{fmt.Sprintf("s%d %s", season, part), address})
+				}
+			}
+		}
+	}
+
+	sort.Slice(contracts, func(i, j int) bool {
+		return contracts[i].Name < contracts[j].Name
+	})
+	return contracts
+}
+
+// runExportMetadata implements the "export-metadata" command, which writes
+// the tokenURI of every token in a range to a JSONL snapshot.
+func runExportMetadata(args []string) {
+	flags := flag.NewFlagSet("export-metadata", flag.ExitOnError)
+	out := flags.String("out", "metadata.jsonl", "snapshot file to write")
+	from := flags.Int64("from", 0, "first token id")
+	to := flags.Int64("to", 0, "last token id (inclusive)")
+	parts := flags.Bool("parts", true, "also export the parts contracts")
+	workers := flags.Int("workers", 4, "concurrent multicall batches")
+	flags.Parse(args)
+
+	if *to < *from {
+		log.Fatalln("-to must be at least -from")
+	}
+
+	client, err := NewMultiBackendFromEnv()
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	f, err := os.Create(*out)
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	encoder := json.NewEncoder(w)
+
+	batcher := NewTokenURIBatcher(client)
+	batcher.Workers = *workers
+
+	for _, c := range snapshotContracts(*parts) {
+		entries, err := exportTokenURIs(batcher, c.Address, *from, *to)
+
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		for _, entry := range entries {
+			if err := encoder.Encode(entry); err != nil {
+				log.Fatalln(err)
+			}
+		}
+
+		log.Printf("%s (%s): exported %d tokens", c.Name, c.Address.Hex(), len(entries))
+	}
+
+	if err := w.Flush(); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// exportTokenURIs calls tokenURI for every id in [from, to]. Ids the
+// contract doesn't know are skipped, any other failure fails the export.
+func exportTokenURIs(batcher *TokenURIBatcher, address common.Address, from, to int64) ([]SnapshotEntry, error) {
+	calls := make([]TokenURICall, 0, to-from+1)
+	for id := from; id <= to; id++ {
+		calls = append(calls, TokenURICall{Contract: address, ID: big.NewInt(id)})
+	}
+
+	results, err := batcher.TokenURIs(context.Background(), calls, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []SnapshotEntry
+	for i, result := range results {
+		if errors.Is(result.Err, ErrCallFailed) {
+			continue
+		} else if result.Err != nil {
+			return nil, fmt.Errorf("token %d: %w", from+int64(i), result.Err)
+		}
+
+		entries = append(entries, SnapshotEntry{address, from + int64(i), result.URI})
+	}
+	return entries, nil
+}
+
+// SnapshotBackend answers tokenURI calls from a metadata snapshot. It
+// implements bind.ContractBackend so the erc721 bindings work unchanged on
+// top of it; every other chain access fails with ErrOffline.
+type SnapshotBackend struct {
+	abi       abi.ABI
+	tokenURIs map[common.Address]map[int64]string
+}
+
+var _ bind.ContractBackend = (*SnapshotBackend)(nil)
+
+// LoadSnapshot reads a snapshot written by the export-metadata command.
+func LoadSnapshot(path string) (*SnapshotBackend, error) {
+	parsed, err := erc721.Erc721MetaData.GetAbi()
+
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	backend := &SnapshotBackend{
+		abi:       *parsed,
+		tokenURIs: map[common.Address]map[int64]string{},
+	}
+
+	scanner := bufio.NewScanner(f)
+	// on-chain SVGs make for long lines
+	scanner.Buffer(make([]byte, 0, 1<<20), 64<<20)
+
+	for line := 1; scanner.Scan(); line++ {
+		var entry SnapshotEntry
+
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+
+		if backend.tokenURIs[entry.Contract] == nil {
+			backend.tokenURIs[entry.Contract] = map[int64]string{}
+		}
+		backend.tokenURIs[entry.Contract][entry.ID] = entry.TokenURI
+	}
+
+	return backend, scanner.Err()
+}
+
+func (s *SnapshotBackend) CodeAt(ctx context.Context, contract common.Address, blockNumber *big.Int) ([]byte, error) {
+	if _, ok := s.tokenURIs[contract]; ok {
+		return []byte{0x00}, nil
+	}
+	return nil, nil
+}
+
+func (s *SnapshotBackend) CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	if call.To == nil || len(call.Data) < 4 {
+		return nil, ErrOffline
+	}
+
+	if blockNumber != nil {
+		return nil, fmt.Errorf("%w: the snapshot only has the latest metadata", ErrOffline)
+	}
+
+	method, err := s.abi.MethodById(call.Data[:4])
+
+	if err != nil || method.Name != "tokenURI" {
+		return nil, fmt.Errorf("%w: only tokenURI calls are in the snapshot", ErrOffline)
+	}
+
+	args, err := method.Inputs.Unpack(call.Data[4:])
+
+	if err != nil {
+		return nil, err
+	}
+
+	id := args[0].(*big.Int)
+	uri, ok := "", false
+
+	if id.IsInt64() {
+		uri, ok = s.tokenURIs[*call.To][id.Int64()]
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("execution reverted: token %s of %s is not in the snapshot", id, call.To.Hex())
+	}
+
+	return method.Outputs.Pack(uri)
+}
+
+func (s *SnapshotBackend) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	return nil, ErrOffline
+}
+
+func (s *SnapshotBackend) PendingCodeAt(ctx context.Context, account common.Address) ([]byte, error) {
+	return nil, ErrOffline
+}
+
+func (s *SnapshotBackend) PendingNonceAt(ctx context.Context, account common.Address) (uint64, error) {
+	return 0, ErrOffline
+}
+
+func (s *SnapshotBackend) SuggestGasPrice(ctx context.Context) (*big.Int, error) {
+	return nil, ErrOffline
+}
+
+func (s *SnapshotBackend) SuggestGasTipCap(ctx context.Context) (*big.Int, error) {
+	return nil, ErrOffline
+}
+
+func (s *SnapshotBackend) EstimateGas(ctx context.Context, call ethereum.CallMsg) (uint64, error) {
+	return 0, ErrOffline
+}
+
+func (s *SnapshotBackend) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	return ErrOffline
+}
+
+func (s *SnapshotBackend) FilterLogs(ctx context.Context, query ethereum.FilterQuery) ([]types.Log, error) {
+	return nil, ErrOffline
+}
+
+func (s *SnapshotBackend) SubscribeFilterLogs(ctx context.Context, query ethereum.FilterQuery, ch chan<- types.Log) (ethereum.Subscription, error) {
+	return nil, ErrOffline
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/color"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/labstack/echo/v4"
+)
+
+// MaxDimension bounds the width and height of a render.
+const MaxDimension = 4096
+
+// CropMode selects which part of the composed citizen ends up in the output.
+type CropMode string
+
+const (
+	CropNone    CropMode = ""
+	CropPFP     CropMode = "pfp"     // 640x640 crop around the head
+	CropPreview CropMode = "preview" // same crop, without the background layer
+)
+
+// FitMode is how the square composition is scaled to dimensions of another
+// aspect ratio.
+type FitMode string
+
+const (
+	FitStretch FitMode = ""        // scale each axis on its own
+	FitContain FitMode = "contain" // keep the aspect ratio, centered and letterboxed with the background
+	FitCover   FitMode = "cover"   // keep the aspect ratio, cropping what overflows
+	FitPad     FitMode = "pad"     // contain, placed against the anchor
+)
+
+// Anchor is the part of the citizen kept in view by FitCover, and the
+// edge FitPad places it against.
+type Anchor string
+
+const (
+	AnchorCenter Anchor = ""
+	AnchorHead   Anchor = "head"
+	AnchorFeet   Anchor = "feet"
+)
+
+// Padding is a safe area in pixels around the citizen, filled with the
+// background. The fit applies to the box inside it.
+type Padding struct {
+	Top    int `json:"top,omitempty"`
+	Right  int `json:"right,omitempty"`
+	Bottom int `json:"bottom,omitempty"`
+	Left   int `json:"left,omitempty"`
+}
+
+// parsePadding reads "all", "vertical,horizontal" or
+// "top,right,bottom,left", like CSS.
+func parsePadding(str string) (*Padding, error) {
+	var values []int
+
+	for _, part := range strings.Split(str, ",") {
+		v, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("invalid padding %q", str)
+		}
+		values = append(values, v)
+	}
+
+	switch len(values) {
+	case 1:
+		return &Padding{values[0], values[0], values[0], values[0]}, nil
+	case 2:
+		return &Padding{values[0], values[1], values[0], values[1]}, nil
+	case 4:
+		return &Padding{values[0], values[1], values[2], values[3]}, nil
+	}
+	return nil, fmt.Errorf("invalid padding %q, expected 1, 2 or 4 values", str)
+}
+
+const (
+	GenderDefault = ""
+	GenderFemale  = "female"
+)
+
+// Accessories that can be drawn on top of a citizen.
+const (
+	AccessorySantaHat = "santa-hat"
+	AccessorySnowball = "snowball"
+)
+
+var knownAccessories = map[string]bool{
+	AccessorySantaHat: true,
+	AccessorySnowball: true,
+}
+
+// Background controls what is drawn behind the citizen. Color is a
+// lowercase 6 digit hex string and takes precedence over the trait
+// background; None leaves the background transparent.
+type Background struct {
+	None  bool   `json:"none,omitempty"`
+	Color string `json:"color,omitempty"`
+}
+
+// RGBA returns the parsed background color, or nil when none is set.
+func (b Background) RGBA() *color.RGBA {
+	if b.Color == "" {
+		return nil
+	}
+	parsed, _ := validateBGColor(b.Color)
+	return parsed
+}
+
+// RenderSpec is the canonical description of a single render. Every option
+// affecting the output lives here, so the cache key derived from it is
+// complete by construction.
+type RenderSpec struct {
+	Season  int      `json:"season"`
+	TokenID int      `json:"id"`
+	Width   int      `json:"width"`
+	Height  int      `json:"height"`
+	Crop    CropMode `json:"crop,omitempty"`
+	Fit     FitMode  `json:"fit,omitempty"`
+	Anchor  Anchor   `json:"anchor,omitempty"`
+	// IntegerScale snaps the scale of the fit to a whole multiple or
+	// fraction, keeping the pixel art crisp.
+	IntegerScale bool       `json:"integer_scale,omitempty"`
+	Padding      *Padding   `json:"padding,omitempty"`
+	Background   Background `json:"background"`
+	Accessories  []string   `json:"accessories,omitempty"`
+	// HiddenLayers lists trait categories ("weapon", "helm", ...) left out
+	// of the composition. Each has to be the category of one of the
+	// citizen's layers, see checkHiddenLayers.
+	HiddenLayers []string `json:"hidden_layers,omitempty"`
+	Gender       string   `json:"gender,omitempty"`
+	NoClothes    bool     `json:"no_clothes,omitempty"`
+	Format       string   `json:"format"`
+	// Quality and Compression are the options of the JPEG and PNG formats.
+	Quality     *int   `json:"quality,omitempty"`
+	Compression string `json:"compression,omitempty"`
+	// Block renders the citizen from its metadata as of that block; 0 is
+	// the latest block.
+	Block uint64 `json:"block,omitempty"`
+}
+
+// ParseRenderSpec reads a RenderSpec from the parameters and query string
+// of the citizen routes.
+func ParseRenderSpec(c echo.Context, season int) (*RenderSpec, error) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return nil, err
+	}
+
+	enc, err := NegotiateEncoding(c, true)
+	if err != nil {
+		return nil, err
+	}
+
+	spec := &RenderSpec{
+		Season:      season,
+		TokenID:     id,
+		Format:      enc.Format,
+		Quality:     enc.Quality,
+		Compression: enc.Compression,
+	}
+
+	if err := spec.setDimensions(c.Param("dimensions")); err != nil {
+		return nil, err
+	}
+
+	// these override what a preset set
+	if fit := c.QueryParam("fit"); fit != "" {
+		spec.Fit = FitMode(fit)
+	}
+
+	if anchor := c.QueryParam("anchor"); anchor != "" {
+		spec.Anchor = Anchor(anchor)
+	}
+
+	if integer := c.QueryParam("integer"); integer != "" {
+		if spec.IntegerScale, err = strconv.ParseBool(integer); err != nil {
+			return nil, fmt.Errorf("invalid integer %q", integer)
+		}
+	}
+
+	if padding := c.QueryParam("padding"); padding != "" {
+		if spec.Padding, err = parsePadding(padding); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.QueryParam("crop_preview") != "" {
+		// Crop preview is a special flag that will generate 640x640 PFP cropped image
+		spec.Crop = CropPreview
+	}
+
+	spec.Background.None = c.QueryParam("no-bg") != ""
+
+	if bgColorHex := c.QueryParam("bg-color"); bgColorHex != "" {
+		parsed, err := validateBGColor(bgColorHex)
+		if err != nil {
+			return nil, err
+		}
+		spec.Background.Color = colorHex(parsed)
+	}
+
+	if c.QueryParam("santa-hat") != "" {
+		spec.Accessories = append(spec.Accessories, AccessorySantaHat)
+	}
+
+	if c.QueryParam("snowball") != "" {
+		spec.Accessories = append(spec.Accessories, AccessorySnowball)
+	}
+
+	// a citizen that was forced to be rendered using female traits
+	if c.QueryParam("female") != "" {
+		spec.Gender = GenderFemale
+	}
+
+	spec.NoClothes = c.QueryParam("no-clothes") != ""
+
+	if block := c.QueryParam("block"); block != "" {
+		if spec.Block, err = strconv.ParseUint(block, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid block %q", block)
+		}
+	}
+
+	return spec, spec.Validate()
+}
+
+// setDimensions parses a "WxH" string, the "pfp" shortcut or the name of a
+// preset.
+func (s *RenderSpec) setDimensions(dimensions string) error {
+	if strings.ToLower(dimensions) == "pfp" {
+		s.Crop = CropPFP
+		return nil
+	}
+
+	if preset, ok := lookupPreset(strings.ToLower(dimensions)); ok {
+		preset.apply(s)
+		return nil
+	}
+
+	whArray := strings.Split(dimensions, "x")
+
+	if len(whArray) != 2 {
+		return errors.New("invalid length")
+	}
+
+	width, err := strconv.Atoi(whArray[0])
+	if err != nil {
+		return err
+	}
+
+	height, err := strconv.Atoi(whArray[1])
+	if err != nil {
+		return err
+	}
+
+	s.Width, s.Height = width, height
+	return nil
+}
+
+// Validate checks the spec and normalizes it so that equivalent specs
+// produce the same cache key.
+func (s *RenderSpec) Validate() error {
+	if _, ok := IPFSBuckets[s.Season]; !ok {
+		return fmt.Errorf("unknown season %d", s.Season)
+	}
+
+	if s.TokenID < 0 {
+		return errors.New("token id must not be negative")
+	}
+
+	switch s.Crop {
+	case CropNone:
+		if s.Width <= 0 || s.Height <= 0 || s.Width > MaxDimension || s.Height > MaxDimension {
+			return fmt.Errorf("dimensions must be between 1 and %d", MaxDimension)
+		}
+	case CropPFP, CropPreview:
+		// the crop always produces a fixed size image
+		s.Width, s.Height = 640, 640
+		s.Fit, s.Anchor, s.IntegerScale, s.Padding = FitStretch, AnchorCenter, false, nil
+	default:
+		return fmt.Errorf("unknown crop %q", s.Crop)
+	}
+
+	if p := s.Padding; p != nil {
+		if p.Top < 0 || p.Right < 0 || p.Bottom < 0 || p.Left < 0 {
+			return errors.New("padding must not be negative")
+		}
+
+		if width, height := s.contentSize(); width < 1 || height < 1 {
+			return errors.New("padding leaves no room for the citizen")
+		}
+
+		if *p == (Padding{}) {
+			s.Padding = nil
+		}
+	}
+
+	switch s.Fit = FitMode(strings.ToLower(string(s.Fit))); s.Fit {
+	case "stretch":
+		s.Fit = FitStretch
+	case FitStretch, FitContain, FitCover, FitPad:
+	default:
+		return fmt.Errorf("unknown fit %q, expected stretch, contain, cover or pad", s.Fit)
+	}
+
+	switch s.Anchor = Anchor(strings.ToLower(string(s.Anchor))); s.Anchor {
+	case "center":
+		s.Anchor = AnchorCenter
+	case AnchorCenter, AnchorHead, AnchorFeet:
+	default:
+		return fmt.Errorf("unknown anchor %q, expected center, head or feet", s.Anchor)
+	}
+
+	// options that don't change the render are dropped
+	if s.Fit == FitStretch || s.Fit == FitContain {
+		s.Anchor = AnchorCenter
+	}
+	if s.Fit == FitStretch {
+		s.IntegerScale = false
+	}
+
+	if s.Background.Color != "" {
+		parsed, err := validateBGColor(s.Background.Color)
+		if err != nil {
+			return err
+		}
+		s.Background.Color = colorHex(parsed)
+	}
+
+	s.Accessories = normalizeList(s.Accessories)
+	for _, accessory := range s.Accessories {
+		if !knownAccessories[accessory] {
+			return fmt.Errorf("unknown accessory %q", accessory)
+		}
+	}
+
+	s.HiddenLayers = normalizeList(s.HiddenLayers)
+
+	s.Gender = strings.ToLower(s.Gender)
+	if s.Gender != GenderDefault && s.Gender != GenderFemale {
+		return fmt.Errorf("unknown gender %q", s.Gender)
+	}
+
+	enc := s.Encoding()
+	if err := enc.normalize(true); err != nil {
+		return err
+	}
+	s.Format, s.Quality, s.Compression = enc.Format, enc.Quality, enc.Compression
+
+	// the SVG only references the layers, there are no pixels to crop or
+	// draw on
+	if s.Format == FormatSVG && (s.Crop != CropNone || len(s.Accessories) > 0) {
+		return errors.New("svg renders support neither crops nor accessories")
+	}
+
+	if s.Format == FormatSVG && (s.Fit == FitPad || s.Padding != nil) {
+		return errors.New("svg renders can't be padded, use contain")
+	}
+
+	return nil
+}
+
+// Encoding returns the output format of the spec.
+func (s *RenderSpec) Encoding() Encoding {
+	return Encoding{Format: s.Format, Quality: s.Quality, Compression: s.Compression}
+}
+
+// contentSize is the size of the box inside the padding.
+func (s *RenderSpec) contentSize() (width, height int) {
+	if p := s.Padding; p != nil {
+		return s.Width - p.Left - p.Right, s.Height - p.Top - p.Bottom
+	}
+	return s.Width, s.Height
+}
+
+// pads reports whether the render is drawn on a background of its full
+// size rather than being the scaled composition.
+func (s *RenderSpec) pads() bool {
+	return s.Fit == FitContain || s.Fit == FitPad || s.Padding != nil
+}
+
+// FitSize returns the size a size x size composition is scaled to by the
+// fit, before any cropping or padding.
+func (s *RenderSpec) FitSize(size int) (width, height int) {
+	contentWidth, contentHeight := s.contentSize()
+
+	if s.Fit == FitStretch {
+		return contentWidth, contentHeight
+	}
+
+	sx, sy := float64(contentWidth)/float64(size), float64(contentHeight)/float64(size)
+	scale := math.Min(sx, sy)
+
+	if s.Fit == FitCover {
+		scale = math.Max(sx, sy)
+	}
+
+	if s.IntegerScale {
+		scale = snapScale(scale, s.Fit == FitCover)
+	}
+
+	scaled := max(int(math.Round(float64(size)*scale)), 1)
+	return scaled, scaled
+}
+
+// snapScale rounds scale to a whole multiple or fraction, up when the
+// result has to cover and down when it has to fit.
+func snapScale(scale float64, up bool) float64 {
+	round := math.Floor
+	if up {
+		round = math.Ceil
+	}
+
+	if scale >= 1 {
+		return math.Max(round(scale), 1)
+	}
+
+	// fractions round the other way
+	if up {
+		round = math.Floor
+	} else {
+		round = math.Ceil
+	}
+	return 1 / math.Max(round(1/scale), 1)
+}
+
+// CallOpts returns the options to read the spec's metadata with.
+func (s *RenderSpec) CallOpts(ctx context.Context) *bind.CallOpts {
+	opts := &bind.CallOpts{Context: ctx}
+	if s.Block != 0 {
+		opts.BlockNumber = new(big.Int).SetUint64(s.Block)
+	}
+	return opts
+}
+
+// HasAccessory reports whether the named accessory was requested.
+func (s *RenderSpec) HasAccessory(name string) bool {
+	for _, accessory := range s.Accessories {
+		if accessory == name {
+			return true
+		}
+	}
+	return false
+}
+
+// HidesLayer reports whether layers of the given trait category are hidden.
+func (s *RenderSpec) HidesLayer(category string) bool {
+	for _, hidden := range s.HiddenLayers {
+		if hidden == category {
+			return true
+		}
+	}
+	return false
+}
+
+// CacheKey returns a stable key for the spec. Renders of the same token
+// share a "s<season>/<id>/" prefix; the rest is a hash of the canonical
+// JSON encoding of the spec.
+func (s *RenderSpec) CacheKey() string {
+	canonical, _ := json.Marshal(s)
+	sum := sha256.Sum256(canonical)
+	return fmt.Sprintf("s%d/%d/%s.%s", s.Season, s.TokenID, hex.EncodeToString(sum[:16]), s.Format)
+}
+
+// normalizeList lowercases, deduplicates and sorts a list of names.
+func normalizeList(list []string) []string {
+	seen := map[string]bool{}
+	var normalized []string
+	for _, item := range list {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if item != "" && !seen[item] {
+			seen[item] = true
+			normalized = append(normalized, item)
+		}
+	}
+	sort.Strings(normalized)
+	return normalized
+}
+
+func colorHex(c *color.RGBA) string {
+	return fmt.Sprintf("%02x%02x%02x", c.R, c.G, c.B)
+}
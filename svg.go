@@ -0,0 +1,1254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-fonts/liberation/liberationmonobold"
+	"github.com/go-fonts/liberation/liberationmonobolditalic"
+	"github.com/go-fonts/liberation/liberationmonoitalic"
+	"github.com/go-fonts/liberation/liberationmonoregular"
+	"github.com/go-fonts/liberation/liberationsansbold"
+	"github.com/go-fonts/liberation/liberationsansbolditalic"
+	"github.com/go-fonts/liberation/liberationsansitalic"
+	"github.com/go-fonts/liberation/liberationsansregular"
+	"github.com/go-fonts/liberation/liberationserifbold"
+	"github.com/go-fonts/liberation/liberationserifbolditalic"
+	"github.com/go-fonts/liberation/liberationserifitalic"
+	"github.com/go-fonts/liberation/liberationserifregular"
+	"github.com/tdewolff/canvas"
+	"github.com/tdewolff/canvas/renderers/rasterizer"
+	"golang.org/x/image/colornames"
+)
+
+// ErrUnsupportedSVG is returned, along with a best effort render, for SVGs
+// using features RasterizeSVG can't draw such as gradients or filters.
+var ErrUnsupportedSVG = errors.New("unsupported SVG feature")
+
+var (
+	svgNumberRegex     = regexp.MustCompile(`[-+]?(?:\d+\.?\d*|\.\d+)(?:[eE][-+]?\d+)?`)
+	svgTransformRegex  = regexp.MustCompile(`([a-zA-Z]+)\s*\(([^)]*)\)`)
+	svgSelectorRegex   = regexp.MustCompile(`^([a-zA-Z][\w-]*|\*)?((?:[.#][\w-]+)*)$`)
+	svgSimpleRegex     = regexp.MustCompile(`[.#][\w-]+`)
+	svgWhitespaceRegex = regexp.MustCompile(`[ \t\r\n]+`)
+)
+
+var (
+	svgFontsOnce sync.Once
+	svgFonts     map[string]*canvas.FontFamily
+	svgFontsErr  error
+)
+
+// loadSVGFonts loads the embedded Liberation fonts, which have the metrics
+// of Times New Roman, Arial and Courier New, so text is laid out as in a
+// browser without any fonts being installed.
+func loadSVGFonts() (map[string]*canvas.FontFamily, error) {
+	svgFontsOnce.Do(func() {
+		families := map[string][4][]byte{
+			"serif":      {liberationserifregular.TTF, liberationserifbold.TTF, liberationserifitalic.TTF, liberationserifbolditalic.TTF},
+			"sans-serif": {liberationsansregular.TTF, liberationsansbold.TTF, liberationsansitalic.TTF, liberationsansbolditalic.TTF},
+			"monospace":  {liberationmonoregular.TTF, liberationmonobold.TTF, liberationmonoitalic.TTF, liberationmonobolditalic.TTF},
+		}
+		styles := [4]canvas.FontStyle{canvas.FontRegular, canvas.FontBold, canvas.FontItalic, canvas.FontBold | canvas.FontItalic}
+
+		fonts := map[string]*canvas.FontFamily{}
+
+		for name, ttfs := range families {
+			family := canvas.NewFontFamily(name)
+
+			for i, ttf := range ttfs {
+				if err := family.LoadFont(ttf, 0, styles[i]); err != nil {
+					svgFontsErr = fmt.Errorf("load %s font: %w", name, err)
+					return
+				}
+			}
+
+			fonts[name] = family
+		}
+
+		svgFonts = fonts
+	})
+
+	return svgFonts, svgFontsErr
+}
+
+// genericFontFamily maps a font-family list to the embedded font standing in
+// for it.
+func genericFontFamily(value string) string {
+	for _, name := range strings.Split(value, ",") {
+		switch strings.ToLower(strings.Trim(strings.TrimSpace(name), `"'`)) {
+		case "serif", "times", "times new roman", "georgia", "liberation serif":
+			return "serif"
+		case "sans-serif", "arial", "helvetica", "verdana", "tahoma", "system-ui", "liberation sans":
+			return "sans-serif"
+		case "monospace", "courier", "courier new", "menlo", "consolas", "liberation mono":
+			return "monospace"
+		}
+	}
+	// what browsers fall back to
+	return "serif"
+}
+
+type svgNode struct {
+	Tag   string
+	Attrs map[string]string
+	// Text is the character data of text nodes, which have no tag.
+	Text     string
+	Children []*svgNode
+}
+
+func parseSVGTree(data []byte) (*svgNode, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+
+	var (
+		root  *svgNode
+		stack []*svgNode
+	)
+
+	for {
+		token, err := decoder.Token()
+
+		if err != nil {
+			// unclosed elements are drawn as far as they go, like browsers do
+			if root != nil && errors.Is(err, io.EOF) {
+				return root, nil
+			}
+			return nil, fmt.Errorf("parse SVG: %w", err)
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			node := &svgNode{Tag: t.Name.Local, Attrs: map[string]string{}}
+			for _, attr := range t.Attr {
+				node.Attrs[attr.Name.Local] = attr.Value
+			}
+
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.Children = append(parent.Children, node)
+			} else if root == nil {
+				if node.Tag != "svg" {
+					return nil, fmt.Errorf("parse SVG: root element is <%s>", node.Tag)
+				}
+				root = node
+			}
+
+			stack = append(stack, node)
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.Children = append(parent.Children, &svgNode{Text: string(t)})
+			}
+		}
+	}
+}
+
+// svgViewport is the size of an SVG in pixels and the view box drawn into
+// it.
+type svgViewport struct {
+	Width, Height float64
+	ViewBox       [4]float64
+	HasViewBox    bool
+}
+
+func parseSVGViewport(root *svgNode) svgViewport {
+	var vp svgViewport
+
+	if numbers := svgNumbers(root.Attrs["viewBox"]); len(numbers) == 4 && numbers[2] > 0 && numbers[3] > 0 {
+		copy(vp.ViewBox[:], numbers)
+		vp.HasViewBox = true
+	}
+
+	width, widthOk := parseSVGLength(root.Attrs["width"], 0, 16)
+	height, heightOk := parseSVGLength(root.Attrs["height"], 0, 16)
+
+	switch {
+	case widthOk && heightOk:
+	case vp.HasViewBox && widthOk:
+		height = width * vp.ViewBox[3] / vp.ViewBox[2]
+	case vp.HasViewBox && heightOk:
+		width = height * vp.ViewBox[2] / vp.ViewBox[3]
+	case vp.HasViewBox:
+		width, height = vp.ViewBox[2], vp.ViewBox[3]
+	default:
+		// the default size of replaced elements
+		width, height = 300, 150
+	}
+
+	vp.Width, vp.Height = width, height
+	return vp
+}
+
+// SVGSize returns the size of an SVG in pixels.
+func SVGSize(data []byte) (float64, float64, error) {
+	root, err := parseSVGTree(data)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	vp := parseSVGViewport(root)
+	return vp.Width, vp.Height, nil
+}
+
+// RasterizeSVG draws an SVG scale times its size. It handles the shapes,
+// paths, text, images, transforms and CSS class rules of on-chain art;
+// when anything else is used, the image is still returned along with an
+// error wrapping ErrUnsupportedSVG.
+func RasterizeSVG(ctx context.Context, data []byte, scale float64) (image.Image, error) {
+	return rasterizeSVG(ctx, data, scale, 0)
+}
+
+func rasterizeSVG(ctx context.Context, data []byte, scale float64, depth int) (image.Image, error) {
+	root, err := parseSVGTree(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	fonts, err := loadSVGFonts()
+
+	if err != nil {
+		return nil, err
+	}
+
+	vp := parseSVGViewport(root)
+
+	if width, height := vp.Width*scale, vp.Height*scale; width < 1 || height < 1 || width > MaxDimension || height > MaxDimension {
+		return nil, fmt.Errorf("SVG would be %.0fx%.0f, the maximum is %d in either direction", width, height, MaxDimension)
+	}
+
+	r := &svgRenderer{
+		ctx:         ctx,
+		canvas:      canvas.New(vp.Width, vp.Height),
+		fonts:       fonts,
+		scale:       scale,
+		depth:       depth,
+		unsupported: map[string]bool{},
+		viewport:    [2]float64{vp.Width, vp.Height},
+	}
+
+	r.collectStyles(root)
+
+	// canvas has its origin at the bottom left
+	m := canvas.Identity.ReflectYAbout(vp.Height / 2)
+
+	if vp.HasViewBox {
+		m = m.Mul(fitViewBox(vp.ViewBox, vp.Width, vp.Height, root.Attrs["preserveAspectRatio"]))
+		r.viewport = [2]float64{vp.ViewBox[2], vp.ViewBox[3]}
+	}
+
+	r.drawChildren(root, defaultSVGStyle(), m)
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	img := rasterizer.Draw(r.canvas, canvas.DPMM(scale), canvas.DefaultColorSpace)
+
+	if len(r.unsupported) > 0 {
+		features := make([]string, 0, len(r.unsupported))
+		for feature := range r.unsupported {
+			features = append(features, feature)
+		}
+		sort.Strings(features)
+
+		return img, fmt.Errorf("%w: %s", ErrUnsupportedSVG, strings.Join(features, ", "))
+	}
+
+	return img, nil
+}
+
+// fitViewBox maps a view box onto a width x height viewport following
+// preserveAspectRatio.
+func fitViewBox(viewBox [4]float64, width, height float64, preserveAspectRatio string) canvas.Matrix {
+	sx, sy := width/viewBox[2], height/viewBox[3]
+
+	fields := strings.Fields(preserveAspectRatio)
+	align, slice := "xMidYMid", false
+
+	if len(fields) > 0 {
+		align = fields[0]
+	}
+	if len(fields) > 1 {
+		slice = fields[1] == "slice"
+	}
+
+	if align == "none" {
+		return canvas.Identity.Scale(sx, sy).Translate(-viewBox[0], -viewBox[1])
+	}
+
+	s := math.Min(sx, sy)
+	if slice {
+		s = math.Max(sx, sy)
+	}
+
+	tx, ty := 0.0, 0.0
+
+	switch {
+	case strings.HasPrefix(align, "xMid"):
+		tx = (width - viewBox[2]*s) / 2
+	case strings.HasPrefix(align, "xMax"):
+		tx = width - viewBox[2]*s
+	}
+
+	switch {
+	case strings.HasSuffix(align, "YMid"):
+		ty = (height - viewBox[3]*s) / 2
+	case strings.HasSuffix(align, "YMax"):
+		ty = height - viewBox[3]*s
+	}
+
+	return canvas.Identity.Translate(tx, ty).Scale(s, s).Translate(-viewBox[0], -viewBox[1])
+}
+
+// svgStyle is the computed style of an element. Colors are nil for none.
+type svgStyle struct {
+	Color         color.NRGBA
+	Fill, Stroke  *color.NRGBA
+	FillOpacity   float64
+	StrokeOpacity float64
+	StrokeWidth   float64
+	LineCap       canvas.Capper
+	LineJoin      canvas.Joiner
+	EvenOdd       bool
+	FontFamily    string
+	FontSize      float64
+	Bold, Italic  bool
+	TextAnchor    string
+	Hidden        bool
+
+	// opacity and display aren't inherited, opacity is multiplied into the
+	// opacity of the children instead
+	Opacity float64
+	Display string
+}
+
+func defaultSVGStyle() svgStyle {
+	black := color.NRGBA{A: 255}
+
+	return svgStyle{
+		Color:         black,
+		Fill:          &black,
+		FillOpacity:   1,
+		StrokeOpacity: 1,
+		StrokeWidth:   1,
+		LineCap:       canvas.ButtCap,
+		LineJoin:      canvas.MiterClipJoin(canvas.BevelJoin, 4),
+		FontFamily:    "serif",
+		FontSize:      16,
+		TextAnchor:    "start",
+		Opacity:       1,
+	}
+}
+
+type cssRule struct {
+	Tag         string
+	ID          string
+	Classes     []string
+	Specificity int
+	Order       int
+	Decls       [][2]string
+}
+
+func (rule cssRule) matches(node *svgNode) bool {
+	if rule.Tag != "" && rule.Tag != "*" && rule.Tag != node.Tag {
+		return false
+	}
+
+	if rule.ID != "" && rule.ID != node.Attrs["id"] {
+		return false
+	}
+
+	classes := strings.Fields(node.Attrs["class"])
+
+	for _, class := range rule.Classes {
+		found := false
+		for _, c := range classes {
+			if c == class {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+type svgRenderer struct {
+	ctx    context.Context
+	canvas *canvas.Canvas
+	fonts  map[string]*canvas.FontFamily
+	rules  []cssRule
+	// scale is how many output pixels a user unit of the root has
+	scale float64
+	// depth counts how deep SVG images are nested
+	depth       int
+	unsupported map[string]bool
+	// viewport is the size percentages are relative to, in user units
+	viewport [2]float64
+}
+
+func (r *svgRenderer) unsupportedFeature(feature string) {
+	r.unsupported[feature] = true
+}
+
+func (r *svgRenderer) collectStyles(node *svgNode) {
+	if node.Tag == "style" {
+		var css strings.Builder
+		for _, child := range node.Children {
+			css.WriteString(child.Text)
+		}
+		r.parseCSS(css.String())
+		return
+	}
+
+	for _, child := range node.Children {
+		r.collectStyles(child)
+	}
+}
+
+func (r *svgRenderer) parseCSS(css string) {
+	for {
+		start := strings.Index(css, "/*")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(css[start+2:], "*/")
+		if end < 0 {
+			css = css[:start]
+			break
+		}
+		css = css[:start] + css[start+2+end+2:]
+	}
+
+	for _, block := range strings.Split(css, "}") {
+		selectors, body, ok := strings.Cut(block, "{")
+
+		if !ok {
+			continue
+		}
+
+		if strings.HasPrefix(strings.TrimSpace(selectors), "@") {
+			r.unsupportedFeature("CSS at-rules")
+			continue
+		}
+
+		decls := parseDeclarations(body)
+
+		for _, selector := range strings.Split(selectors, ",") {
+			groups := svgSelectorRegex.FindStringSubmatch(strings.TrimSpace(selector))
+
+			if groups == nil {
+				r.unsupportedFeature("CSS selector " + strings.TrimSpace(selector))
+				continue
+			}
+
+			rule := cssRule{Tag: groups[1], Order: len(r.rules), Decls: decls}
+
+			if rule.Tag != "" && rule.Tag != "*" {
+				rule.Specificity = 1
+			}
+
+			for _, part := range svgSimpleRegex.FindAllString(groups[2], -1) {
+				if part[0] == '#' {
+					rule.ID = part[1:]
+					rule.Specificity += 100
+				} else {
+					rule.Classes = append(rule.Classes, part[1:])
+					rule.Specificity += 10
+				}
+			}
+
+			r.rules = append(r.rules, rule)
+		}
+	}
+}
+
+func parseDeclarations(body string) [][2]string {
+	var decls [][2]string
+
+	for _, decl := range strings.Split(body, ";") {
+		name, value, ok := strings.Cut(decl, ":")
+
+		if !ok {
+			continue
+		}
+
+		value = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(value), "!important"))
+		decls = append(decls, [2]string{strings.ToLower(strings.TrimSpace(name)), value})
+	}
+
+	return decls
+}
+
+// computeStyle applies presentation attributes, then matching CSS rules
+// and then the style attribute on top of the parent's style.
+func (r *svgRenderer) computeStyle(node *svgNode, parent svgStyle) svgStyle {
+	style := parent
+	style.Display = ""
+	own := svgStyle{Opacity: 1}
+
+	apply := func(name, value string) {
+		if name == "opacity" {
+			if v, ok := parseSVGOpacity(value); ok {
+				own.Opacity = v
+			}
+			return
+		}
+		r.applyProperty(&style, parent, name, value)
+	}
+
+	// color goes first as currentColor refers to it
+	applyAll := func(decls [][2]string) {
+		sort.SliceStable(decls, func(i, j int) bool {
+			return decls[i][0] == "color" && decls[j][0] != "color"
+		})
+		for _, decl := range decls {
+			apply(decl[0], decl[1])
+		}
+	}
+
+	attrs := make([][2]string, 0, len(node.Attrs))
+	for name, value := range node.Attrs {
+		attrs = append(attrs, [2]string{name, value})
+	}
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i][0] < attrs[j][0] })
+	applyAll(attrs)
+
+	var rules []cssRule
+	for _, rule := range r.rules {
+		if rule.matches(node) {
+			rules = append(rules, rule)
+		}
+	}
+
+	sort.SliceStable(rules, func(i, j int) bool {
+		if rules[i].Specificity != rules[j].Specificity {
+			return rules[i].Specificity < rules[j].Specificity
+		}
+		return rules[i].Order < rules[j].Order
+	})
+
+	for _, rule := range rules {
+		applyAll(append([][2]string(nil), rule.Decls...))
+	}
+
+	applyAll(parseDeclarations(node.Attrs["style"]))
+
+	style.Opacity = parent.Opacity * own.Opacity
+	return style
+}
+
+var svgFontSizes = map[string]float64{
+	"xx-small": 9, "x-small": 10, "small": 13, "medium": 16,
+	"large": 18, "x-large": 24, "xx-large": 32, "xxx-large": 48,
+}
+
+func (r *svgRenderer) applyProperty(style *svgStyle, parent svgStyle, name, value string) {
+	value = strings.TrimSpace(value)
+
+	if value == "inherit" {
+		return
+	}
+
+	switch name {
+	case "color":
+		if c, ok := r.parsePaint(value, parent.Color); ok && c != nil {
+			style.Color = *c
+		}
+	case "fill":
+		if c, ok := r.parsePaint(value, style.Color); ok {
+			style.Fill = c
+		}
+	case "stroke":
+		if c, ok := r.parsePaint(value, style.Color); ok {
+			style.Stroke = c
+		}
+	case "fill-opacity":
+		if v, ok := parseSVGOpacity(value); ok {
+			style.FillOpacity = v
+		}
+	case "stroke-opacity":
+		if v, ok := parseSVGOpacity(value); ok {
+			style.StrokeOpacity = v
+		}
+	case "stroke-width":
+		if v, ok := parseSVGLength(value, math.Hypot(r.viewport[0], r.viewport[1])/math.Sqrt2, parent.FontSize); ok && v >= 0 {
+			style.StrokeWidth = v
+		}
+	case "stroke-linecap":
+		switch value {
+		case "butt":
+			style.LineCap = canvas.ButtCap
+		case "round":
+			style.LineCap = canvas.RoundCap
+		case "square":
+			style.LineCap = canvas.SquareCap
+		}
+	case "stroke-linejoin":
+		switch value {
+		case "miter":
+			style.LineJoin = canvas.MiterClipJoin(canvas.BevelJoin, 4)
+		case "round":
+			style.LineJoin = canvas.RoundJoin
+		case "bevel":
+			style.LineJoin = canvas.BevelJoin
+		}
+	case "stroke-dasharray":
+		if value != "none" {
+			r.unsupportedFeature("stroke-dasharray")
+		}
+	case "fill-rule":
+		style.EvenOdd = value == "evenodd"
+	case "font-family":
+		style.FontFamily = genericFontFamily(value)
+	case "font-size":
+		if size, ok := svgFontSizes[value]; ok {
+			style.FontSize = size
+		} else if v, ok := parseSVGLength(value, parent.FontSize, parent.FontSize); ok && v > 0 {
+			style.FontSize = v
+		}
+	case "font-weight":
+		switch value {
+		case "bold", "bolder":
+			style.Bold = true
+		case "normal", "lighter":
+			style.Bold = false
+		default:
+			if weight, err := strconv.Atoi(value); err == nil {
+				style.Bold = weight >= 600
+			}
+		}
+	case "font-style":
+		style.Italic = value == "italic" || value == "oblique"
+	case "font":
+		r.applyFontShorthand(style, parent, value)
+	case "text-anchor":
+		style.TextAnchor = value
+	case "visibility":
+		style.Hidden = value == "hidden" || value == "collapse"
+	case "display":
+		style.Display = value
+	case "clip-path", "mask", "filter":
+		if value != "none" {
+			r.unsupportedFeature(name)
+		}
+	}
+}
+
+// applyFontShorthand handles "font: [style] [weight] size[/line-height] family".
+func (r *svgRenderer) applyFontShorthand(style *svgStyle, parent svgStyle, value string) {
+	fields := strings.Fields(value)
+
+	for i, field := range fields {
+		switch {
+		case field == "italic" || field == "oblique":
+			style.Italic = true
+		case field == "bold" || field == "bolder":
+			style.Bold = true
+		case field[0] >= '0' && field[0] <= '9' || svgFontSizes[field] > 0:
+			if weight, err := strconv.Atoi(field); err == nil && len(field) == 3 {
+				style.Bold = weight >= 600
+				continue
+			}
+
+			size, _, _ := strings.Cut(field, "/")
+			r.applyProperty(style, parent, "font-size", size)
+			style.FontFamily = genericFontFamily(strings.Join(fields[i+1:], " "))
+			return
+		}
+	}
+}
+
+// parsePaint parses a color; nil is none. current is what currentColor
+// refers to.
+func (r *svgRenderer) parsePaint(value string, current color.NRGBA) (*color.NRGBA, bool) {
+	value = strings.TrimSpace(value)
+	lower := strings.ToLower(value)
+
+	switch {
+	case lower == "none" || lower == "transparent":
+		return nil, true
+	case lower == "currentcolor":
+		return &current, true
+	case strings.HasPrefix(lower, "url("):
+		// gradients and patterns, drawn with the fallback color if any
+		r.unsupportedFeature("paint servers")
+
+		if _, fallback, ok := strings.Cut(value, ")"); ok && strings.TrimSpace(fallback) != "" {
+			return r.parsePaint(fallback, current)
+		}
+		return nil, true
+	}
+
+	c, ok := parseSVGColor(lower)
+	return &c, ok
+}
+
+func parseSVGColor(value string) (color.NRGBA, bool) {
+	if strings.HasPrefix(value, "#") {
+		hex := value[1:]
+
+		// #rgb and #rgba
+		if len(hex) == 3 || len(hex) == 4 {
+			var expanded strings.Builder
+			for _, c := range hex {
+				expanded.WriteRune(c)
+				expanded.WriteRune(c)
+			}
+			hex = expanded.String()
+		}
+
+		if len(hex) == 6 {
+			hex += "ff"
+		}
+
+		v, err := strconv.ParseUint(hex, 16, 32)
+
+		if len(hex) != 8 || err != nil {
+			return color.NRGBA{}, false
+		}
+
+		return color.NRGBA{uint8(v >> 24), uint8(v >> 16), uint8(v >> 8), uint8(v)}, true
+	}
+
+	if strings.HasPrefix(value, "rgb") {
+		_, args, _ := strings.Cut(value, "(")
+		fields := strings.FieldsFunc(strings.TrimSuffix(args, ")"), func(r rune) bool {
+			return r == ',' || r == ' ' || r == '/'
+		})
+
+		if len(fields) < 3 {
+			return color.NRGBA{}, false
+		}
+
+		c := color.NRGBA{A: 255}
+		channels := []*uint8{&c.R, &c.G, &c.B}
+
+		for i, channel := range channels {
+			field := fields[i]
+			v, err := strconv.ParseFloat(strings.TrimSuffix(field, "%"), 64)
+
+			if err != nil {
+				return color.NRGBA{}, false
+			}
+
+			if strings.HasSuffix(field, "%") {
+				v = v * 255 / 100
+			}
+
+			*channel = uint8(math.Round(math.Max(0, math.Min(255, v))))
+		}
+
+		if len(fields) > 3 {
+			alpha, ok := parseSVGOpacity(fields[3])
+			if !ok {
+				return color.NRGBA{}, false
+			}
+			c.A = uint8(math.Round(alpha * 255))
+		}
+
+		return c, true
+	}
+
+	if c, ok := colornames.Map[value]; ok {
+		return color.NRGBA(c), true
+	}
+
+	return color.NRGBA{}, false
+}
+
+func parseSVGOpacity(value string) (float64, bool) {
+	value = strings.TrimSpace(value)
+	percent := strings.HasSuffix(value, "%")
+
+	v, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+
+	if err != nil {
+		return 0, false
+	}
+
+	if percent {
+		v /= 100
+	}
+
+	return math.Max(0, math.Min(1, v)), true
+}
+
+// parseSVGLength returns a length in user units. Percentages are of ref,
+// ems of fontSize.
+func parseSVGLength(value string, ref, fontSize float64) (float64, bool) {
+	value = strings.TrimSpace(value)
+
+	units := map[string]float64{
+		"px": 1, "pt": 96.0 / 72, "pc": 16, "mm": 96 / 25.4, "cm": 96 / 2.54, "in": 96,
+		"em": fontSize, "ex": fontSize / 2, "%": ref / 100,
+	}
+
+	for suffix, factor := range units {
+		if strings.HasSuffix(value, suffix) {
+			if suffix == "%" && ref == 0 {
+				return 0, false
+			}
+
+			v, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(value, suffix)), 64)
+			return v * factor, err == nil
+		}
+	}
+
+	v, err := strconv.ParseFloat(value, 64)
+	return v, err == nil
+}
+
+func svgNumbers(value string) []float64 {
+	var numbers []float64
+
+	for _, number := range svgNumberRegex.FindAllString(value, -1) {
+		if v, err := strconv.ParseFloat(number, 64); err == nil {
+			numbers = append(numbers, v)
+		}
+	}
+
+	return numbers
+}
+
+func parseSVGTransform(value string) canvas.Matrix {
+	m := canvas.Identity
+
+	for _, groups := range svgTransformRegex.FindAllStringSubmatch(value, -1) {
+		args := svgNumbers(groups[2])
+		arg := func(i int, fallback float64) float64 {
+			if i < len(args) {
+				return args[i]
+			}
+			return fallback
+		}
+
+		switch groups[1] {
+		case "matrix":
+			if len(args) == 6 {
+				m = m.Mul(canvas.Matrix{{args[0], args[2], args[4]}, {args[1], args[3], args[5]}})
+			}
+		case "translate":
+			m = m.Translate(arg(0, 0), arg(1, 0))
+		case "scale":
+			m = m.Scale(arg(0, 1), arg(1, arg(0, 1)))
+		case "rotate":
+			m = m.RotateAbout(arg(0, 0), arg(1, 0), arg(2, 0))
+		case "skewX":
+			m = m.Shear(math.Tan(arg(0, 0)*math.Pi/180), 0)
+		case "skewY":
+			m = m.Shear(0, math.Tan(arg(0, 0)*math.Pi/180))
+		}
+	}
+
+	return m
+}
+
+func (r *svgRenderer) length(node *svgNode, attr string, ref float64, style svgStyle) float64 {
+	v, _ := parseSVGLength(node.Attrs[attr], ref, style.FontSize)
+	return v
+}
+
+func (r *svgRenderer) drawChildren(node *svgNode, style svgStyle, m canvas.Matrix) {
+	for _, child := range node.Children {
+		if child.Tag != "" {
+			r.draw(child, style, m)
+		}
+	}
+}
+
+func (r *svgRenderer) draw(node *svgNode, parent svgStyle, m canvas.Matrix) {
+	if r.ctx.Err() != nil {
+		return
+	}
+
+	style := r.computeStyle(node, parent)
+
+	if style.Display == "none" {
+		return
+	}
+
+	if transform, ok := node.Attrs["transform"]; ok {
+		m = m.Mul(parseSVGTransform(transform))
+	}
+
+	width, height := r.viewport[0], r.viewport[1]
+	diagonal := math.Hypot(width, height) / math.Sqrt2
+
+	switch node.Tag {
+	case "g", "a", "switch":
+		r.drawChildren(node, style, m)
+	case "svg":
+		// nested viewports are only positioned, not clipped
+		m = m.Translate(r.length(node, "x", width, style), r.length(node, "y", height, style))
+		r.drawChildren(node, style, m)
+	case "rect":
+		x, y := r.length(node, "x", width, style), r.length(node, "y", height, style)
+		w, h := r.length(node, "width", width, style), r.length(node, "height", height, style)
+
+		if w <= 0 || h <= 0 {
+			return
+		}
+
+		rx, rxOk := parseSVGLength(node.Attrs["rx"], width, style.FontSize)
+		ry, ryOk := parseSVGLength(node.Attrs["ry"], height, style.FontSize)
+
+		if !rxOk {
+			rx = ry
+		}
+		if !ryOk {
+			ry = rx
+		}
+
+		rx, ry = math.Max(0, math.Min(rx, w/2)), math.Max(0, math.Min(ry, h/2))
+
+		p := &canvas.Path{}
+
+		if rx == 0 || ry == 0 {
+			p = canvas.Rectangle(w, h).Translate(x, y)
+		} else {
+			p.MoveTo(x+rx, y)
+			p.LineTo(x+w-rx, y)
+			p.ArcTo(rx, ry, 0, false, true, x+w, y+ry)
+			p.LineTo(x+w, y+h-ry)
+			p.ArcTo(rx, ry, 0, false, true, x+w-rx, y+h)
+			p.LineTo(x+rx, y+h)
+			p.ArcTo(rx, ry, 0, false, true, x, y+h-ry)
+			p.LineTo(x, y+ry)
+			p.ArcTo(rx, ry, 0, false, true, x+rx, y)
+			p.Close()
+		}
+
+		r.drawPath(p, style, m)
+	case "circle":
+		radius := r.length(node, "r", diagonal, style)
+
+		if radius > 0 {
+			r.drawPath(canvas.Circle(radius).Translate(r.length(node, "cx", width, style), r.length(node, "cy", height, style)), style, m)
+		}
+	case "ellipse":
+		rx, ry := r.length(node, "rx", width, style), r.length(node, "ry", height, style)
+
+		if rx > 0 && ry > 0 {
+			r.drawPath(canvas.Ellipse(rx, ry).Translate(r.length(node, "cx", width, style), r.length(node, "cy", height, style)), style, m)
+		}
+	case "line":
+		p := &canvas.Path{}
+		p.MoveTo(r.length(node, "x1", width, style), r.length(node, "y1", height, style))
+		p.LineTo(r.length(node, "x2", width, style), r.length(node, "y2", height, style))
+
+		// lines are never filled
+		style.Fill = nil
+		r.drawPath(p, style, m)
+	case "polyline", "polygon":
+		points := svgNumbers(node.Attrs["points"])
+
+		if len(points) < 4 {
+			return
+		}
+
+		p := &canvas.Path{}
+		p.MoveTo(points[0], points[1])
+
+		for i := 2; i+1 < len(points); i += 2 {
+			p.LineTo(points[i], points[i+1])
+		}
+
+		if node.Tag == "polygon" {
+			p.Close()
+		}
+
+		r.drawPath(p, style, m)
+	case "path":
+		p, err := canvas.ParseSVGPath(node.Attrs["d"])
+
+		// like browsers, draw the path up to the error
+		if err != nil {
+			r.unsupportedFeature("malformed path")
+		}
+
+		if p != nil {
+			r.drawPath(p, style, m)
+		}
+	case "text":
+		r.drawText(node, style, m)
+	case "image":
+		r.drawImage(node, style, m)
+	case "use", "foreignObject":
+		r.unsupportedFeature("<" + node.Tag + ">")
+	}
+}
+
+func svgPaint(c *color.NRGBA, opacity float64) canvas.Paint {
+	if c == nil || opacity <= 0 {
+		return canvas.Paint{}
+	}
+
+	nrgba := *c
+	nrgba.A = uint8(math.Round(float64(nrgba.A) * opacity))
+
+	return canvas.Paint{Color: color.RGBAModel.Convert(nrgba).(color.RGBA)}
+}
+
+func (r *svgRenderer) drawPath(p *canvas.Path, style svgStyle, m canvas.Matrix) {
+	if style.Hidden || p.Empty() {
+		return
+	}
+
+	s := canvas.DefaultStyle
+	s.Fill = svgPaint(style.Fill, style.FillOpacity*style.Opacity)
+	s.Stroke = svgPaint(style.Stroke, style.StrokeOpacity*style.Opacity)
+	s.StrokeWidth = style.StrokeWidth
+	s.StrokeCapper = style.LineCap
+	s.StrokeJoiner = style.LineJoin
+
+	if style.StrokeWidth == 0 {
+		s.Stroke = canvas.Paint{}
+	}
+
+	if style.EvenOdd {
+		s.FillRule = canvas.EvenOdd
+	}
+
+	if !s.HasFill() && !s.HasStroke() {
+		return
+	}
+
+	r.canvas.RenderPath(p, s, m)
+}
+
+// textPen is where the next run of a text element is drawn.
+type textPen struct {
+	X, Y float64
+	// Space is whether the last run ended with a space, which the next one
+	// collapses into.
+	Space bool
+	First bool
+}
+
+func (r *svgRenderer) drawText(node *svgNode, style svgStyle, m canvas.Matrix) {
+	pen := &textPen{First: true}
+	r.drawTextRuns(node, style, m, pen)
+}
+
+func (r *svgRenderer) drawTextRuns(node *svgNode, style svgStyle, m canvas.Matrix, pen *textPen) {
+	width, height := r.viewport[0], r.viewport[1]
+
+	// only the first of a list of positions is used
+	position := func(attr string, ref float64) (float64, bool) {
+		fields := strings.FieldsFunc(node.Attrs[attr], func(r rune) bool { return r == ',' || r == ' ' })
+		if len(fields) == 0 {
+			return 0, false
+		}
+		if len(fields) > 1 {
+			r.unsupportedFeature("per glyph text positions")
+		}
+		return parseSVGLength(fields[0], ref, style.FontSize)
+	}
+
+	if x, ok := position("x", width); ok {
+		pen.X = x
+	}
+	if y, ok := position("y", height); ok {
+		pen.Y = y
+	}
+	if dx, ok := position("dx", width); ok {
+		pen.X += dx
+	}
+	if dy, ok := position("dy", height); ok {
+		pen.Y += dy
+	}
+
+	for i, child := range node.Children {
+		switch child.Tag {
+		case "":
+			text := collapseWhitespace(child.Text, pen.Space || pen.First)
+
+			// trailing whitespace of the whole element is dropped
+			if i == len(node.Children)-1 && node.Tag == "text" {
+				text = strings.TrimRight(text, " ")
+			}
+
+			if text == "" {
+				continue
+			}
+
+			pen.First = false
+			pen.Space = strings.HasSuffix(text, " ")
+			r.drawTextRun(text, style, m, pen)
+		case "tspan", "a":
+			childStyle := r.computeStyle(child, style)
+
+			if childStyle.Display == "none" {
+				continue
+			}
+
+			r.drawTextRuns(child, childStyle, m, pen)
+		case "textPath":
+			r.unsupportedFeature("<textPath>")
+		}
+	}
+}
+
+// collapseWhitespace collapses whitespace like browsers do, dropping
+// leading whitespace when it follows a space or starts the text.
+func collapseWhitespace(text string, trimLeading bool) string {
+	text = svgWhitespaceRegex.ReplaceAllString(text, " ")
+
+	if trimLeading {
+		return strings.TrimLeft(text, " ")
+	}
+	return text
+}
+
+func (r *svgRenderer) drawTextRun(text string, style svgStyle, m canvas.Matrix, pen *textPen) {
+	if style.Hidden || style.Fill == nil {
+		return
+	}
+
+	fontStyle := canvas.FontRegular
+	if style.Bold {
+		fontStyle |= canvas.FontBold
+	}
+	if style.Italic {
+		fontStyle |= canvas.FontItalic
+	}
+
+	paint := svgPaint(style.Fill, style.FillOpacity*style.Opacity)
+	// font sizes are in points, user units are treated as millimeters
+	face := r.fonts[style.FontFamily].Face(style.FontSize*72/25.4, paint.Color, fontStyle)
+	advance := face.TextWidth(text)
+
+	x := pen.X
+	switch style.TextAnchor {
+	case "middle":
+		x -= advance / 2
+	case "end":
+		x -= advance
+	}
+
+	// glyphs are drawn upwards from the baseline, user space points down
+	r.canvas.RenderText(canvas.NewTextLine(face, text, canvas.Left), m.Translate(x, pen.Y).ReflectY())
+
+	pen.X += advance
+}
+
+func (r *svgRenderer) drawImage(node *svgNode, style svgStyle, m canvas.Matrix) {
+	if style.Hidden {
+		return
+	}
+
+	href := node.Attrs["href"]
+
+	if href == "" {
+		return
+	}
+
+	data, err := Resource(href).Decode(r.ctx)
+
+	if err != nil {
+		r.unsupportedFeature("unloadable image")
+		return
+	}
+
+	width, height := r.viewport[0], r.viewport[1]
+	x, y := r.length(node, "x", width, style), r.length(node, "y", height, style)
+	w, wOk := parseSVGLength(node.Attrs["width"], width, style.FontSize)
+	h, hOk := parseSVGLength(node.Attrs["height"], height, style.FontSize)
+
+	var (
+		img image.Image
+		// the size the image has when no width or height is given, which
+		// for SVGs isn't the size they were rasterized at
+		naturalWidth, naturalHeight float64
+	)
+
+	if data.ContentType == "image/svg+xml" {
+		if r.depth >= 3 {
+			r.unsupportedFeature("deeply nested SVG images")
+			return
+		}
+
+		iw, ih, err := SVGSize(data.Raw)
+
+		if err != nil {
+			r.unsupportedFeature("unloadable image")
+			return
+		}
+
+		naturalWidth, naturalHeight = iw, ih
+
+		// rasterized at the size it's drawn at, at the output resolution
+		scale := r.scale * math.Sqrt(math.Abs(m.Det()))
+		if wOk && hOk && iw > 0 && ih > 0 {
+			scale *= math.Max(w/iw, h/ih)
+		}
+
+		img, err = rasterizeSVG(r.ctx, data.Raw, scale, r.depth+1)
+
+		if errors.Is(err, ErrUnsupportedSVG) {
+			r.unsupportedFeature("nested " + err.Error())
+		} else if err != nil {
+			r.unsupportedFeature("unloadable image")
+			return
+		}
+	} else if img, _, err = image.Decode(bytes.NewReader(data.Raw)); err != nil {
+		r.unsupportedFeature("unloadable image")
+		return
+	}
+
+	bounds := img.Bounds()
+	iw, ih := float64(bounds.Dx()), float64(bounds.Dy())
+
+	if naturalWidth == 0 || naturalHeight == 0 {
+		naturalWidth, naturalHeight = iw, ih
+	}
+
+	if !wOk && !hOk {
+		w, h = naturalWidth, naturalHeight
+	} else if !wOk {
+		w = h * naturalWidth / naturalHeight
+	} else if !hOk {
+		h = w * naturalHeight / naturalWidth
+	}
+
+	if w <= 0 || h <= 0 {
+		return
+	}
+
+	if style.Opacity < 1 {
+		r.unsupportedFeature("image opacity")
+	}
+
+	if strings.HasSuffix(node.Attrs["preserveAspectRatio"], "slice") {
+		r.unsupportedFeature("image clipping")
+	}
+
+	// images have their origin at the bottom left as well
+	fit := fitViewBox([4]float64{0, 0, iw, ih}, w, h, node.Attrs["preserveAspectRatio"])
+	r.canvas.RenderImage(img, m.Translate(x, y).Mul(fit).Translate(0, ih).ReflectY())
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden images in testdata")
+
+// checkerPNG is a 2x2 red and blue checkerboard.
+func checkerPNG(t *testing.T) string {
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	red, blue := color.NRGBA{0xff, 0, 0, 0xff}, color.NRGBA{0, 0, 0xff, 0xff}
+	img.Set(0, 0, red)
+	img.Set(1, 1, red)
+	img.Set(1, 0, blue)
+	img.Set(0, 1, blue)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+const nestedSVG = `<svg xmlns="http://www.w3.org/2000/svg" width="10" height="20" viewBox="0 0 10 20">` +
+	`<rect width="10" height="20" fill="#222"/><circle cx="5" cy="10" r="4" fill="yellow"/></svg>`
+
+func nestedSVGURI() string {
+	return "data:image/svg+xml;base64," + base64.StdEncoding.EncodeToString([]byte(nestedSVG))
+}
+
+var svgGoldenTests = []struct {
+	name string
+	svg  func(t *testing.T) string
+}{
+	{"shapes", func(t *testing.T) string {
+		return `<svg xmlns="http://www.w3.org/2000/svg" width="40" height="40" viewBox="0 0 40 40">
+			<style>.a { fill: teal; stroke: black; stroke-width: 1 } #b { fill: rgb(255, 128, 0) }</style>
+			<rect x="2" y="2" width="16" height="16" rx="3" class="a"/>
+			<circle id="b" cx="30" cy="10" r="8"/>
+			<ellipse cx="10" cy="30" rx="8" ry="5" fill="purple" opacity="0.5"/>
+			<line x1="22" y1="22" x2="38" y2="38" stroke="red" stroke-width="2"/>
+			<polygon points="22,38 30,22 38,38" fill="none" stroke="navy"/>
+			<path d="M2 22 Q10 14 18 22 T34 22" fill="none" stroke="green" transform="translate(0 12)"/>
+		</svg>`
+	}},
+	{"text", func(t *testing.T) string {
+		return `<svg xmlns="http://www.w3.org/2000/svg" width="80" height="40">
+			<text x="2" y="12" font-family="sans-serif" font-size="10">Sans</text>
+			<text x="2" y="24" font-family="serif" font-size="10" font-style="italic">Serif</text>
+			<text x="2" y="36" font-family="monospace" font-size="10" font-weight="bold" fill="blue">Mono <tspan fill="red">1</tspan></text>
+			<text x="78" y="12" font-size="8" text-anchor="end">end</text>
+		</svg>`
+	}},
+	{"images", func(t *testing.T) string {
+		return `<svg xmlns="http://www.w3.org/2000/svg" width="60" height="20">
+			<image href="` + checkerPNG(t) + `" width="8" height="8" style="image-rendering: pixelated"/>
+			<image href="` + nestedSVGURI() + `" x="10" width="10"/>
+			<rect x="20" width="20" height="20" fill="none" stroke="gray" stroke-width="0.5"/>
+			<image href="` + nestedSVGURI() + `" x="20" width="20" height="20" preserveAspectRatio="xMinYMid meet"/>
+			<rect x="40" width="20" height="20" fill="none" stroke="gray" stroke-width="0.5"/>
+			<image href="` + nestedSVGURI() + `" x="40" width="20" height="20" preserveAspectRatio="none"/>
+		</svg>`
+	}},
+	{"viewbox", func(t *testing.T) string {
+		return `<svg xmlns="http://www.w3.org/2000/svg" width="40" height="20" viewBox="0 0 10 10" preserveAspectRatio="xMaxYMid meet">
+			<rect width="10" height="10" fill="orange"/><circle cx="5" cy="5" r="3"/>
+		</svg>`
+	}},
+}
+
+func TestRasterizeSVGGolden(t *testing.T) {
+	for _, test := range svgGoldenTests {
+		t.Run(test.name, func(t *testing.T) {
+			img, err := RasterizeSVG(context.Background(), []byte(test.svg(t)), PartScale)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			path := filepath.Join("testdata", "svg", test.name+".png")
+
+			if *updateGolden {
+				if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := imaging.Save(img, path); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			golden, err := imaging.Open(path)
+
+			if err != nil {
+				t.Fatalf("%v, run the tests with -update to create it", err)
+			}
+
+			compareImages(t, img, golden)
+		})
+	}
+}
+
+// compareImages fails when more than a few pixels differ noticeably, which
+// leaves room for floating point differences between platforms.
+func compareImages(t *testing.T, got, want image.Image) {
+	t.Helper()
+
+	if got.Bounds().Size() != want.Bounds().Size() {
+		t.Fatalf("got a %v image, want %v", got.Bounds().Size(), want.Bounds().Size())
+	}
+
+	a, b := imaging.Clone(got), imaging.Clone(want)
+	differing := 0
+
+	for i := 0; i < len(a.Pix); i += 4 {
+		for c := 0; c < 4; c++ {
+			if d := int(a.Pix[i+c]) - int(b.Pix[i+c]); d > 8 || d < -8 {
+				differing++
+				break
+			}
+		}
+	}
+
+	if total := len(a.Pix) / 4; differing*200 > total {
+		t.Errorf("%d of %d pixels differ", differing, total)
+	}
+}
+
+func TestRasterizeSVGNestedScale(t *testing.T) {
+	// a nested SVG is rasterized at the output resolution, so it's as sharp
+	// as the same shapes drawn directly
+	for _, scale := range []float64{1, 2, 5} {
+		nested, err := RasterizeSVG(context.Background(), []byte(
+			`<svg xmlns="http://www.w3.org/2000/svg" width="20" height="40" viewBox="0 0 10 20">`+
+				`<image href="`+nestedSVGURI()+`"/></svg>`), scale)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		direct, err := RasterizeSVG(context.Background(), []byte(
+			`<svg xmlns="http://www.w3.org/2000/svg" width="20" height="40" viewBox="0 0 10 20">`+
+				`<rect width="10" height="20" fill="#222"/><circle cx="5" cy="10" r="4" fill="yellow"/></svg>`), scale)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		compareImages(t, nested, direct)
+	}
+}
+
+func TestRasterizeSVGUnsupported(t *testing.T) {
+	img, err := RasterizeSVG(context.Background(), []byte(
+		`<svg xmlns="http://www.w3.org/2000/svg" width="10" height="10">`+
+			`<defs><linearGradient id="g"/></defs><rect width="10" height="10" fill="url(#g)"/></svg>`), 1)
+
+	if !errors.Is(err, ErrUnsupportedSVG) {
+		t.Fatalf("got %v, want ErrUnsupportedSVG", err)
+	}
+
+	if img == nil {
+		t.Fatal("no best effort render")
+	}
+}
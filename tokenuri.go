@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrNotDataURI is returned for tokenURIs that point elsewhere instead of
+// embedding the metadata.
+var ErrNotDataURI = errors.New("tokenURI is not a data URI")
+
+// DecodeTokenURI decodes on-chain metadata: data:application/json URIs
+// with a base64, utf8 or percent-encoded payload, or bare JSON. JSON that
+// doesn't parse is repaired (see RepairJSON) rather than dropped.
+func DecodeTokenURI(tokenUri string) (*Metadata, error) {
+	payload, err := tokenURIPayload(tokenUri)
+
+	if err != nil {
+		return nil, err
+	}
+
+	metadata, err := ParseMetadata(payload)
+
+	if err == nil {
+		return metadata, nil
+	}
+
+	var syntaxErr *json.SyntaxError
+	if !errors.As(err, &syntaxErr) {
+		return nil, err
+	}
+
+	metadata, repairErr := ParseMetadata(RepairJSON(payload))
+
+	if repairErr != nil {
+		// the original error points at the actual problem
+		return nil, fmt.Errorf("tokenURI: %w", err)
+	}
+	return metadata, nil
+}
+
+// tokenURIPayload returns the JSON embedded in a tokenURI.
+func tokenURIPayload(tokenUri string) ([]byte, error) {
+	tokenUri = strings.TrimSpace(tokenUri)
+
+	if strings.HasPrefix(tokenUri, "{") {
+		return []byte(tokenUri), nil
+	}
+
+	if len(tokenUri) < 5 || !strings.EqualFold(tokenUri[:5], "data:") {
+		return nil, ErrNotDataURI
+	}
+
+	// base64, utf8 and percent-encoded payloads are all decoded the way
+	// data URIs in the metadata are
+	data, err := DecodeData(tokenUri)
+
+	if err != nil {
+		return nil, fmt.Errorf("tokenURI: %w", err)
+	}
+
+	// DecodeData defaults a missing media type to text/plain
+	if data.ContentType != "application/json" && data.ContentType != "text/plain" {
+		return nil, fmt.Errorf("tokenURI: unexpected media type %q", data.ContentType)
+	}
+	return data.Raw, nil
+}
+
+// decodeBase64 accepts padded and unpadded, standard and URL-safe base64,
+// and ignores whitespace some contracts wrap it in.
+func decodeBase64(data string) ([]byte, error) {
+	data = strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\n', '\r', '\t':
+			return -1
+		}
+		return r
+	}, data)
+
+	data = strings.TrimRight(string(percentDecode(data)), "=")
+
+	if strings.ContainsAny(data, "-_") {
+		return base64.RawURLEncoding.DecodeString(data)
+	}
+	return base64.RawStdEncoding.DecodeString(data)
+}
+
+// RepairJSON fixes the ways hand built metadata tends to be malformed, so
+// no field has to be dropped:
+//
+//   - quotes inside strings that weren't escaped; a quote only ends a
+//     string when what follows can continue the JSON
+//   - raw newlines, tabs and other control characters inside strings
+//   - backslashes that don't start a valid escape
+//   - invalid UTF-8
+//
+// Valid JSON comes out unchanged.
+func RepairJSON(data []byte) []byte {
+	if !utf8.Valid(data) {
+		data = bytes.ToValidUTF8(data, []byte("�"))
+	}
+
+	out := make([]byte, 0, len(data)+16)
+	inString := false
+
+	for i := 0; i < len(data); i++ {
+		b := data[i]
+
+		if !inString {
+			out = append(out, b)
+			if b == '"' {
+				inString = true
+			}
+			continue
+		}
+
+		switch {
+		case b == '\\':
+			if i+1 < len(data) && isJSONEscape(data[i+1:]) {
+				out = append(out, b, data[i+1])
+				i++
+			} else {
+				out = append(out, '\\', '\\')
+			}
+		case b == '"':
+			if closesString(data[i+1:]) {
+				out = append(out, b)
+				inString = false
+			} else {
+				out = append(out, '\\', '"')
+			}
+		case b < 0x20:
+			switch b {
+			case '\n':
+				out = append(out, '\\', 'n')
+			case '\r':
+				out = append(out, '\\', 'r')
+			case '\t':
+				out = append(out, '\\', 't')
+			default:
+				out = append(out, fmt.Sprintf(`\u%04x`, b)...)
+			}
+		default:
+			out = append(out, b)
+		}
+	}
+
+	if inString {
+		out = append(out, '"')
+	}
+
+	return out
+}
+
+// isJSONEscape reports whether rest, following a backslash, is a valid
+// escape sequence.
+func isJSONEscape(rest []byte) bool {
+	switch rest[0] {
+	case '"', '\\', '/', 'b', 'f', 'n', 'r', 't':
+		return true
+	case 'u':
+		if len(rest) < 5 {
+			return false
+		}
+		for _, h := range rest[1:5] {
+			if !strings.ContainsRune("0123456789abcdefABCDEF", rune(h)) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// closesString reports whether a quote followed by rest ends a string:
+// the JSON has to continue with a colon, the end of an object or array,
+// or a comma followed by the start of another key or value.
+func closesString(rest []byte) bool {
+	rest = bytes.TrimLeft(rest, " \t\r\n")
+
+	if len(rest) == 0 {
+		return true
+	}
+
+	switch rest[0] {
+	case ':', '}', ']':
+		return true
+	case ',':
+		next := bytes.TrimLeft(rest[1:], " \t\r\n")
+		if len(next) == 0 {
+			return false
+		}
+		switch c := next[0]; {
+		case c == '"', c == '{', c == '[', c == '-', c >= '0' && c <= '9':
+			return true
+		case bytes.HasPrefix(next, []byte("true")), bytes.HasPrefix(next, []byte("false")), bytes.HasPrefix(next, []byte("null")):
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"testing"
+	"unicode/utf8"
+)
+
+const sampleMetadata = `{"name":"Citizen #1","description":"A citizen","attributes":[{"trait_type":"Class","value":"Hacker"}],"image":"ipfs://Qm/1.png"}`
+
+func TestDecodeTokenURI(t *testing.T) {
+	tests := []struct {
+		name     string
+		tokenUri string
+		want     string
+		err      error
+	}{
+		{"bare JSON", sampleMetadata, "Citizen #1", nil},
+		{"base64", "data:application/json;base64," + base64.StdEncoding.EncodeToString([]byte(sampleMetadata)), "Citizen #1", nil},
+		{"unpadded url-safe base64", "data:application/json;base64," + base64.RawURLEncoding.EncodeToString([]byte(`{"name":"Citizen #1","description":"???>>>"}`)), "Citizen #1", nil},
+		{"wrapped base64", "data:application/json;base64," + base64.StdEncoding.EncodeToString([]byte(sampleMetadata))[:20] + "\n" + base64.StdEncoding.EncodeToString([]byte(sampleMetadata))[20:], "Citizen #1", nil},
+		{"charset and base64", "data:application/json;charset=utf-8;base64," + base64.StdEncoding.EncodeToString([]byte(sampleMetadata)), "Citizen #1", nil},
+		{"utf8", "data:application/json;utf8," + sampleMetadata, "Citizen #1", nil},
+		{"no media type", "data:," + sampleMetadata, "Citizen #1", nil},
+		{"upper case", "DATA:Application/JSON;BASE64," + base64.StdEncoding.EncodeToString([]byte(sampleMetadata)), "Citizen #1", nil},
+		{"percent-encoded", "data:application/json," + url.PathEscape(sampleMetadata), "Citizen #1", nil},
+		{"stray percent", `data:application/json,{"name":"100% citizen"}`, "100% citizen", nil},
+		{"unescaped quotes", `data:application/json;utf8,{"name":"The "Hacker"","description":"x"}`, `The "Hacker"`, nil},
+		{"raw newline", "data:application/json;utf8,{\"name\":\"two\nlines\"}", "two\nlines", nil},
+		{"invalid escape", `data:application/json;utf8,{"name":"C:\citizen"}`, `C:\citizen`, nil},
+		{"invalid UTF-8", "data:application/json;utf8,{\"name\":\"caf\xe9\"}", "caf\ufffd", nil},
+		{"http URI", "https://example.com/1.json", "", ErrNotDataURI},
+		{"ipfs URI", "ipfs://Qm/1.json", "", ErrNotDataURI},
+		{"no comma", "data:application/json;base64", "", ErrInvalidDataURI},
+		{"bad base64", "data:application/json;base64,!!!!", "", ErrInvalidDataURI},
+		{"unknown encoding", "data:application/json;gzip,H4sI", "", ErrUnsupportedEncoding},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			metadata, err := DecodeTokenURI(test.tokenUri)
+
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("got error %v, want %v", err, test.err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if metadata.Name != test.want {
+				t.Fatalf("got name %q, want %q", metadata.Name, test.want)
+			}
+		})
+	}
+}
+
+func TestDecodeTokenURIMediaType(t *testing.T) {
+	if _, err := DecodeTokenURI("data:image/svg+xml;base64,PHN2Zy8+"); err == nil {
+		t.Fatal("decoded an SVG as metadata")
+	}
+}
+
+func FuzzDecodeTokenURI(f *testing.F) {
+	f.Add(sampleMetadata)
+	f.Add("data:application/json;base64," + base64.StdEncoding.EncodeToString([]byte(sampleMetadata)))
+	f.Add("data:application/json;utf8," + sampleMetadata)
+	f.Add("data:application/json," + url.PathEscape(sampleMetadata))
+	f.Add(`data:application/json;utf8,{"name":"The "Hacker"","description":"\x"}`)
+	f.Add("data:;base64,")
+	f.Add("data:")
+
+	f.Fuzz(func(t *testing.T, tokenUri string) {
+		// anything goes as long as it doesn't panic
+		DecodeTokenURI(tokenUri)
+	})
+}
+
+func FuzzRepairJSON(f *testing.F) {
+	f.Add([]byte(sampleMetadata))
+	f.Add([]byte(`{"a":"b\"c","d":[1,2.5,true,null],"e":{"f":"\u00e9"}}`))
+	f.Add([]byte(`{"name":"The "Hacker"","description":"C:\x"}`))
+	f.Add([]byte("{\"name\":\"two\nlines\"}"))
+	f.Add([]byte(`"unterminated`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		repaired := RepairJSON(data)
+
+		// invalid UTF-8 is replaced even inside otherwise valid JSON
+		if json.Valid(data) && utf8.Valid(data) && !bytes.Equal(repaired, data) {
+			t.Fatalf("changed valid JSON %q into %q", data, repaired)
+		}
+	})
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"math/big"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/NT-community/citizen-gen/erc721"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	KindCitizen = "citizen"
+	KindPart    = "part"
+)
+
+// WalletToken is a citizen or part held by a wallet.
+type WalletToken struct {
+	Kind     string         `json:"kind"`
+	Season   int            `json:"season"`
+	ID       *big.Int       `json:"id"`
+	Contract common.Address `json:"contract"`
+	Part     string         `json:"part,omitempty"`
+	V2       bool           `json:"v2,omitempty"`
+	Image    string         `json:"image"`
+}
+
+// walletContract describes what the tokens of a contract are.
+type walletContract struct {
+	Kind   string
+	Season int
+	Part   string
+	V2     bool
+}
+
+// walletContracts maps every citizen and parts contract to what it holds.
+func walletContracts(citizens map[int]*CitizenContracts) map[common.Address]walletContract {
+	contracts := map[common.Address]walletContract{}
+
+	for season, c := range citizens {
+		contracts[c.OldAddress] = walletContract{Kind: KindCitizen, Season: season}
+		contracts[c.NewAddress] = walletContract{Kind: KindCitizen, Season: season, V2: true}
+	}
+
+	for _, set := range []map[int]map[string]string{LegacyPartsContracts, PartsContracts} {
+		for season, byPart := range set {
+			for part, addr := range byPart {
+				// "id" is an alias of "identity"
+				if part == "id" {
+					continue
+				}
+				contracts[common.HexToAddress(addr)] = walletContract{Kind: KindPart, Season: season, Part: part}
+			}
+		}
+	}
+
+	return contracts
+}
+
+func (w walletContract) token(contract common.Address, id *big.Int) WalletToken {
+	token := WalletToken{
+		Kind:     w.Kind,
+		Season:   w.Season,
+		ID:       id,
+		Contract: contract,
+		Part:     w.Part,
+		V2:       w.V2,
+	}
+
+	if w.Kind == KindCitizen {
+		token.Image = fmt.Sprintf("/s%d/pfp/%s", w.Season, id)
+	} else {
+		token.Image = fmt.Sprintf("/s%d/parts/%s/%s/render", w.Season, w.Part, id)
+	}
+
+	return token
+}
+
+// walletTokens lists what owner holds, from the indexer when it runs and
+// by enumerating the contracts otherwise. source says which was used.
+func walletTokens(ctx context.Context, owner common.Address, contracts map[common.Address]walletContract, backend bind.ContractBackend) (tokens []WalletToken, source string, err error) {
+	if indexer != nil {
+		holdings, err := indexer.Holdings(owner)
+
+		if err != nil {
+			return nil, "", err
+		}
+
+		for _, h := range holdings {
+			if w, ok := contracts[h.Contract]; ok {
+				tokens = append(tokens, w.token(h.Contract, h.ID))
+			}
+		}
+
+		sortWalletTokens(tokens)
+		return tokens, "indexer", nil
+	}
+
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		errs []error
+	)
+
+	for address, w := range contracts {
+		wg.Add(1)
+		go func(address common.Address, w walletContract) {
+			defer wg.Done()
+
+			held, err := enumerateTokens(ctx, address, owner, backend)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			// contracts that aren't enumerable are skipped, the chain being
+			// unreachable (or replaced by a snapshot) is not
+			if IsTransient(err) || errors.Is(err, ErrOffline) {
+				errs = append(errs, err)
+			}
+
+			for _, id := range held {
+				tokens = append(tokens, w.token(address, id))
+			}
+		}(address, w)
+	}
+
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return nil, "", errors.Join(errs...)
+	}
+
+	sortWalletTokens(tokens)
+	return tokens, "chain", nil
+}
+
+// enumerateTokens lists the tokens of owner through ERC721Enumerable.
+func enumerateTokens(ctx context.Context, address, owner common.Address, backend bind.ContractBackend) ([]*big.Int, error) {
+	contract, err := erc721.NewErc721(address, backend)
+
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &bind.CallOpts{Context: ctx}
+
+	balance, err := contract.BalanceOf(opts, owner)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []*big.Int
+
+	for i := int64(0); i < balance.Int64(); i++ {
+		id, err := contract.TokenOfOwnerByIndex(opts, owner, big.NewInt(i))
+
+		if err != nil {
+			return ids, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+func sortWalletTokens(tokens []WalletToken) {
+	sort.Slice(tokens, func(i, j int) bool {
+		a, b := tokens[i], tokens[j]
+		if a.Kind != b.Kind {
+			return a.Kind == KindCitizen
+		}
+		if a.Season != b.Season {
+			return a.Season < b.Season
+		}
+		if a.Part != b.Part {
+			return a.Part < b.Part
+		}
+		return a.ID.Cmp(b.ID) < 0
+	})
+}
+
+func parseWalletAddress(c echo.Context) (common.Address, error) {
+	address := c.Param("address")
+
+	if !common.IsHexAddress(address) {
+		return common.Address{}, fmt.Errorf("invalid address %q", address)
+	}
+
+	return common.HexToAddress(address), nil
+}
+
+func wallet(citizens map[int]*CitizenContracts, backend bind.ContractBackend) func(c echo.Context) error {
+	contracts := walletContracts(citizens)
+
+	return func(c echo.Context) error {
+		owner, err := parseWalletAddress(c)
+
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+
+		tokens, source, err := walletTokens(c.Request().Context(), owner, contracts, backend)
+
+		if err != nil {
+			return c.String(chainStatus(err, http.StatusInternalServerError), err.Error())
+		}
+
+		if tokens == nil {
+			tokens = []WalletToken{}
+		}
+
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"address": owner,
+			"source":  source,
+			"tokens":  tokens,
+		})
+	}
+}
+
+// collage renders every citizen of a wallet into a grid. size is the size
+// of a cell ("WxH" or "pfp", the default), spacing the gap between cells
+// and around the grid, and bg-color the color showing through the gaps.
+func collage(citizens map[int]*CitizenContracts, backend bind.ContractBackend) func(c echo.Context) error {
+	contracts := walletContracts(citizens)
+
+	return func(c echo.Context) error {
+		owner, err := parseWalletAddress(c)
+
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+
+		enc, err := NegotiateEncoding(c, false)
+
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+
+		ctx := c.Request().Context()
+		tokens, _, err := walletTokens(ctx, owner, contracts, backend)
+
+		if err != nil {
+			return c.String(chainStatus(err, http.StatusInternalServerError), err.Error())
+		}
+
+		size := c.QueryParam("size")
+
+		if size == "" {
+			size = "pfp"
+		}
+
+		var specs []*RenderSpec
+
+		// a citizen held on both the old and the V2 contract is drawn once
+		seen := map[string]bool{}
+
+		for _, token := range tokens {
+			key := fmt.Sprintf("%d/%s", token.Season, token.ID)
+
+			if token.Kind != KindCitizen || !token.ID.IsInt64() || seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			spec := &RenderSpec{
+				Season:  token.Season,
+				TokenID: int(token.ID.Int64()),
+				Format:  FormatPNG,
+			}
+
+			spec.Background.None = c.QueryParam("no-bg") != ""
+
+			if err := spec.setDimensions(size); err != nil {
+				return c.String(http.StatusBadRequest, err.Error())
+			}
+
+			if err := spec.Validate(); err != nil {
+				return c.String(http.StatusBadRequest, err.Error())
+			}
+
+			specs = append(specs, spec)
+		}
+
+		if len(specs) == 0 {
+			return c.String(http.StatusNotFound, "wallet holds no citizens")
+		}
+
+		cols := int(math.Ceil(math.Sqrt(float64(len(specs)))))
+
+		if str := c.QueryParam("cols"); str != "" {
+			if cols, err = strconv.Atoi(str); err != nil || cols < 1 {
+				return c.String(http.StatusBadRequest, "cols must be a positive integer")
+			}
+		}
+
+		cols = min(cols, len(specs))
+
+		spacing := 0
+
+		if str := c.QueryParam("spacing"); str != "" {
+			if spacing, err = strconv.Atoi(str); err != nil || spacing < 0 {
+				return c.String(http.StatusBadRequest, "spacing must be a non-negative integer")
+			}
+		}
+
+		grid := Grid{Cols: cols, Spacing: spacing}
+
+		if bgColorHex := c.QueryParam("bg-color"); bgColorHex != "" {
+			if grid.Background, err = validateBGColor(bgColorHex); err != nil {
+				return c.String(http.StatusBadRequest, err.Error())
+			}
+		}
+
+		if width, height := grid.Size(len(specs), specs[0].Width, specs[0].Height); width > MaxDimension || height > MaxDimension {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("collage would be %dx%d, the maximum is %d in either direction; use a smaller size or more columns", width, height, MaxDimension))
+		}
+
+		cells, err := renderCitizens(ctx, specs, citizens)
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if err != nil {
+			return c.String(statusOf(err), err.Error())
+		}
+
+		return storeAndServe(c, "", grid.Draw(cells), enc, nil)
+	}
+}
+
+// Grid lays out equally sized cells in rows of Cols, Spacing pixels apart
+// and from the edges, over Background (transparent when nil).
+type Grid struct {
+	Cols       int
+	Spacing    int
+	Background *color.RGBA
+}
+
+// Size returns the size of a grid of n cells.
+func (g Grid) Size(n, cellWidth, cellHeight int) (int, int) {
+	cols := min(g.Cols, n)
+	rows := (n + cols - 1) / cols
+	return cols*cellWidth + (cols+1)*g.Spacing, rows*cellHeight + (rows+1)*g.Spacing
+}
+
+// Draw composes cells, which all have the size of the first one.
+func (g Grid) Draw(cells []image.Image) *image.RGBA {
+	cellWidth, cellHeight := cells[0].Bounds().Dx(), cells[0].Bounds().Dy()
+	width, height := g.Size(len(cells), cellWidth, cellHeight)
+
+	canvas := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	if g.Background != nil {
+		draw.Draw(canvas, canvas.Bounds(), image.NewUniform(g.Background), image.Point{}, draw.Src)
+	}
+
+	for i, cell := range cells {
+		x := g.Spacing + (i%g.Cols)*(cellWidth+g.Spacing)
+		y := g.Spacing + (i/g.Cols)*(cellHeight+g.Spacing)
+
+		draw.Draw(canvas, image.Rect(x, y, x+cellWidth, y+cellHeight), cell, cell.Bounds().Min, draw.Over)
+	}
+
+	return canvas
+}
+
+// renderCitizens renders specs concurrently through the render cache.
+func renderCitizens(ctx context.Context, specs []*RenderSpec, citizens map[int]*CitizenContracts) ([]image.Image, error) {
+	cells := make([]image.Image, len(specs))
+	errs := make([]error, len(specs))
+	sem := make(chan struct{}, 4)
+
+	var wg sync.WaitGroup
+
+	for i, spec := range specs {
+		wg.Add(1)
+		go func(i int, spec *RenderSpec) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			cells[i], errs[i] = cachedCitizenImage(ctx, spec, citizens[spec.Season])
+		}(i, spec)
+	}
+
+	wg.Wait()
+
+	return cells, errors.Join(errs...)
+}
+
+// cachedCitizenImage renders spec through the render cache.
+func cachedCitizenImage(ctx context.Context, spec *RenderSpec, contracts *CitizenContracts) (image.Image, error) {
+	cacheKey := spec.CacheKey()
+
+	if data, _, err := renderCache.Get(ctx, cacheKey); err == nil {
+		if img, err := png.Decode(bytes.NewReader(data)); err == nil {
+			return img, nil
+		}
+	}
+
+	render, err := citizenImage(ctx, spec, contracts)
+
+	if err != nil || render.Missing != nil || ctx.Err() != nil {
+		if render != nil {
+			return render.Image, nil
+		}
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+
+	if err := png.Encode(&buf, render.Image); err == nil {
+		renderCache.Put(ctx, cacheKey, buf.Bytes(), CacheEntry{
+			ContentType: formatTypes[FormatPNG],
+			Metadata:    render.Metadata(spec),
+		})
+	}
+
+	return render.Image, nil
+}
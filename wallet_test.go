@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/NT-community/citizen-gen/erc721"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestWalletTokensOffline(t *testing.T) {
+	parsed, err := erc721.Erc721MetaData.GetAbi()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	citizen := common.HexToAddress("0xc171")
+	backend := &SnapshotBackend{
+		abi:       *parsed,
+		tokenURIs: map[common.Address]map[int64]string{citizen: {1: sampleMetadata}},
+	}
+	contracts := map[common.Address]walletContract{citizen: {Kind: KindCitizen, Season: 1}}
+
+	tokens, _, err := walletTokens(context.Background(), common.HexToAddress("0xa11ce"), contracts, backend)
+
+	if !errors.Is(err, ErrOffline) {
+		t.Fatalf("got %v and %d tokens, want ErrOffline", err, len(tokens))
+	}
+
+	if status := chainStatus(err, http.StatusInternalServerError); status != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d, want 503", status)
+	}
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+	"math/bits"
+	"sort"
+
+	"github.com/disintegration/imaging"
+)
+
+// maxWebPDimension is the largest width and height VP8L can describe.
+const maxWebPDimension = 1 << 14
+
+// VP8L alphabet sizes: green carries the literal green value and the
+// backward reference length prefixes.
+const (
+	webpLiteralSymbols  = 256
+	webpLengthSymbols   = 24
+	webpDistanceSymbols = 40
+	webpMaxCopy         = 4096
+)
+
+// webpCodeLengthOrder is the order code length code lengths are written in.
+var webpCodeLengthOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// EncodeWebP writes img as a lossless WebP (VP8L). It uses none of the
+// format's transforms nor its color cache, only backward references to
+// the pixels on the left and above, which is what pixel art compresses
+// well with.
+func EncodeWebP(w io.Writer, img image.Image) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	if width < 1 || height < 1 || width > maxWebPDimension || height > maxWebPDimension {
+		return errors.New("webp: image must be between 1 and 16384 pixels in either direction")
+	}
+
+	nrgba := imaging.Clone(img)
+	argb := make([]uint32, width*height)
+	alpha := false
+
+	for i := range argb {
+		p := nrgba.Pix[i*4 : i*4+4]
+		argb[i] = uint32(p[3])<<24 | uint32(p[0])<<16 | uint32(p[1])<<8 | uint32(p[2])
+		alpha = alpha || p[3] != 0xff
+	}
+
+	tokens := webpBackwardReferences(argb, width)
+
+	var (
+		green    = make([]int, webpLiteralSymbols+webpLengthSymbols)
+		red      = make([]int, webpLiteralSymbols)
+		blue     = make([]int, webpLiteralSymbols)
+		alphas   = make([]int, webpLiteralSymbols)
+		distance = make([]int, webpDistanceSymbols)
+	)
+
+	for _, t := range tokens {
+		if t.length == 0 {
+			green[t.argb>>8&0xff]++
+			red[t.argb>>16&0xff]++
+			blue[t.argb&0xff]++
+			alphas[t.argb>>24]++
+			continue
+		}
+
+		code, _, _ := webpPrefix(t.length)
+		green[webpLiteralSymbols+code]++
+
+		code, _, _ = webpPrefix(t.distance)
+		distance[code]++
+	}
+
+	bw := &bitWriter{}
+
+	bw.write(0x2f, 8)
+	bw.write(uint32(width-1), 14)
+	bw.write(uint32(height-1), 14)
+	if alpha {
+		bw.write(1, 1)
+	} else {
+		bw.write(0, 1)
+	}
+	bw.write(0, 3) // version
+
+	bw.write(0, 1) // no transforms
+	bw.write(0, 1) // no color cache
+	bw.write(0, 1) // a single set of prefix codes
+
+	greenCode := bw.writeHuffmanCode(green)
+	redCode := bw.writeHuffmanCode(red)
+	blueCode := bw.writeHuffmanCode(blue)
+	alphaCode := bw.writeHuffmanCode(alphas)
+	distanceCode := bw.writeHuffmanCode(distance)
+
+	for _, t := range tokens {
+		if t.length == 0 {
+			greenCode.write(bw, int(t.argb>>8&0xff))
+			redCode.write(bw, int(t.argb>>16&0xff))
+			blueCode.write(bw, int(t.argb&0xff))
+			alphaCode.write(bw, int(t.argb>>24))
+			continue
+		}
+
+		code, n, extra := webpPrefix(t.length)
+		greenCode.write(bw, webpLiteralSymbols+code)
+		bw.write(uint32(extra), n)
+
+		code, n, extra = webpPrefix(t.distance)
+		distanceCode.write(bw, code)
+		bw.write(uint32(extra), n)
+	}
+
+	data := bw.bytes()
+
+	riffSize := 4 + 8 + len(data) + len(data)&1
+	header := make([]byte, 20)
+
+	copy(header, "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(riffSize))
+	copy(header[8:], "WEBPVP8L")
+	binary.LittleEndian.PutUint32(header[16:], uint32(len(data)))
+
+	if len(data)&1 == 1 {
+		data = append(data, 0)
+	}
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	_, err := w.Write(data)
+	return err
+}
+
+// webpToken is a literal pixel or, when length is set, a copy of length
+// pixels from distance, a VP8L distance code.
+type webpToken struct {
+	argb     uint32
+	length   int
+	distance int
+}
+
+// webpBackwardReferences greedily replaces runs of pixels repeating the
+// pixel on their left or above with copies.
+func webpBackwardReferences(argb []uint32, width int) []webpToken {
+	var tokens []webpToken
+
+	for i := 0; i < len(argb); {
+		left := webpMatch(argb, i, 1)
+		up := webpMatch(argb, i, width)
+
+		switch {
+		case up >= 3 && up >= left:
+			// distance code 1 is the pixel above
+			tokens = append(tokens, webpToken{length: up, distance: 1})
+			i += up
+		case left >= 3:
+			// and 2 the pixel on the left
+			tokens = append(tokens, webpToken{length: left, distance: 2})
+			i += left
+		default:
+			tokens = append(tokens, webpToken{argb: argb[i]})
+			i++
+		}
+	}
+
+	return tokens
+}
+
+// webpMatch returns how many pixels from i on repeat the ones distance
+// pixels back.
+func webpMatch(argb []uint32, i, distance int) int {
+	if i < distance {
+		return 0
+	}
+
+	n := 0
+	for i+n < len(argb) && n < webpMaxCopy && argb[i+n] == argb[i+n-distance] {
+		n++
+	}
+	return n
+}
+
+// webpPrefix splits a length or distance into its prefix code and extra
+// bits.
+func webpPrefix(value int) (code int, n uint, extra int) {
+	d := value - 1
+
+	if d < 4 {
+		return d, 0, 0
+	}
+
+	highest := bits.Len(uint(d)) - 1
+	second := (d >> (highest - 1)) & 1
+	n = uint(highest - 1)
+
+	return 2*highest + second, n, d & (1<<n - 1)
+}
+
+// bitWriter packs bits least significant first, as VP8L reads them.
+type bitWriter struct {
+	buf  []byte
+	acc  uint64
+	nacc uint
+}
+
+func (w *bitWriter) write(bits uint32, n uint) {
+	w.acc |= uint64(bits) << w.nacc
+	w.nacc += n
+
+	for w.nacc >= 8 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc >>= 8
+		w.nacc -= 8
+	}
+}
+
+func (w *bitWriter) bytes() []byte {
+	if w.nacc > 0 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc, w.nacc = 0, 0
+	}
+	return w.buf
+}
+
+// huffmanCode is a canonical prefix code. Symbols of length 0 take no bits,
+// which is how a code of a single symbol is written.
+type huffmanCode struct {
+	lengths []uint8
+	codes   []uint32
+}
+
+func (h huffmanCode) write(w *bitWriter, symbol int) {
+	w.write(h.codes[symbol], uint(h.lengths[symbol]))
+}
+
+// writeHuffmanCode writes the prefix code for the symbol counts and
+// returns it.
+func (w *bitWriter) writeHuffmanCode(counts []int) huffmanCode {
+	var symbols []int
+	for symbol, count := range counts {
+		if count > 0 {
+			symbols = append(symbols, symbol)
+		}
+	}
+
+	if len(symbols) <= 2 && (len(symbols) == 0 || symbols[len(symbols)-1] < 256) {
+		return w.writeSimpleCode(symbols, len(counts))
+	}
+
+	lengths := huffmanLengths(counts, 15)
+
+	// the code lengths are themselves prefix coded, with 17 and 18
+	// standing for runs of zeros
+	type clToken struct {
+		symbol int
+		extra  uint32
+		n      uint
+	}
+
+	var tokens []clToken
+	clCounts := make([]int, len(webpCodeLengthOrder))
+
+	for i := 0; i < len(lengths); {
+		if lengths[i] != 0 {
+			tokens = append(tokens, clToken{symbol: int(lengths[i])})
+			clCounts[lengths[i]]++
+			i++
+			continue
+		}
+
+		run := 1
+		for i+run < len(lengths) && lengths[i+run] == 0 && run < 138 {
+			run++
+		}
+
+		switch {
+		case run >= 11:
+			tokens = append(tokens, clToken{18, uint32(run - 11), 7})
+			clCounts[18]++
+		case run >= 3:
+			tokens = append(tokens, clToken{17, uint32(run - 3), 3})
+			clCounts[17]++
+		default:
+			run = 1
+			tokens = append(tokens, clToken{symbol: 0})
+			clCounts[0]++
+		}
+		i += run
+	}
+
+	clLengths := huffmanLengths(clCounts, 7)
+	clCode := huffmanCode{lengths: clLengths, codes: canonicalCodes(clLengths)}
+
+	numCodes := 4
+	for i, symbol := range webpCodeLengthOrder {
+		if clLengths[symbol] != 0 && i+1 > numCodes {
+			numCodes = i + 1
+		}
+	}
+
+	w.write(0, 1) // normal code
+	w.write(uint32(numCodes-4), 4)
+	for _, symbol := range webpCodeLengthOrder[:numCodes] {
+		w.write(uint32(clLengths[symbol]), 3)
+	}
+	w.write(0, 1) // every symbol has a length
+
+	for _, t := range tokens {
+		clCode.write(w, t.symbol)
+		w.write(t.extra, t.n)
+	}
+
+	return huffmanCode{lengths: lengths, codes: canonicalCodes(lengths)}
+}
+
+// writeSimpleCode writes a code of at most two symbols below 256.
+func (w *bitWriter) writeSimpleCode(symbols []int, alphabet int) huffmanCode {
+	code := huffmanCode{lengths: make([]uint8, alphabet), codes: make([]uint32, alphabet)}
+
+	if len(symbols) == 0 {
+		symbols = []int{0}
+	}
+
+	w.write(1, 1) // simple code
+	w.write(uint32(len(symbols)-1), 1)
+
+	if symbols[0] < 2 {
+		w.write(0, 1)
+		w.write(uint32(symbols[0]), 1)
+	} else {
+		w.write(1, 1)
+		w.write(uint32(symbols[0]), 8)
+	}
+
+	if len(symbols) == 2 {
+		w.write(uint32(symbols[1]), 8)
+
+		code.lengths[symbols[0]], code.lengths[symbols[1]] = 1, 1
+		code.codes[symbols[1]] = 1
+	}
+
+	return code
+}
+
+// huffmanLengths returns the code lengths of a Huffman code for counts no
+// longer than limit. At least two symbols get a length, so the code is
+// complete.
+func huffmanLengths(counts []int, limit int) []uint8 {
+	counts = append([]int{}, counts...)
+
+	var used int
+	for _, count := range counts {
+		if count > 0 {
+			used++
+		}
+	}
+
+	for i := 0; used < 2 && i < len(counts); i++ {
+		if counts[i] == 0 {
+			counts[i] = 1
+			used++
+		}
+	}
+
+	for {
+		lengths := huffmanTree(counts)
+
+		longest := uint8(0)
+		for _, length := range lengths {
+			if length > longest {
+				longest = length
+			}
+		}
+
+		if int(longest) <= limit {
+			return lengths
+		}
+
+		// flatten the distribution until the tree is shallow enough
+		for i, count := range counts {
+			if count > 0 {
+				counts[i] = (count + 1) / 2
+			}
+		}
+	}
+}
+
+// huffmanTree returns the depth of every symbol in the Huffman tree of
+// counts.
+func huffmanTree(counts []int) []uint8 {
+	type node struct {
+		weight      int
+		symbol      int
+		left, right int
+	}
+
+	var nodes []node
+	for symbol, count := range counts {
+		if count > 0 {
+			nodes = append(nodes, node{weight: count, symbol: symbol, left: -1, right: -1})
+		}
+	}
+
+	sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].weight < nodes[j].weight })
+
+	// two queues: the sorted leaves and the merged nodes, which are created
+	// in order of weight
+	leaves := len(nodes)
+	next, merged := 0, leaves
+
+	pop := func() int {
+		if next < leaves && (merged >= len(nodes) || nodes[next].weight <= nodes[merged].weight) {
+			next++
+			return next - 1
+		}
+		merged++
+		return merged - 1
+	}
+
+	for i := 0; i < leaves-1; i++ {
+		a, b := pop(), pop()
+		nodes = append(nodes, node{weight: nodes[a].weight + nodes[b].weight, symbol: -1, left: a, right: b})
+	}
+
+	lengths := make([]uint8, len(counts))
+
+	var walk func(i int, depth uint8)
+	walk = func(i int, depth uint8) {
+		if nodes[i].left < 0 {
+			lengths[nodes[i].symbol] = depth
+			return
+		}
+		walk(nodes[i].left, depth+1)
+		walk(nodes[i].right, depth+1)
+	}
+	walk(len(nodes)-1, 0)
+
+	return lengths
+}
+
+// canonicalCodes assigns the canonical codes of lengths, bit reversed for
+// bitWriter.
+func canonicalCodes(lengths []uint8) []uint32 {
+	var count [16]uint32
+	for _, length := range lengths {
+		count[length]++
+	}
+	count[0] = 0
+
+	var next [16]uint32
+	code := uint32(0)
+	for length := 1; length < 16; length++ {
+		code = (code + count[length-1]) << 1
+		next[length] = code
+	}
+
+	codes := make([]uint32, len(lengths))
+	for symbol, length := range lengths {
+		if length == 0 {
+			continue
+		}
+		codes[symbol] = bits.Reverse32(next[length]) >> (32 - uint(length))
+		next[length]++
+	}
+	return codes
+}
@@ -2,6 +2,10 @@ package main
 
 import (
 	"encoding/xml"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
 )
 
 type XMLImage struct {
@@ -23,3 +27,82 @@ func CollectImages(data []byte) ([]XMLImage, error) {
 
 	return imgs.Images, nil
 }
+
+var (
+	svgImageRegex   = regexp.MustCompile(`(?s)<image\b[^>]*?(?:/>|>.*?</image\s*>)`)
+	svgHrefRegex    = regexp.MustCompile(`(\s(?:xlink:)?href\s*=\s*)("[^"]*"|'[^']*')`)
+	svgRootRegex    = regexp.MustCompile(`<svg\b[^>]*?(/?>)`)
+	svgSizeRegex    = regexp.MustCompile(`\s(?:width|height|preserveAspectRatio)\s*=\s*(?:"[^"]*"|'[^']*')`)
+	svgViewBoxRegex = regexp.MustCompile(`\sviewBox\s*=`)
+)
+
+// CitizenSVG rewrites the on-chain SVG of a citizen for spec, leaving the
+// layers as links: their hrefs are resolved for the spec's gender, hidden
+// layers are left out, the background follows the spec and the image is
+// sized to it. When covering, the head and feet anchors keep the top and
+// the bottom in view. Layers are matched the way ImageGenerator composes
+// them.
+func CitizenSVG(svg []byte, spec *RenderSpec) []byte {
+	idx := -1
+	backgroundColor := spec.Background.RGBA()
+
+	out := svgImageRegex.ReplaceAllFunc(svg, func(element []byte) []byte {
+		idx++
+
+		match := svgHrefRegex.FindSubmatchIndex(element)
+		if match == nil {
+			return element
+		}
+
+		href := html.UnescapeString(string(element[match[4]+1 : match[5]-1]))
+		hidden := spec.HidesLayer(layerCategory(href))
+
+		switch {
+		case hidden && idx > 0:
+			return nil
+		case strings.Contains(href, "cloth") && spec.NoClothes:
+			return nil
+		case idx == 0 && backgroundColor != nil:
+			return []byte(fmt.Sprintf(`<rect width="100%%" height="100%%" fill="#%s"/>`, colorHex(backgroundColor)))
+		case idx == 0 && (spec.Background.None || hidden):
+			return nil
+		}
+
+		resolved := `"` + html.EscapeString(resolveLayerURL(href, spec)) + `"`
+
+		return []byte(string(element[:match[4]]) + resolved + string(element[match[5]:]))
+	})
+
+	root := svgRootRegex.FindSubmatchIndex(out)
+	if root == nil {
+		return out
+	}
+
+	tag := svgSizeRegex.ReplaceAllString(string(out[root[0]:root[2]]), "")
+
+	if !svgViewBoxRegex.MatchString(tag) {
+		// the layers are 1200x1200
+		tag += ` viewBox="0 0 1200 1200"`
+	}
+
+	width, height := spec.FitSize(1200)
+	aspect := "none"
+
+	switch spec.Fit {
+	case FitContain:
+		// letterboxed, the background layer only covers the citizen
+		width, height = spec.Width, spec.Height
+		aspect = "xMidYMid meet"
+	case FitCover:
+		width, height = spec.Width, spec.Height
+		aspect = map[Anchor]string{
+			AnchorCenter: "xMidYMid slice",
+			AnchorHead:   "xMidYMin slice",
+			AnchorFeet:   "xMidYMax slice",
+		}[spec.Anchor]
+	}
+
+	tag += fmt.Sprintf(` width="%d" height="%d" preserveAspectRatio="%s"`, width, height, aspect)
+
+	return []byte(string(out[:root[0]]) + tag + string(out[root[2]:]))
+}